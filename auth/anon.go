@@ -1,6 +1,8 @@
 package auth
 
 import (
+	"strconv"
+
 	"github.com/gammazero/nexus/v3/wamp"
 )
 
@@ -14,7 +16,7 @@ type AnonymousAuth struct {
 func (a AnonymousAuth) Authenticate(_ wamp.ID, _ wamp.Dict, _ wamp.Peer) (*wamp.Welcome, error) {
 	return &wamp.Welcome{
 		Details: wamp.Dict{
-			"authid": string(wamp.GlobalID()),
+			"authid": strconv.FormatUint(uint64(wamp.GlobalID()), 10),
 			"authrole": wamp.List{
 				a.AuthRole,
 			},
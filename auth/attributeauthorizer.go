@@ -0,0 +1,377 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/EmbeddedEnterprises/autobahnkreuz/auth/expression"
+	"github.com/EmbeddedEnterprises/autobahnkreuz/auth/multiauthorizer"
+	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
+
+	mapset "github.com/deckarep/golang-set"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// attributeVariables are the variables available in conditions.
+var attributeVariables = []string{
+	"authid", "authrole", "authextra", "authmethod", "authprovider",
+	"session", "transport", "uri", "segments", "action",
+}
+
+// AttributeAuthorizer authorizes actions by evaluating conditions on the
+// attributes of the session, the URI and the action, see package expression.
+// The rules are read from a file or fetched from an upstream RPC.
+type AttributeAuthorizer struct {
+	PermitDefault    bool
+	TrustedAuthRoles mapset.Set
+	// Path is the rule file, if it is empty the rules are fetched from
+	// RulesURI.
+	Path     string
+	RulesURI string
+	// RefreshInterval is the time between two reloads of the rules, 0
+	// disables the periodic reload. The rules are always reloaded on SIGHUP.
+	RefreshInterval time.Duration
+
+	// rules holds the current *attributeRules, it is empty until the first
+	// successful load.
+	rules atomic.Value
+	// done stops Watch when closed.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// AttributeFile contains the rules of the attribute authorizer, either in
+// YAML or in JSON.
+type AttributeFile struct {
+	Rules []AttributeRule `json:"rules" yaml:"rules"`
+}
+
+// AttributeRule allows or denies actions on URIs matching a pattern, if its
+// condition is true.
+type AttributeRule struct {
+	// URI is the pattern of the URIs the rule applies to, it applies to all
+	// URIs if empty.
+	URI string `json:"uri" yaml:"uri"`
+	// Match is the WAMP match policy of URI, by default URIs with empty
+	// components are wildcard patterns and all others are exact.
+	Match string `json:"match" yaml:"match"`
+	// Actions are call, register, subscribe, publish, unsubscribe,
+	// unregister, cancel and meta, all of them but meta if empty or *.
+	Actions []string `json:"actions" yaml:"actions"`
+	// Condition is an expression which has to be true for the rule to apply,
+	// the rule always applies if it is empty.
+	Condition string `json:"condition" yaml:"condition"`
+	// Effect is either allow (default) or deny.
+	Effect string `json:"effect" yaml:"effect"`
+}
+
+// attributeRule is a validated AttributeRule.
+type attributeRule struct {
+	ruleTarget
+	condition *expression.Expression
+	effect    Permission
+}
+
+// attributeRules is an immutable list of validated rules.
+type attributeRules struct {
+	rules []attributeRule
+}
+
+// NewAttributeAuthorizer creates an authorizer using the rule file at path or,
+// if path is empty, the rules returned by rulesURI.
+func NewAttributeAuthorizer(permitDefault bool, path string, rulesURI string, trustedAuthRoles mapset.Set) *AttributeAuthorizer {
+	return &AttributeAuthorizer{
+		PermitDefault:    permitDefault,
+		Path:             path,
+		RulesURI:         rulesURI,
+		TrustedAuthRoles: trustedAuthRoles,
+		done:             make(chan struct{}),
+	}
+}
+
+// compileAttributeRules validates the rules and compiles their conditions.
+func compileAttributeRules(file *AttributeFile) (*attributeRules, error) {
+	compiled := &attributeRules{
+		rules: make([]attributeRule, 0, len(file.Rules)),
+	}
+	for i, rule := range file.Rules {
+		var target ruleTarget
+		var err error
+		if rule.URI == "" && rule.Match == "" {
+			target.match = wamp.MatchPrefix
+			target.actions, err = compileRuleActions(rule.Actions)
+		} else {
+			target, err = compileRuleTarget(wamp.URI(rule.URI), rule.Match, rule.Actions)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Rule %d: %v", i, err)
+		}
+		effect, err := parseEffect(rule.Effect)
+		if err != nil {
+			return nil, fmt.Errorf("Rule %d: %v", i, err)
+		}
+
+		compiledRule := attributeRule{
+			ruleTarget: target,
+			effect:     effect,
+		}
+		if strings.TrimSpace(rule.Condition) != "" {
+			compiledRule.condition, err = expression.Compile(rule.Condition, attributeVariables...)
+			if err != nil {
+				return nil, fmt.Errorf("Rule %d: invalid condition: %v", i, err)
+			}
+		}
+		compiled.rules = append(compiled.rules, compiledRule)
+	}
+	return compiled, nil
+}
+
+// parseAttributeFile converts the reply of RulesURI, which is either a list of
+// rules or a dict containing `rules`.
+func parseAttributeFile(raw interface{}) (*AttributeFile, error) {
+	if dict, ok := wamp.AsDict(raw); ok && dict != nil {
+		raw = dict["rules"]
+	}
+	list, ok := wamp.AsList(raw)
+	if !ok {
+		return nil, errors.New("Rules are not a list")
+	}
+	file := &AttributeFile{}
+	for i, item := range list {
+		dict, ok := wamp.AsDict(item)
+		if !ok || dict == nil {
+			return nil, fmt.Errorf("Rule %d is not a dict", i)
+		}
+		rule := AttributeRule{
+			URI:       wamp.OptionString(dict, "uri"),
+			Match:     wamp.OptionString(dict, "match"),
+			Condition: wamp.OptionString(dict, "condition"),
+			Effect:    wamp.OptionString(dict, "effect"),
+		}
+		// Like in the file, missing actions mean all actions.
+		var actions wamp.List
+		if actionsRaw, ok := dict["actions"]; ok && actionsRaw != nil {
+			if actions, ok = wamp.AsList(actionsRaw); !ok {
+				return nil, fmt.Errorf("Rule %d: actions are not a list", i)
+			}
+		}
+		for _, action := range actions {
+			actionString, ok := wamp.AsString(action)
+			if !ok {
+				return nil, fmt.Errorf("Rule %d: action is not a string", i)
+			}
+			rule.Actions = append(rule.Actions, actionString)
+		}
+		file.Rules = append(file.Rules, rule)
+	}
+	return file, nil
+}
+
+// fetch reads the rules from Path or RulesURI.
+func (this *AttributeAuthorizer) fetch(ctx context.Context) (*AttributeFile, error) {
+	if this.Path != "" {
+		file := &AttributeFile{}
+		if err := readRuleFile(this.Path, file); err != nil {
+			return nil, fmt.Errorf("Failed to read rule file %s: %v", this.Path, err)
+		}
+		return file, nil
+	}
+
+	res, err := callUpstream(ctx, this.RulesURI, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var raw interface{} = res.ArgumentsKw["rules"]
+	if len(res.Arguments) > 0 {
+		raw = res.Arguments[0]
+	}
+	return parseAttributeFile(raw)
+}
+
+// source describes where the rules come from, for log messages.
+func (this *AttributeAuthorizer) source() string {
+	if this.Path != "" {
+		return this.Path
+	}
+	return this.RulesURI
+}
+
+// Load fetches and validates the rules. If they are invalid, the previous
+// rules stay active.
+func (this *AttributeAuthorizer) Load(ctx context.Context) error {
+	file, err := this.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	compiled, err := compileAttributeRules(file)
+	if err != nil {
+		return fmt.Errorf("Invalid attribute rules from %s: %v", this.source(), err)
+	}
+	this.rules.Store(compiled)
+	util.Logger.Infof("Loaded %d attribute rules from %s", len(compiled.rules), this.source())
+	return nil
+}
+
+// Watch loads the rules until they are available, the provider may register
+// its function after the router started. Afterwards they are reloaded on
+// SIGHUP and every RefreshInterval, until Close is called.
+func (this *AttributeAuthorizer) Watch() {
+	reloader{
+		name: "attribute rules from " + this.source(),
+		load: func() error {
+			return this.Load(context.Background())
+		},
+		loaded:   this.rules.Load() != nil,
+		interval: this.RefreshInterval,
+		hangup:   true,
+	}.run(this.done)
+}
+
+// Close stops Watch.
+func (this *AttributeAuthorizer) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.done)
+	})
+	return nil
+}
+
+// attributeEnv returns the variables of the conditions.
+func attributeEnv(sess *wamp.Session, roles *authRoles, uri wamp.URI, action string) map[string]interface{} {
+	authrole := make(wamp.List, len(*roles))
+	for i, role := range *roles {
+		authrole[i] = role
+	}
+	segments := wamp.List{}
+	for _, segment := range strings.Split(string(uri), ".") {
+		segments = append(segments, segment)
+	}
+	return map[string]interface{}{
+		"authid":       sess.Details["authid"],
+		"authrole":     authrole,
+		"authextra":    sess.Details["authextra"],
+		"authmethod":   sess.Details["authmethod"],
+		"authprovider": sess.Details["authprovider"],
+		"session":      sess.ID,
+		"transport":    sess.Details["transport"],
+		"uri":          string(uri),
+		"segments":     segments,
+		"action":       action,
+	}
+}
+
+// explainRule describes the i-th rule.
+func (r *attributeRules) explainRule(i int) wamp.Dict {
+	rule := &r.rules[i]
+	res := wamp.Dict{
+		"rule":  i,
+		"uri":   rule.uri,
+		"match": rule.match,
+	}
+	if rule.condition != nil {
+		res["condition"] = rule.condition.String()
+	}
+	return res
+}
+
+// Authorize permits or denies msg, if no rule applies PermitDefault is used.
+func (this *AttributeAuthorizer) Authorize(sess *wamp.Session, msg wamp.Message) (bool, error) {
+	decision, err := this.Decide(sess, msg)
+	return decision.Permitted(this.PermitDefault), err
+}
+
+// Decide abstains if no rule applies to msg or the rules are not loaded yet.
+func (this *AttributeAuthorizer) Decide(sess *wamp.Session, msg wamp.Message) (multiauthorizer.Decision, error) {
+	return this.decide(sess, msg, nil), nil
+}
+
+// Explain returns the decision and the rule it was taken from.
+func (this *AttributeAuthorizer) Explain(sess *wamp.Session, msg wamp.Message) multiauthorizer.Explanation {
+	details := wamp.Dict{}
+	decision := this.decide(sess, msg, details)
+	return multiauthorizer.Explanation{
+		Decision:  decision,
+		Permitted: decision.Permitted(this.PermitDefault),
+		Details:   details,
+	}
+}
+
+// decide makes the decision, the reasons are added to details if it is not
+// nil. A deny rule wins over an allow rule. If a condition can not be
+// evaluated, e.g. because an attribute has an unexpected type, an allow rule
+// does not apply, but a deny rule does.
+func (this *AttributeAuthorizer) decide(sess *wamp.Session, msg wamp.Message, details wamp.Dict) multiauthorizer.Decision {
+	roles, err := extractAuthRoles(sess.Details["authrole"])
+	if err != nil {
+		return multiauthorizer.Abstain
+	}
+
+	isTrustedAuthRole := roles.checkTrustedAuthRoles(this.TrustedAuthRoles)
+	if details != nil {
+		details["trusted"] = isTrustedAuthRole
+	}
+	if isTrustedAuthRole {
+		return multiauthorizer.Permit
+	}
+
+	uri, action := resolveMessageAction(sess, msg)
+	if action == "" {
+		// Like the other authorizers, all other messages are required by
+		// nexus to function correctly.
+		return multiauthorizer.Permit
+	}
+
+	current, _ := this.rules.Load().(*attributeRules)
+	if current == nil {
+		if details != nil {
+			details["loaded"] = false
+		}
+		return multiauthorizer.Abstain
+	}
+
+	var env map[string]interface{}
+	allowedBy := -1
+	for i := range current.rules {
+		rule := &current.rules[i]
+		if !rule.matches(uri, action) {
+			continue
+		}
+		if rule.condition != nil {
+			if env == nil {
+				env = attributeEnv(sess, roles, uri, action)
+			}
+			applies, err := rule.condition.EvalBool(env)
+			if err != nil {
+				util.Logger.Debugf("Attribute rule %d on %v failed: %v", i, uri, err)
+				applies = rule.effect == PermissionDeny
+			}
+			if !applies {
+				continue
+			}
+		}
+		if rule.effect == PermissionDeny {
+			util.Logger.Debugf("%v on %v denied by attribute rule %d", action, uri, i)
+			if details != nil {
+				details["denied_by"] = current.explainRule(i)
+			}
+			return multiauthorizer.Deny
+		}
+		if allowedBy < 0 {
+			allowedBy = i
+		}
+	}
+
+	if allowedBy >= 0 {
+		if details != nil {
+			details["allowed_by"] = current.explainRule(allowedBy)
+		}
+		return multiauthorizer.Permit
+	}
+
+	return multiauthorizer.Abstain
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/EmbeddedEnterprises/autobahnkreuz/auth/multiauthorizer"
+	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
+
+	mapset "github.com/deckarep/golang-set"
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+func TestAttributeAuthorizerDecide(t *testing.T) {
+	util.Init()
+	// The rules are given like the reply of the rules RPC, the first one
+	// without actions and the second one with null actions.
+	file, err := parseAttributeFile(wamp.Dict{
+		"rules": wamp.List{
+			wamp.Dict{"uri": "com.app.", "condition": "authid == segments[2]"},
+			wamp.Dict{"uri": "com.app.admin", "match": "prefix", "actions": nil, "effect": "deny"},
+			wamp.Dict{"uri": "com.public", "actions": wamp.List{"subscribe"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := compileAttributeRules(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizer := NewAttributeAuthorizer(false, "", "test.rules", mapset.NewSet("trusted"))
+	authorizer.rules.Store(rules)
+
+	cases := []struct {
+		authid   string
+		authrole string
+		msg      wamp.Message
+		expected multiauthorizer.Decision
+	}{
+		{"alice", "user", &wamp.Call{Procedure: "com.app.alice"}, multiauthorizer.Permit},
+		{"alice", "user", &wamp.Publish{Topic: "com.app.alice"}, multiauthorizer.Permit},
+		{"bob", "user", &wamp.Call{Procedure: "com.app.alice"}, multiauthorizer.Abstain},
+		{"admin", "user", &wamp.Register{Procedure: "com.app.admin"}, multiauthorizer.Deny},
+		{"alice", "user", &wamp.Call{Procedure: "com.app.admin.delete"}, multiauthorizer.Deny},
+		{"alice", "trusted", &wamp.Call{Procedure: "com.app.admin.delete"}, multiauthorizer.Permit},
+		{"alice", "user", &wamp.Subscribe{Topic: "com.public"}, multiauthorizer.Permit},
+		{"alice", "user", &wamp.Publish{Topic: "com.public"}, multiauthorizer.Abstain},
+	}
+	for _, c := range cases {
+		sess := &wamp.Session{
+			Details: wamp.Dict{
+				"authid":   c.authid,
+				"authrole": c.authrole,
+			},
+		}
+		if decision := authorizer.decide(sess, c.msg, nil); decision != c.expected {
+			t.Errorf("%s (%s) %#v: expected %v, got %v", c.authid, c.authrole, c.msg, c.expected, decision)
+		}
+	}
+}
+
+func TestParseAttributeFileInvalid(t *testing.T) {
+	cases := []interface{}{
+		"rules",
+		wamp.List{"rule"},
+		wamp.List{wamp.Dict{"actions": "call"}},
+		wamp.List{wamp.Dict{"actions": wamp.List{1}}},
+	}
+	for _, raw := range cases {
+		if _, err := parseAttributeFile(raw); err == nil {
+			t.Errorf("%v: expected an error", raw)
+		}
+	}
+}
@@ -2,7 +2,9 @@ package auth
 
 import (
 	"context"
+	"time"
 
+	"github.com/EmbeddedEnterprises/autobahnkreuz/auth/multiauthorizer"
 	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
 	mapset "github.com/deckarep/golang-set"
 
@@ -16,46 +18,70 @@ type DynamicAuthorizer struct {
 	TrustedAuthRoles   mapset.Set
 	UpstreamAuthorizer string
 	Realm              string
+	// Cache stores the decisions of UpstreamAuthorizer, it may be nil.
+	Cache *DecisionCache
+	// Payload selects the actions whose arguments and options are passed to
+	// UpstreamAuthorizer, it may be nil.
+	Payload *PayloadConfig
 }
 
-// Authorize checks whether the session `sess` is allowed to send the message `msg`
+// Authorize checks whether the session `sess` is allowed to send the message `msg`.
+// Permitted messages are modified according to the directives of the
+// upstream authorizer.
 func (a DynamicAuthorizer) Authorize(sess *wamp.Session, msg wamp.Message) (bool, error) {
+	permit, directives, err := a.evaluate(sess, msg, true)
+	if permit && directives != nil {
+		applyDirectives(directives, msg)
+	}
+	return permit, err
+}
+
+// Evaluate is Authorize without modifying msg, it is used when the decision
+// is not enforced.
+func (a DynamicAuthorizer) Evaluate(sess *wamp.Session, msg wamp.Message) (bool, error) {
+	permit, _, err := a.evaluate(sess, msg, true)
+	return permit, err
+}
+
+// evaluate makes the decision and returns the directives of the upstream
+// authorizer, if any, without applying them. The decision is only cached if
+// store is true.
+func (a DynamicAuthorizer) evaluate(sess *wamp.Session, msg wamp.Message, store bool) (bool, interface{}, error) {
 
 	roles, err := extractAuthRoles(sess.Details["authrole"])
 
 	if err != nil {
-		return a.PermitDefault, nil
+		return a.PermitDefault, nil, nil
 	}
 
 	isTrustedAuthRole := roles.checkTrustedAuthRoles(a.TrustedAuthRoles)
 
 	if isTrustedAuthRole {
-		return true, nil
-	}
-
-	msgType := ""
-	uri := wamp.URI("")
-
-	switch msg.MessageType() {
-	case wamp.CALL:
-		msgType = "call"
-		uri = msg.(*wamp.Call).Procedure
-	case wamp.REGISTER:
-		msgType = "register"
-		uri = msg.(*wamp.Register).Procedure
-	case wamp.SUBSCRIBE:
-		msgType = "subscribe"
-		uri = msg.(*wamp.Subscribe).Topic
-	case wamp.PUBLISH:
-		msgType = "publish"
-		uri = msg.(*wamp.Publish).Topic
-	default:
+		return true, nil, nil
+	}
+
+	uri, msgType := resolveMessageAction(sess, msg)
+	if msgType == "" {
 		// Fixed the same bug as in the Feature Authorizer.
-		return true, nil
+		return true, nil, nil
 	}
 
 	//util.Logger.Debugf("Authorizing %v on %v for roles %v", msgType, uri, roles)
 
+	// Decisions about payloads depend on the arguments, so they are never
+	// cached.
+	withPayload := a.Payload != nil && a.Payload.applies(uri)
+
+	authid, _ := wamp.AsString(sess.Details["authid"])
+	key := newDecisionKey(*roles, authid, uri, msgType)
+	var generation uint64
+	if a.Cache != nil && !withPayload {
+		if permit, ok := a.Cache.Get(key, time.Now()); ok {
+			return permit, nil, nil
+		}
+		generation = a.Cache.Generation()
+	}
+
 	ctx := context.Background()
 	session := wamp.Dict{
 		"realm":        a.Realm,
@@ -65,41 +91,100 @@ func (a DynamicAuthorizer) Authorize(sess *wamp.Session, msg wamp.Message) (bool
 		"authmethod":   sess.Details["authmethod"],
 		"authrole":     roles,
 	}
-	res, err := util.LocalClient.Call(ctx, a.UpstreamAuthorizer, nil, wamp.List{
+	args := wamp.List{
 		session,
 		uri,
 		msgType,
-	}, nil, nil)
+	}
+	if withPayload {
+		args = append(args, a.Payload.payload(msg))
+	}
+	res, err := callUpstream(ctx, a.UpstreamAuthorizer, args, nil)
 
 	if err != nil {
-		util.Logger.Warningf("Failed to run authorizer: %v", err)
-		return a.PermitDefault, nil
+		warnUpstreamFailure(a.UpstreamAuthorizer, err)
+		// Rejections caused by timeouts or an open circuit breaker carry the
+		// error URI, so the client can tell a broken authorizer from a missing
+		// permission.
+		if _, isUpstreamErr := err.(*util.UpstreamError); isUpstreamErr && !a.PermitDefault {
+			return false, nil, err
+		}
+		return a.PermitDefault, nil, nil
 	}
 
 	if res.Arguments == nil || len(res.Arguments) == 0 {
 		util.Logger.Warning("Authorizer returned no result")
-		return a.PermitDefault, nil
-	}
-	permit, ok := res.Arguments[0].(bool)
-	if ok {
-		return permit, nil
+		return a.PermitDefault, nil, nil
 	}
 
-	det, ok := res.Arguments[0].(map[string]interface{})
-	if ok {
-		permit, ok = det["allow"].(bool)
-		if !ok {
-			return permit, nil
-		}
+	ttl := time.Duration(0)
+	if a.Cache != nil {
+		ttl = a.Cache.TTL
+	}
+	permit, ttl, ok := parseAuthorizerReply(res.Arguments[0], ttl)
+	if !ok {
+		return a.PermitDefault, nil, nil
+	}
+	if withPayload {
+		return permit, res.Arguments[0], nil
+	}
+	if store && a.Cache != nil && ttl > 0 {
+		a.Cache.Put(key, *roles, permit, ttl, time.Now(), generation)
 	}
+	return permit, nil, nil
+}
 
-	det2, ok := res.Arguments[0].(map[interface{}]interface{})
-	if ok {
-		permit, ok = det2["allow"].(bool)
-		if ok {
-			return permit, nil
+// Explain returns the decision of Authorize, whether the trusted authrole
+// shortcut applied and whether the decision was cached. It neither modifies
+// msg nor caches the decision.
+func (a DynamicAuthorizer) Explain(sess *wamp.Session, msg wamp.Message) multiauthorizer.Explanation {
+	details := wamp.Dict{
+		"trusted": false,
+	}
+	if roles, err := extractAuthRoles(sess.Details["authrole"]); err == nil {
+		details["trusted"] = roles.checkTrustedAuthRoles(a.TrustedAuthRoles)
+		if uri, action := resolveMessageAction(sess, msg); a.Cache != nil && action != "" {
+			authid, _ := wamp.AsString(sess.Details["authid"])
+			_, details["cached"] = a.Cache.Get(newDecisionKey(*roles, authid, uri, action), time.Now())
 		}
 	}
+	permitted, _, err := a.evaluate(sess, msg, false)
+	decision := multiauthorizer.Deny
+	if permitted {
+		decision = multiauthorizer.Permit
+	}
+	return multiauthorizer.Explanation{
+		Decision:  decision,
+		Permitted: permitted,
+		Err:       err,
+		Details:   details,
+	}
+}
 
-	return a.PermitDefault, nil
+// parseAuthorizerReply reads the decision of the upstream authorizer, which is
+// either a bool or a dict containing `allow`. A dict may disable caching of
+// the decision with `cache: false` or replace the default ttl by `ttl`
+// seconds.
+func parseAuthorizerReply(reply interface{}, ttl time.Duration) (bool, time.Duration, bool) {
+	if permit, ok := reply.(bool); ok {
+		return permit, ttl, true
+	}
+	if reply == nil {
+		return false, 0, false
+	}
+	det, ok := wamp.AsDict(reply)
+	if !ok {
+		return false, 0, false
+	}
+	permit, ok := det["allow"].(bool)
+	if !ok {
+		return false, 0, false
+	}
+	if seconds, ok := wamp.AsFloat64(det["ttl"]); ok {
+		ttl = time.Duration(seconds * float64(time.Second))
+	}
+	if cache, ok := det["cache"].(bool); ok && !cache {
+		ttl = 0
+	}
+	return permit, ttl, true
 }
@@ -3,6 +3,8 @@ package auth
 import (
 	"errors"
 
+	"github.com/EmbeddedEnterprises/autobahnkreuz/auth/multiauthorizer"
+
 	mapset "github.com/deckarep/golang-set"
 	"github.com/gammazero/nexus/v3/wamp"
 )
@@ -48,3 +50,49 @@ func (r authRoles) checkTrustedAuthRoles(trustedAuthRoles mapset.Set) bool {
 
 	return false
 }
+
+// trustedCaller checks whether the caller of an invocation has one of the
+// trusted authroles, which requires the procedure to disclose the caller.
+func trustedCaller(invk *wamp.Invocation, trustedAuthRoles mapset.Set) bool {
+	callerRoles, err := extractAuthRoles(invk.Details["caller_authrole"])
+	return err == nil && trustedAuthRoles != nil && callerRoles.checkTrustedAuthRoles(trustedAuthRoles)
+}
+
+// resolveMessageAction is multiauthorizer.MessageAction, but looks up the
+// URI of the subscription or registration an UNSUBSCRIBE or UNREGISTER
+// refers to and the procedure of the call of sess a CANCEL refers to, see
+// TrackEndpoints. It stays empty if they are unknown.
+func resolveMessageAction(sess *wamp.Session, msg wamp.Message) (wamp.URI, string) {
+	uri, action := multiauthorizer.MessageAction(msg)
+	switch msg := msg.(type) {
+	case *wamp.Unsubscribe:
+		uri = endpoints.lookup(endpoints.subscriptions, msg.Subscription)
+	case *wamp.Unregister:
+		uri = endpoints.lookup(endpoints.registrations, msg.Registration)
+	case *wamp.Cancel:
+		uri = endpoints.lookupCall(sess.ID, msg.Request)
+	}
+	return uri, action
+}
+
+// actionMessage creates a message performing action on uri, it is the
+// inverse of multiauthorizer.MessageAction for the actions referring to a
+// URI.
+func actionMessage(uri wamp.URI, action string) (wamp.Message, error) {
+	switch action {
+	case "call":
+		return &wamp.Call{Procedure: uri, Options: wamp.Dict{}}, nil
+	case "register":
+		return &wamp.Register{Procedure: uri, Options: wamp.Dict{}}, nil
+	case "subscribe":
+		return &wamp.Subscribe{Topic: uri, Options: wamp.Dict{}}, nil
+	case "publish":
+		return &wamp.Publish{Topic: uri, Options: wamp.Dict{}}, nil
+	case featureActionMeta:
+		if !multiauthorizer.IsMetaURI(uri) {
+			return nil, errors.New(string(uri) + " is not a meta procedure")
+		}
+		return &wamp.Call{Procedure: uri, Options: wamp.Dict{}}, nil
+	}
+	return nil, errors.New("Unknown action " + action)
+}
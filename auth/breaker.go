@@ -0,0 +1,275 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
+
+	"github.com/gammazero/nexus/v3/client"
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets all calls pass.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects all calls without calling upstream.
+	BreakerOpen
+	// BreakerHalfOpen lets a limited number of probe calls pass to check
+	// whether the upstream has recovered.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+const (
+	// BreakerStateProcedure returns the state of all circuit breakers.
+	BreakerStateProcedure = "ee.auth.upstream-breakers"
+	// BreakerStateTopic receives an event on every state transition.
+	BreakerStateTopic = "ee.auth.upstream-breaker-changed"
+)
+
+var errCircuitOpen = errors.New("Circuit breaker is open")
+
+// BreakerConfig configures the circuit breakers of all upstream procedures.
+type BreakerConfig struct {
+	// FailureThreshold is the number of consecutive failures which opens the
+	// breaker, 0 disables the breakers.
+	FailureThreshold int
+	// OpenDuration is the time an open breaker rejects calls before probing.
+	OpenDuration time.Duration
+	// HalfOpenProbes is the number of successful probes required to close the
+	// breaker again, at most this many probes are in flight at the same time.
+	HalfOpenProbes int
+}
+
+// CircuitBreaker tracks the failures of a single upstream procedure.
+type CircuitBreaker struct {
+	procedure string
+	config    BreakerConfig
+	mu        sync.Mutex
+	state     BreakerState
+	failures  int
+	successes int
+	probes    int
+	openedAt  time.Time
+}
+
+// allow reports whether a call may be made and whether it is a probe.
+func (b *CircuitBreaker) allow(now time.Time) (bool, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if now.Before(b.openedAt.Add(b.config.OpenDuration)) {
+			return false, false
+		}
+		b.transition(BreakerHalfOpen, now)
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probes >= b.config.HalfOpenProbes {
+			return false, false
+		}
+		b.probes++
+		return true, true
+	}
+	return true, false
+}
+
+// isUpstreamFailure reports whether err indicates that the upstream is not
+// working. Errors returned by the callee itself are answers, not failures.
+func isUpstreamFailure(err error) bool {
+	if rpcErr, ok := err.(client.RPCError); ok {
+		return rpcErr.Err.Error == wamp.ErrNoSuchProcedure
+	}
+	if upstreamErr, ok := err.(*util.UpstreamError); ok {
+		return upstreamErr.URI == util.ErrUpstreamTimeout
+	}
+	return true
+}
+
+// record updates the breaker with the result of a call.
+func (b *CircuitBreaker) record(probe bool, err error, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probes--
+	}
+	// Calls canceled by the caller say nothing about the upstream.
+	if upstreamErr, ok := err.(*util.UpstreamError); ok && upstreamErr.URI == util.ErrUpstreamCanceled {
+		return
+	}
+	failed := err != nil && isUpstreamFailure(err)
+	switch b.state {
+	case BreakerClosed:
+		if !failed {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.config.FailureThreshold {
+			b.transition(BreakerOpen, now)
+		}
+	case BreakerHalfOpen:
+		// Results of calls made before the breaker opened are ignored.
+		if !probe {
+			return
+		}
+		if failed {
+			b.transition(BreakerOpen, now)
+			return
+		}
+		b.successes++
+		if b.successes >= b.config.HalfOpenProbes {
+			b.transition(BreakerClosed, now)
+		}
+	}
+}
+
+// transition changes the state and announces it, the caller must hold mu.
+func (b *CircuitBreaker) transition(to BreakerState, now time.Time) {
+	from := b.state
+	b.state = to
+	b.successes = 0
+	switch to {
+	case BreakerOpen:
+		b.openedAt = now
+		if from == BreakerHalfOpen {
+			util.Logger.Warningf("Circuit breaker of `%s` opened again, probe failed", b.procedure)
+		} else {
+			util.Logger.Warningf("Circuit breaker of `%s` opened after %d failures", b.procedure, b.failures)
+		}
+	case BreakerClosed:
+		b.failures = 0
+		util.Logger.Infof("Circuit breaker of `%s` closed", b.procedure)
+	}
+	event := wamp.Dict{
+		"procedure": b.procedure,
+		"from":      from.String(),
+		"to":        to.String(),
+	}
+	// Publish outside of the lock, a slow router must not block callers.
+	go func() {
+		if util.LocalClient == nil {
+			return
+		}
+		if err := util.LocalClient.Publish(BreakerStateTopic, nil, wamp.List{event}, nil); err != nil {
+			util.Logger.Warningf("Failed to publish circuit breaker state: %v", err)
+		}
+	}()
+}
+
+func (b *CircuitBreaker) status() wamp.Dict {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	res := wamp.Dict{
+		"state":    b.state.String(),
+		"failures": b.failures,
+	}
+	if !b.openedAt.IsZero() {
+		res["opened"] = b.openedAt.UTC().Format(time.RFC3339)
+	}
+	return res
+}
+
+// BreakerSet holds one circuit breaker per upstream procedure.
+type BreakerSet struct {
+	Config   BreakerConfig
+	mu       sync.Mutex
+	breakers map[string]*CircuitBreaker
+}
+
+// UpstreamBreakers guards all upstream calls of the authenticators and
+// authorizers. The breakers are disabled until a threshold is configured.
+var UpstreamBreakers = &BreakerSet{}
+
+func (s *BreakerSet) breaker(procedure string) *CircuitBreaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.breakers == nil {
+		s.breakers = make(map[string]*CircuitBreaker)
+	}
+	b, ok := s.breakers[procedure]
+	if !ok {
+		b = &CircuitBreaker{
+			procedure: procedure,
+			config:    s.Config,
+		}
+		s.breakers[procedure] = b
+	}
+	return b
+}
+
+// Initialize registers the procedure returning the breaker states.
+func (s *BreakerSet) Initialize() {
+	err := util.LocalClient.Register(BreakerStateProcedure, s.listBreakers, wamp.Dict{})
+	if err != nil {
+		util.Logger.Warningf("Failed to register %s: %v", BreakerStateProcedure, err)
+	}
+}
+
+func (s *BreakerSet) listBreakers(_ context.Context, _ *wamp.Invocation) client.InvokeResult {
+	s.mu.Lock()
+	procedures := make([]string, 0, len(s.breakers))
+	for procedure := range s.breakers {
+		procedures = append(procedures, procedure)
+	}
+	s.mu.Unlock()
+	sort.Strings(procedures)
+
+	result := wamp.Dict{}
+	for _, procedure := range procedures {
+		result[procedure] = s.breaker(procedure).status()
+	}
+	return client.InvokeResult{
+		Args: wamp.List{
+			result,
+		},
+	}
+}
+
+// callUpstream calls procedure like util.CallUpstream, unless its circuit
+// breaker is open. Calls rejected by the breaker fail with
+// util.ErrUpstreamUnavailable.
+func callUpstream(ctx context.Context, procedure string, args wamp.List, kwargs wamp.Dict) (*wamp.Result, error) {
+	if UpstreamBreakers.Config.FailureThreshold <= 0 {
+		return util.CallUpstream(ctx, procedure, args, kwargs)
+	}
+	b := UpstreamBreakers.breaker(procedure)
+	allowed, probe := b.allow(time.Now())
+	if !allowed {
+		return nil, &util.UpstreamError{
+			URI:       util.ErrUpstreamUnavailable,
+			Procedure: procedure,
+			Err:       errCircuitOpen,
+		}
+	}
+	result, err := util.CallUpstream(ctx, procedure, args, kwargs)
+	b.record(probe, err, time.Now())
+	return result, err
+}
+
+// warnUpstreamFailure logs a failed upstream call. Calls rejected by an open
+// circuit breaker are only logged in debug mode, the transition was logged
+// already.
+func warnUpstreamFailure(procedure string, err error) {
+	if upstreamErr, ok := err.(*util.UpstreamError); ok && upstreamErr.Err == errCircuitOpen {
+		util.Logger.Debugf("Skipped call to `%s`: %v", procedure, errCircuitOpen)
+		return
+	}
+	util.Logger.Warningf("Failed to call `%s`: %v", procedure, err)
+}
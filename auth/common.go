@@ -3,6 +3,9 @@ package auth
 import (
 	"context"
 	"errors"
+	"net"
+	"net/http"
+	"strings"
 
 	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
 
@@ -24,17 +27,93 @@ func (s *SharedSecretAuthenticator) AuthMethod() string {
 	return s.AuthMethodValue
 }
 
+// transportRequest returns the HTTP request which initiated the websocket
+// connection of a client, if available.
+func transportRequest(details wamp.Dict) (*http.Request, error) {
+	tpdet, ok := details["transport"].(wamp.Dict)
+	if !ok {
+		return nil, errors.New("No transport details given")
+	}
+	authdet, ok := tpdet["auth"].(wamp.Dict)
+	if !ok {
+		return nil, errors.New("No auth key in transport details")
+	}
+	req, ok := authdet["request"].(*http.Request)
+	if !ok || req == nil {
+		return nil, errors.New("HTTP request is missing")
+	}
+	return req, nil
+}
+
+// peerAddress returns the address of the client, as seen by the reverse proxy
+// in front of the router, if any.
+func peerAddress(details wamp.Dict) string {
+	req, err := transportRequest(details)
+	if err != nil {
+		return ""
+	}
+	if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	if realIP := req.Header.Get("X-Real-IP"); realIP != "" {
+		return realIP
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// filterAuthRoles converts the given list of authroles to strings and removes
+// all roles contained in invalidAuthRoles, if any.
+func filterAuthRoles(authroles wamp.List, invalidAuthRoles mapset.Set) []string {
+	var authRoleList []string
+	var targetList []string
+	for _, x := range authroles {
+		if role, ok := wamp.AsString(x); ok {
+			authRoleList = append(authRoleList, role)
+		}
+	}
+
+	if invalidAuthRoles == nil {
+		return authRoleList
+	}
+
+	rawAuthRoles := mapset.NewSet()
+	for _, x := range authRoleList {
+		rawAuthRoles.Add(x)
+	}
+
+	filteredSet := rawAuthRoles.Difference(invalidAuthRoles)
+
+	for x := range filteredSet.Iter() {
+		role := x.(string)
+		targetList = append(targetList, role)
+	}
+	return targetList
+}
+
+// upstreamFailure returns the error URI of timed out or canceled upstream
+// calls, all other errors are replaced by fallback.
+func upstreamFailure(err error, fallback string) error {
+	if upstreamErr, ok := err.(*util.UpstreamError); ok {
+		return upstreamErr
+	}
+	return errors.New(fallback)
+}
+
 // FetchAndFilterAuthRoles tries to fetch authroles for a previously authenticated
 // client based on its authid using the configured UpstreamGetAuthRolesFunc
 func (s *SharedSecretAuthenticator) FetchAndFilterAuthRoles(authid string) (*wamp.Welcome, error) {
 	ctx := context.Background()
-	result, err := util.LocalClient.Call(ctx, s.UpstreamGetAuthRolesFunc, nil, wamp.List{
+	result, err := callUpstream(ctx, s.UpstreamGetAuthRolesFunc, wamp.List{
 		s.Realm,
 		authid,
-	}, nil, nil)
+	}, nil)
 	if err != nil {
-		util.Logger.Warningf("Failed to call `%s`: %v", s.UpstreamGetAuthRolesFunc, err)
-		return nil, errors.New("Unauthorized")
+		warnUpstreamFailure(s.UpstreamGetAuthRolesFunc, err)
+		return nil, upstreamFailure(err, "Unauthorized")
 	}
 	if len(result.Arguments) == 0 {
 		util.Logger.Warningf("Upstream auth func returned no values")
@@ -60,30 +139,7 @@ func (s *SharedSecretAuthenticator) FetchAndFilterAuthRoles(authid string) (*wam
 		userData = make(map[string]interface{})
 	}
 
-	var authRoleList []string
-	var targetList []string
-	for _, x := range authroles {
-		if role, ok := wamp.AsString(x); ok {
-			authRoleList = append(authRoleList, role)
-		}
-	}
-
-	if s.InvalidAuthRoles != nil {
-		rawAuthRoles := mapset.NewSet()
-		for _, x := range authRoleList {
-			rawAuthRoles.Add(x)
-		}
-
-		filteredSet := rawAuthRoles.Difference(s.InvalidAuthRoles)
-
-		for x := range filteredSet.Iter() {
-			role := x.(string)
-			targetList = append(targetList, role)
-		}
-
-	} else {
-		targetList = authRoleList
-	}
+	targetList := filterAuthRoles(authroles, s.InvalidAuthRoles)
 	welcomeDetails := wamp.Dict{}
 	if len(result.Arguments) > 1 {
 		if dict, dictok := wamp.AsDict(result.Arguments[1]); dictok {
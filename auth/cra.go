@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
+	mapset "github.com/deckarep/golang-set"
+
+	"github.com/gammazero/nexus/v3/wamp"
+	"github.com/gammazero/nexus/v3/wamp/crsign"
+)
+
+// craSecret is the secret of a single authid as returned by the upstream
+// secret function. If Salt is set, Secret is the PBKDF2 derived key and the
+// salting parameters are passed to the client within the challenge.
+type craSecret struct {
+	Secret     string
+	Salt       string
+	KeyLen     int
+	Iterations int
+}
+
+// WampCRAAuth is an authenticator which performs a WAMP-CRA challenge-response
+// authentication. In contrast to DynamicTicketAuth the password never leaves
+// the client, only the HMAC signature of the challenge is transmitted.
+type WampCRAAuth struct {
+	SharedSecretAuthenticator
+	UpstreamSecretFunc string
+}
+
+// NewWampCRA creates a new WampCRAAuth object based on the given parameters
+func NewWampCRA(secretfunc string, authrolefunc string, realm string, invalid mapset.Set) (*WampCRAAuth, error) {
+	x := &WampCRAAuth{
+		SharedSecretAuthenticator: SharedSecretAuthenticator{
+			AuthMethodValue:          "wampcra",
+			InvalidAuthRoles:         invalid,
+			Realm:                    realm,
+			UpstreamGetAuthRolesFunc: authrolefunc,
+		},
+		UpstreamSecretFunc: secretfunc,
+	}
+	return x, nil
+}
+
+// fetchSecret asks the configured UpstreamSecretFunc for the secret of authid.
+// The upstream function may return either a plain string or a dictionary
+// containing `secret` and optionally `salt`, `keylen` and `iterations`.
+func (a *WampCRAAuth) fetchSecret(authid string) (*craSecret, error) {
+	ctx := context.Background()
+	result, err := callUpstream(ctx, a.UpstreamSecretFunc, wamp.List{
+		a.Realm,
+		authid,
+	}, nil)
+	if err != nil {
+		warnUpstreamFailure(a.UpstreamSecretFunc, err)
+		return nil, err
+	}
+	if len(result.Arguments) == 0 {
+		return nil, errors.New("Upstream secret func returned no values")
+	}
+
+	if secret, ok := wamp.AsString(result.Arguments[0]); ok {
+		return &craSecret{Secret: secret}, nil
+	}
+
+	dict, ok := wamp.AsDict(result.Arguments[0])
+	if !ok {
+		return nil, errors.New("Upstream secret func returned an invalid value")
+	}
+	secret, ok := wamp.AsString(dict["secret"])
+	if !ok || secret == "" {
+		return nil, errors.New("Upstream secret func returned no secret")
+	}
+	res := &craSecret{Secret: secret}
+	res.Salt, _ = wamp.AsString(dict["salt"])
+	if keylen, ok := wamp.AsInt64(dict["keylen"]); ok {
+		res.KeyLen = int(keylen)
+	}
+	if iterations, ok := wamp.AsInt64(dict["iterations"]); ok {
+		res.Iterations = int(iterations)
+	}
+	return res, nil
+}
+
+// makeChallenge creates the JSON encoded challenge string which has to be
+// signed by the client.
+func (a *WampCRAAuth) makeChallenge(sid wamp.ID, authid string) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	challenge, err := json.Marshal(map[string]interface{}{
+		"authid":       authid,
+		"authprovider": "dynamic",
+		"authmethod":   a.AuthMethod(),
+		"nonce":        base64.StdEncoding.EncodeToString(nonce),
+		"timestamp":    wamp.NowISO8601(),
+		"session":      sid,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(challenge), nil
+}
+
+// Authenticate sends a WAMP-CRA challenge to the client and verifies the
+// signature using the secret provided by the upstream secret function.
+func (a *WampCRAAuth) Authenticate(sid wamp.ID, details wamp.Dict, client wamp.Peer) (*wamp.Welcome, error) {
+	authid := wamp.OptionString(details, "authid")
+	if authid == "" {
+		return nil, errors.New("wamp.error.empty-auth-id")
+	}
+
+	secret, secretErr := a.fetchSecret(authid)
+	if secretErr != nil {
+		// Continue with a random secret, otherwise we would leak whether the
+		// authid exists.
+		key, keyErr := randomHex(32)
+		if keyErr != nil {
+			return nil, errors.New("wamp.error.internal-error")
+		}
+		secret = &craSecret{Secret: key}
+	}
+
+	challenge, err := a.makeChallenge(sid, authid)
+	if err != nil {
+		return nil, errors.New("wamp.error.internal-error")
+	}
+
+	extra := wamp.Dict{
+		"challenge": challenge,
+	}
+	if secret.Salt != "" {
+		extra["salt"] = secret.Salt
+		extra["keylen"] = secret.KeyLen
+		extra["iterations"] = secret.Iterations
+	}
+
+	err = client.Send(&wamp.Challenge{
+		AuthMethod: a.AuthMethod(),
+		Extra:      extra,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Read AUTHENTICATE response from client.
+	// A timeout of 5 seconds should be enough for slow clients...
+	msg, err := wamp.RecvTimeout(client, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	authRsp, ok := msg.(*wamp.Authenticate)
+	if !ok {
+		util.Logger.Warningf("Protocol violation from %v: %v", client, msg.MessageType())
+		return nil, errors.New(string(wamp.ErrProtocolViolation))
+	}
+
+	if _, ok := secretErr.(*util.UpstreamError); ok {
+		// A hung backend does not tell anything about the authid.
+		return nil, secretErr
+	}
+	if secretErr != nil || !crsign.VerifySignature(authRsp.Signature, challenge, []byte(secret.Secret)) {
+		util.Logger.Infof("Invalid WAMP-CRA signature for authid %v", authid)
+		return nil, errors.New(string(wamp.ErrAuthenticationFailed))
+	}
+
+	return a.FetchAndFilterAuthRoles(authid)
+}
@@ -0,0 +1,253 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/EmbeddedEnterprises/autobahnkreuz/cli"
+	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
+	mapset "github.com/deckarep/golang-set"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// CryptosignAuth is an authenticator which performs a WAMP-Cryptosign
+// challenge-response authentication using Ed25519 keys.
+// Public keys are resolved to authid and authroles either using a static key
+// file or an upstream WAMP RPC.
+type CryptosignAuth struct {
+	Realm                 string
+	UpstreamPubKeyFunc    string
+	StaticKeys            map[string]cli.CryptosignKeyInfo
+	InvalidAuthRoles      mapset.Set
+	RequireChannelBinding bool
+}
+
+// NewCryptosign creates a new CryptosignAuth object based on the given parameters
+func NewCryptosign(pubkeyfunc string, keys map[string]cli.CryptosignKeyInfo, realm string, invalid mapset.Set, requireChannelBinding bool) (*CryptosignAuth, error) {
+	if pubkeyfunc == "" && keys == nil {
+		return nil, errors.New("Either a public key function or static keys are required")
+	}
+	x := &CryptosignAuth{
+		Realm:                 realm,
+		UpstreamPubKeyFunc:    pubkeyfunc,
+		StaticKeys:            keys,
+		InvalidAuthRoles:      invalid,
+		RequireChannelBinding: requireChannelBinding,
+	}
+	return x, nil
+}
+
+// resolvePubKey maps a hex encoded public key to a welcome message, the static
+// keys take precedence over the upstream function.
+func (a *CryptosignAuth) resolvePubKey(pubkey string) (*wamp.Welcome, error) {
+	if info, ok := a.StaticKeys[pubkey]; ok {
+		roles := wamp.List{}
+		for _, role := range info.AuthRoles {
+			roles = append(roles, role)
+		}
+		return &wamp.Welcome{
+			Details: wamp.Dict{
+				"authid":       info.AuthID,
+				"authrole":     filterAuthRoles(roles, a.InvalidAuthRoles),
+				"authextra":    wamp.Dict{"pubkey": pubkey},
+				"authprovider": "static",
+				"authmethod":   a.AuthMethod(),
+			},
+		}, nil
+	}
+
+	if a.UpstreamPubKeyFunc == "" {
+		return nil, errors.New("Unauthorized")
+	}
+
+	ctx := context.Background()
+	result, err := callUpstream(ctx, a.UpstreamPubKeyFunc, wamp.List{
+		a.Realm,
+		pubkey,
+	}, nil)
+	if err != nil {
+		warnUpstreamFailure(a.UpstreamPubKeyFunc, err)
+		return nil, upstreamFailure(err, "Unauthorized")
+	}
+	if len(result.Arguments) == 0 {
+		util.Logger.Warningf("Upstream pubkey func returned no values")
+		return nil, errors.New("Unauthorized")
+	}
+
+	userData, ok := wamp.AsDict(result.Arguments[0])
+	if !ok {
+		util.Logger.Warningf("Upstream pubkey func returned no dictionary")
+		return nil, errors.New("Unauthorized")
+	}
+	authid, ok := wamp.AsString(userData["authid"])
+	if !ok || authid == "" {
+		util.Logger.Warningf("Upstream pubkey func returned no authid")
+		return nil, errors.New("Unauthorized")
+	}
+	authroles, ok := wamp.AsList(userData["authroles"])
+	if !ok {
+		util.Logger.Warningf("Upstream pubkey func returned no authroles")
+		return nil, errors.New("Unauthorized")
+	}
+	authextra := wamp.Dict{}
+	for k, v := range userData {
+		if k != "authid" && k != "authroles" {
+			authextra[k] = v
+		}
+	}
+	authextra["pubkey"] = pubkey
+
+	return &wamp.Welcome{
+		Details: wamp.Dict{
+			"authid":       authid,
+			"authrole":     filterAuthRoles(authroles, a.InvalidAuthRoles),
+			"authextra":    authextra,
+			"authprovider": "dynamic",
+			"authmethod":   a.AuthMethod(),
+		},
+	}, nil
+}
+
+// channelBindingTypes are the supported channel bindings, tls-unique is not
+// defined for TLS 1.3, which requires tls-exporter (RFC 9266).
+var channelBindingTypes = map[string]bool{
+	"tls-unique":   true,
+	"tls-exporter": true,
+}
+
+// channelBinding returns the channel binding data of bindingType of the
+// underlying transport, if available.
+func channelBinding(details wamp.Dict, bindingType string) ([]byte, error) {
+	req, err := transportRequest(details)
+	if err != nil {
+		return nil, err
+	}
+	if req.TLS == nil {
+		return nil, errors.New("Channel binding requires a TLS connection")
+	}
+	if bindingType == "tls-exporter" {
+		return req.TLS.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+	}
+	if req.TLS.Version >= tls.VersionTLS13 {
+		return nil, errors.New("tls-unique is not defined for TLS 1.3, the client has to use tls-exporter")
+	}
+	if len(req.TLS.TLSUnique) == 0 {
+		return nil, errors.New("TLS connection does not provide tls-unique")
+	}
+	return req.TLS.TLSUnique, nil
+}
+
+// Authenticate sends a random challenge to the client and verifies the
+// Ed25519 signature against the public key presented in authextra.
+func (a *CryptosignAuth) Authenticate(sid wamp.ID, details wamp.Dict, client wamp.Peer) (*wamp.Welcome, error) {
+	authextra, _ := wamp.AsDict(details["authextra"])
+	pubkey := strings.ToLower(wamp.OptionString(authextra, "pubkey"))
+	pubkeyBytes, err := hex.DecodeString(pubkey)
+	if err != nil || len(pubkeyBytes) != ed25519.PublicKeySize {
+		return nil, errors.New("wamp.error.invalid-pubkey")
+	}
+
+	bindingType := wamp.OptionString(authextra, "channel_binding")
+	if bindingType != "" && !channelBindingTypes[bindingType] {
+		return nil, errors.New("wamp.error.invalid-channel-binding")
+	}
+	if bindingType == "" && a.RequireChannelBinding {
+		return nil, errors.New("wamp.error.channel-binding-required")
+	}
+
+	challengeHex, err := randomHex(32)
+	if err != nil {
+		return nil, errors.New("wamp.error.internal-error")
+	}
+	challenge, _ := hex.DecodeString(challengeHex)
+
+	// With channel binding, the client has to sign the challenge XOR'ed with
+	// the SHA256 hash of the channel binding data, so the signature can not be
+	// replayed over another TLS connection.
+	expected := challenge
+	if bindingType != "" {
+		binding, err := channelBinding(details, bindingType)
+		if err != nil {
+			util.Logger.Warningf("Cryptosign channel binding failed: %v", err)
+			return nil, errors.New("wamp.error.invalid-channel-binding")
+		}
+		bindingHash := sha256.Sum256(binding)
+		expected = make([]byte, len(challenge))
+		for i := range challenge {
+			expected[i] = challenge[i] ^ bindingHash[i]
+		}
+	}
+
+	extra := wamp.Dict{
+		"challenge": challengeHex,
+	}
+	if bindingType != "" {
+		extra["channel_binding"] = bindingType
+	}
+	err = client.Send(&wamp.Challenge{
+		AuthMethod: a.AuthMethod(),
+		Extra:      extra,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Read AUTHENTICATE response from client.
+	// A timeout of 5 seconds should be enough for slow clients...
+	msg, err := wamp.RecvTimeout(client, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	authRsp, ok := msg.(*wamp.Authenticate)
+	if !ok {
+		util.Logger.Warningf("Protocol violation from %v: %v", client, msg.MessageType())
+		return nil, errors.New(string(wamp.ErrProtocolViolation))
+	}
+
+	// The signature is either the plain 64 byte signature or the signature
+	// followed by the signed message (96 bytes), as sent by autobahn clients.
+	signature, err := hex.DecodeString(authRsp.Signature)
+	if err != nil {
+		return nil, errors.New(string(wamp.ErrAuthenticationFailed))
+	}
+	switch len(signature) {
+	case ed25519.SignatureSize:
+	case ed25519.SignatureSize + len(expected):
+		if string(signature[ed25519.SignatureSize:]) != string(expected) {
+			return nil, errors.New(string(wamp.ErrAuthenticationFailed))
+		}
+		signature = signature[:ed25519.SignatureSize]
+	default:
+		return nil, errors.New(string(wamp.ErrAuthenticationFailed))
+	}
+	if !ed25519.Verify(pubkeyBytes, expected, signature) {
+		util.Logger.Infof("Invalid cryptosign signature for pubkey %v", pubkey)
+		return nil, errors.New(string(wamp.ErrAuthenticationFailed))
+	}
+
+	welcome, err := a.resolvePubKey(pubkey)
+	if err != nil {
+		return nil, err
+	}
+
+	// The client may announce an authid, it has to match the one assigned to
+	// the public key.
+	authid := wamp.OptionString(details, "authid")
+	if authid != "" && authid != welcome.Details["authid"] {
+		util.Logger.Warningf("Cryptosign authid mismatch: requested %v, key belongs to %v", authid, welcome.Details["authid"])
+		return nil, errors.New("Unauthorized")
+	}
+	return welcome, nil
+}
+
+// AuthMethod returns a string representing the type of the authenticator
+func (a *CryptosignAuth) AuthMethod() string {
+	return "cryptosign"
+}
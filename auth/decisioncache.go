@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"container/list"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
+
+	"github.com/gammazero/nexus/v3/client"
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// InvalidateDecisionsURI is used as procedure and topic to flush cached
+// authorization decisions, either all of them or only those of an authrole.
+const InvalidateDecisionsURI = "ee.authorizer.invalidate"
+
+// decisionKey identifies a cached authorization decision.
+type decisionKey struct {
+	roles  string
+	authid string
+	uri    wamp.URI
+	action string
+}
+
+type decisionEntry struct {
+	key     decisionKey
+	roles   authRoles
+	permit  bool
+	expires time.Time
+}
+
+// newDecisionKey creates the cache key of an action, the order of the
+// authroles does not matter.
+func newDecisionKey(roles authRoles, authid string, uri wamp.URI, action string) decisionKey {
+	sorted := append([]string{}, roles...)
+	sort.Strings(sorted)
+	return decisionKey{
+		roles:  strings.Join(sorted, "\x00"),
+		authid: authid,
+		uri:    uri,
+		action: action,
+	}
+}
+
+// DecisionCache is a bounded LRU cache of authorization decisions. The least
+// recently used decision is evicted when the cache is full.
+type DecisionCache struct {
+	Size    int
+	TTL     time.Duration
+	mu      sync.Mutex
+	entries map[decisionKey]*list.Element
+	order   *list.List
+	// generation is incremented by every invalidation, so decisions made
+	// before an invalidation are not stored afterwards.
+	generation uint64
+}
+
+// NewDecisionCache creates a cache holding at most size decisions for ttl.
+func NewDecisionCache(size int, ttl time.Duration) *DecisionCache {
+	return &DecisionCache{
+		Size:    size,
+		TTL:     ttl,
+		entries: make(map[decisionKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Get returns the cached decision for key, if there is an unexpired one.
+func (c *DecisionCache) Get(key decisionKey, now time.Time) (bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return false, false
+	}
+	entry := elem.Value.(*decisionEntry)
+	if now.After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return false, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.permit, true
+}
+
+// Generation returns the current generation, it has to be passed to Put.
+func (c *DecisionCache) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// Put stores a decision for ttl, unless the cache was invalidated since
+// generation was returned by Generation before the decision was made.
+func (c *DecisionCache) Put(key decisionKey, roles authRoles, permit bool, ttl time.Duration, now time.Time, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	entry := &decisionEntry{
+		key:     key,
+		roles:   roles,
+		permit:  permit,
+		expires: now.Add(ttl),
+	}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.Size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*decisionEntry).key)
+	}
+}
+
+// Invalidate removes all decisions made for sessions with the given authrole
+// and returns the number of removed decisions. An empty authrole flushes the
+// whole cache.
+func (c *DecisionCache) Invalidate(role string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if role == "" {
+		count := c.order.Len()
+		c.entries = make(map[decisionKey]*list.Element)
+		c.order.Init()
+		return count
+	}
+	count := 0
+	for key, elem := range c.entries {
+		for _, r := range elem.Value.(*decisionEntry).roles {
+			if r == role {
+				c.order.Remove(elem)
+				delete(c.entries, key)
+				count++
+				break
+			}
+		}
+	}
+	return count
+}
+
+// Initialize registers the invalidation procedure and subscribes to the
+// invalidation topic, so backends can flush the cache by calling or
+// publishing.
+func (c *DecisionCache) Initialize() {
+	err := util.LocalClient.Register(InvalidateDecisionsURI, c.invalidate, wamp.Dict{})
+	if err != nil {
+		util.Logger.Warningf("Failed to register %s: %v", InvalidateDecisionsURI, err)
+	}
+	err = util.LocalClient.Subscribe(InvalidateDecisionsURI, func(event *wamp.Event) {
+		role := invalidatedRole(event.Arguments, event.ArgumentsKw)
+		util.Logger.Infof("Flushed %d cached authorization decisions", c.Invalidate(role))
+	}, wamp.Dict{})
+	if err != nil {
+		util.Logger.Warningf("Failed to subscribe to %s: %v", InvalidateDecisionsURI, err)
+	}
+}
+
+// invalidatedRole returns the authrole given as first argument or as keyword
+// argument `authrole`, if any.
+func invalidatedRole(args wamp.List, kwargs wamp.Dict) string {
+	if len(args) > 0 {
+		role, _ := wamp.AsString(args[0])
+		return role
+	}
+	return wamp.OptionString(kwargs, "authrole")
+}
+
+func (c *DecisionCache) invalidate(_ context.Context, invk *wamp.Invocation) client.InvokeResult {
+	count := c.Invalidate(invalidatedRole(invk.Arguments, invk.ArgumentsKw))
+	util.Logger.Infof("Flushed %d cached authorization decisions", count)
+	return client.InvokeResult{
+		Args: wamp.List{
+			count,
+		},
+	}
+}
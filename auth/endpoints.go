@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"context"
+	"sync"
+
+	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// maxTrackedCalls is the number of calls per session whose procedure is
+// remembered for CANCEL, older calls are forgotten first.
+const maxTrackedCalls = 256
+
+// endpointTracker remembers the URIs of all subscriptions and registrations
+// using the meta events, so the URI an UNSUBSCRIBE or UNREGISTER refers to
+// is known without calling the meta API while nexus authorizes the message.
+// It also remembers the procedures of the permitted calls of each session,
+// which a CANCEL refers to by the request ID.
+type endpointTracker struct {
+	mu            sync.RWMutex
+	subscriptions map[wamp.ID]wamp.URI
+	registrations map[wamp.ID]wamp.URI
+	calls         map[wamp.ID]*sessionCalls
+}
+
+// sessionCalls are the procedures of the latest calls of a session by their
+// request ID. order is a ring buffer of the request IDs.
+type sessionCalls struct {
+	procedures map[wamp.ID]wamp.URI
+	order      []wamp.ID
+	next       int
+}
+
+// endpoints is shared by all authorizers, it is filled by TrackEndpoints.
+var endpoints = &endpointTracker{
+	subscriptions: make(map[wamp.ID]wamp.URI),
+	registrations: make(map[wamp.ID]wamp.URI),
+	calls:         make(map[wamp.ID]*sessionCalls),
+}
+
+// TrackEndpoints subscribes to the meta events about created and deleted
+// subscriptions and registrations and loads the existing ones. Without it,
+// the URIs of UNSUBSCRIBE and UNREGISTER are unknown to the authorizers.
+// The calls of a session are forgotten when it leaves.
+func TrackEndpoints() {
+	endpoints.track(wamp.MetaEventSubOnCreate, wamp.MetaEventSubOnDelete, endpoints.subscriptions)
+	endpoints.track(wamp.MetaEventRegOnCreate, wamp.MetaEventRegOnDelete, endpoints.registrations)
+	endpoints.load(wamp.MetaProcSubList, wamp.MetaProcSubGet, endpoints.subscriptions)
+	endpoints.load(wamp.MetaProcRegList, wamp.MetaProcRegGet, endpoints.registrations)
+	err := util.LocalClient.Subscribe(string(wamp.MetaEventSessionOnLeave), func(event *wamp.Event) {
+		if len(event.Arguments) == 0 {
+			return
+		}
+		if id, ok := wamp.AsID(event.Arguments[0]); ok {
+			endpoints.mu.Lock()
+			delete(endpoints.calls, id)
+			endpoints.mu.Unlock()
+		}
+	}, wamp.Dict{})
+	if err != nil {
+		util.Logger.Warningf("Failed to subscribe to %v: %v", wamp.MetaEventSessionOnLeave, err)
+	}
+}
+
+// track keeps uris up to date. The create events carry the details of the
+// subscription or registration, the delete events only its ID.
+func (t *endpointTracker) track(onCreate, onDelete wamp.URI, uris map[wamp.ID]wamp.URI) {
+	err := util.LocalClient.Subscribe(string(onCreate), func(event *wamp.Event) {
+		if len(event.Arguments) < 2 {
+			return
+		}
+		details, _ := wamp.AsDict(event.Arguments[1])
+		t.add(uris, details)
+	}, wamp.Dict{})
+	if err != nil {
+		util.Logger.Warningf("Failed to subscribe to %v: %v", onCreate, err)
+	}
+	err = util.LocalClient.Subscribe(string(onDelete), func(event *wamp.Event) {
+		if len(event.Arguments) < 2 {
+			return
+		}
+		if id, ok := wamp.AsID(event.Arguments[1]); ok {
+			t.mu.Lock()
+			delete(uris, id)
+			t.mu.Unlock()
+		}
+	}, wamp.Dict{})
+	if err != nil {
+		util.Logger.Warningf("Failed to subscribe to %v: %v", onDelete, err)
+	}
+}
+
+// add stores the URI of a subscription or registration given by its details.
+func (t *endpointTracker) add(uris map[wamp.ID]wamp.URI, details wamp.Dict) {
+	id, idOk := wamp.AsID(details["id"])
+	uri, uriOk := wamp.AsURI(details["uri"])
+	if !idOk || !uriOk {
+		return
+	}
+	t.mu.Lock()
+	uris[id] = uri
+	t.mu.Unlock()
+}
+
+// load adds the subscriptions or registrations which existed before track
+// was called, the list procedure returns their IDs by match policy.
+func (t *endpointTracker) load(list, get wamp.URI, uris map[wamp.ID]wamp.URI) {
+	res, err := util.CallUpstream(context.Background(), string(list), nil, nil)
+	if err != nil || len(res.Arguments) == 0 {
+		util.Logger.Warningf("Failed to list endpoints via %v: %v", list, err)
+		return
+	}
+	byMatch, _ := wamp.AsDict(res.Arguments[0])
+	for _, idsRaw := range byMatch {
+		ids, _ := wamp.AsList(idsRaw)
+		for _, id := range ids {
+			res, err := util.CallUpstream(context.Background(), string(get), wamp.List{id}, nil)
+			if err != nil || len(res.Arguments) == 0 {
+				continue
+			}
+			details, _ := wamp.AsDict(res.Arguments[0])
+			t.add(uris, details)
+		}
+	}
+}
+
+// lookup returns the URI of the subscription or registration id.
+func (t *endpointTracker) lookup(uris map[wamp.ID]wamp.URI, id wamp.ID) wamp.URI {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return uris[id]
+}
+
+// addCall remembers the procedure of the call request of session.
+func (t *endpointTracker) addCall(session, request wamp.ID, procedure wamp.URI) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	calls, ok := t.calls[session]
+	if !ok {
+		calls = &sessionCalls{procedures: make(map[wamp.ID]wamp.URI)}
+		t.calls[session] = calls
+	}
+	if _, ok := calls.procedures[request]; !ok {
+		if len(calls.order) < maxTrackedCalls {
+			calls.order = append(calls.order, request)
+		} else {
+			delete(calls.procedures, calls.order[calls.next])
+			calls.order[calls.next] = request
+			calls.next = (calls.next + 1) % maxTrackedCalls
+		}
+	}
+	calls.procedures[request] = procedure
+}
+
+// lookupCall returns the procedure of the call request of session.
+func (t *endpointTracker) lookupCall(session, request wamp.ID) wamp.URI {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if calls, ok := t.calls[session]; ok {
+		return calls.procedures[request]
+	}
+	return ""
+}
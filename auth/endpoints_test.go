@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// actionRecorder permits all messages and records their resolved URIs.
+type actionRecorder struct {
+	uris []wamp.URI
+}
+
+func (r *actionRecorder) Authorize(sess *wamp.Session, msg wamp.Message) (bool, error) {
+	uri, _ := resolveMessageAction(sess, msg)
+	r.uris = append(r.uris, uri)
+	return true, nil
+}
+
+func TestGuardResolvesCancel(t *testing.T) {
+	recorder := &actionRecorder{}
+	guard := &MessageGuard{
+		Authorizer:           recorder,
+		AuthorizeWithdrawals: true,
+	}
+	sess := &wamp.Session{ID: 1001, Details: wamp.Dict{"authrole": "user"}}
+	other := &wamp.Session{ID: 1002, Details: wamp.Dict{"authrole": "user"}}
+
+	guard.Authorize(sess, &wamp.Call{Request: 1, Procedure: "com.app.first"})
+	guard.Authorize(sess, &wamp.Call{Request: 2, Procedure: "com.app.second"})
+	guard.Authorize(sess, &wamp.Cancel{Request: 2})
+	guard.Authorize(sess, &wamp.Cancel{Request: 1})
+	// Request IDs are scoped to the session.
+	guard.Authorize(other, &wamp.Cancel{Request: 1})
+	guard.Authorize(sess, &wamp.Cancel{Request: 3})
+
+	expected := []wamp.URI{"com.app.first", "com.app.second", "com.app.second", "com.app.first", "", ""}
+	if len(recorder.uris) != len(expected) {
+		t.Fatalf("Expected %d authorizations, got %d", len(expected), len(recorder.uris))
+	}
+	for i, uri := range expected {
+		if recorder.uris[i] != uri {
+			t.Errorf("Authorization %d: expected %q, got %q", i, uri, recorder.uris[i])
+		}
+	}
+}
+
+func TestEndpointTrackerForgetsOldCalls(t *testing.T) {
+	const session = 2001
+	for i := 1; i <= maxTrackedCalls+10; i++ {
+		endpoints.addCall(session, wamp.ID(i), "com.app.call")
+	}
+	cases := map[wamp.ID]wamp.URI{
+		1:                    "",
+		10:                   "",
+		11:                   "com.app.call",
+		maxTrackedCalls + 10: "com.app.call",
+	}
+	for request, expected := range cases {
+		if uri := endpoints.lookupCall(session, request); uri != expected {
+			t.Errorf("Request %d: expected %q, got %q", request, expected, uri)
+		}
+	}
+	endpoints.mu.RLock()
+	count := len(endpoints.calls[session].procedures)
+	endpoints.mu.RUnlock()
+	if count != maxTrackedCalls {
+		t.Errorf("Expected %d tracked calls, got %d", maxTrackedCalls, count)
+	}
+}
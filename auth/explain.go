@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"context"
+
+	"github.com/EmbeddedEnterprises/autobahnkreuz/auth/multiauthorizer"
+	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
+
+	mapset "github.com/deckarep/golang-set"
+
+	"github.com/gammazero/nexus/v3/client"
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// ExplainProcedure returns how the authorizers decide about an action of a
+// session.
+const ExplainProcedure = "ee.authorizer.explain"
+
+// AuthorizationExplainer provides ExplainProcedure for the authorizers of the
+// realm, it may only be called by trusted authroles.
+type AuthorizationExplainer struct {
+	Authorizer       *multiauthorizer.MultiAuthorizer
+	TrustedAuthRoles mapset.Set
+	// Guard decides about the meta API before the authorizers, it may be nil.
+	Guard *MessageGuard
+}
+
+// Initialize registers ExplainProcedure. The caller is disclosed, so the
+// authrole of the caller can be checked.
+func (e *AuthorizationExplainer) Initialize() {
+	err := util.LocalClient.Register(ExplainProcedure, e.explain, wamp.Dict{
+		wamp.OptDiscloseCaller: true,
+	})
+	if err != nil {
+		util.Logger.Warningf("Failed to register %s: %v", ExplainProcedure, err)
+	}
+}
+
+// explainedSession creates a session from a dict containing authid,
+// authroles (or authrole) and authextra.
+func explainedSession(raw interface{}) (*wamp.Session, bool) {
+	dict, ok := wamp.AsDict(raw)
+	if !ok || dict == nil {
+		return nil, false
+	}
+	roles, ok := dict["authroles"]
+	if !ok {
+		roles = dict["authrole"]
+	}
+	if _, err := extractAuthRoles(roles); err != nil {
+		return nil, false
+	}
+	return &wamp.Session{
+		Details: wamp.Dict{
+			"authid":       dict["authid"],
+			"authrole":     roles,
+			"authextra":    dict["authextra"],
+			"authmethod":   dict["authmethod"],
+			"authprovider": dict["authprovider"],
+		},
+	}, true
+}
+
+// explain takes the session, the URI and the action as positional arguments
+// or as keyword arguments `session`, `uri` and `action`.
+func (e *AuthorizationExplainer) explain(_ context.Context, invk *wamp.Invocation) client.InvokeResult {
+	if !trustedCaller(invk, e.TrustedAuthRoles) {
+		return client.InvokeResult{Err: wamp.ErrNotAuthorized}
+	}
+
+	sessionRaw, uriRaw, actionRaw := invk.ArgumentsKw["session"], invk.ArgumentsKw["uri"], invk.ArgumentsKw["action"]
+	if len(invk.Arguments) > 0 {
+		sessionRaw = invk.Arguments[0]
+	}
+	if len(invk.Arguments) > 1 {
+		uriRaw = invk.Arguments[1]
+	}
+	if len(invk.Arguments) > 2 {
+		actionRaw = invk.Arguments[2]
+	}
+
+	sess, ok := explainedSession(sessionRaw)
+	uri, uriOk := wamp.AsURI(uriRaw)
+	action, _ := wamp.AsString(actionRaw)
+	if !ok || !uriOk || uri == "" {
+		return client.InvokeResult{Err: wamp.ErrInvalidArgument}
+	}
+	msg, err := actionMessage(uri, action)
+	if err != nil {
+		return client.InvokeResult{
+			Err:  wamp.ErrInvalidArgument,
+			Args: wamp.List{err.Error()},
+		}
+	}
+
+	explanation := e.Authorizer.Explain(sess, msg)
+	if e.Guard != nil {
+		if permitted, decided := e.Guard.decide(sess, msg); decided {
+			explanation["permit"] = permitted
+			explanation["meta_api_policy"] = e.Guard.MetaAPIPolicy
+		}
+	}
+	return client.InvokeResult{
+		Args: wamp.List{
+			explanation,
+		},
+	}
+}
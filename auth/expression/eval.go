@@ -0,0 +1,388 @@
+package expression
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+type node interface {
+	eval(env map[string]interface{}) (interface{}, error)
+}
+
+type constantNode struct {
+	value interface{}
+}
+
+func (n constantNode) eval(map[string]interface{}) (interface{}, error) {
+	return n.value, nil
+}
+
+type variableNode struct {
+	name string
+}
+
+func (n variableNode) eval(env map[string]interface{}) (interface{}, error) {
+	return env[n.name], nil
+}
+
+type listNode struct {
+	items []node
+}
+
+func (n listNode) eval(env map[string]interface{}) (interface{}, error) {
+	list := make(wamp.List, len(n.items))
+	for i, item := range n.items {
+		value, err := item.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = value
+	}
+	return list, nil
+}
+
+// memberNode accesses an attribute of a dictionary or an element of a list.
+type memberNode struct {
+	value node
+	key   node
+}
+
+func (n memberNode) eval(env map[string]interface{}) (interface{}, error) {
+	value, err := n.value.eval(env)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	key, err := n.key.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if dict, ok := wamp.AsDict(value); ok {
+		name, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("dictionary key is %s, not a string", typeName(key))
+		}
+		return dict[name], nil
+	}
+	if list, ok := wamp.AsList(value); ok {
+		index, ok := wamp.AsFloat64(key)
+		if !ok {
+			return nil, fmt.Errorf("list index is %s, not a number", typeName(key))
+		}
+		if index < 0 || int(index) >= len(list) || index != float64(int(index)) {
+			return nil, nil
+		}
+		return list[int(index)], nil
+	}
+	return nil, fmt.Errorf("can not access an attribute of %s", typeName(value))
+}
+
+type logicalNode struct {
+	or    bool
+	left  node
+	right node
+}
+
+func (n logicalNode) eval(env map[string]interface{}) (interface{}, error) {
+	left, err := evalBool(n.left, env)
+	if err != nil {
+		return nil, err
+	}
+	// Short circuit, the right side may be invalid if the left side decides.
+	if left == n.or {
+		return left, nil
+	}
+	return evalBool(n.right, env)
+}
+
+type notNode struct {
+	operand node
+}
+
+func (n notNode) eval(env map[string]interface{}) (interface{}, error) {
+	operand, err := evalBool(n.operand, env)
+	if err != nil {
+		return nil, err
+	}
+	return !operand, nil
+}
+
+type negateNode struct {
+	operand node
+}
+
+func (n negateNode) eval(env map[string]interface{}) (interface{}, error) {
+	operand, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	number, ok := asNumber(operand)
+	if !ok {
+		return nil, fmt.Errorf("can not negate %s", typeName(operand))
+	}
+	return -number, nil
+}
+
+type compareNode struct {
+	operator string
+	left     node
+	right    node
+}
+
+func (n compareNode) eval(env map[string]interface{}) (interface{}, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.operator {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "in":
+		return contains(right, left)
+	}
+
+	var order int
+	leftNumber, leftIsNumber := asNumber(left)
+	rightNumber, rightIsNumber := asNumber(right)
+	leftString, leftIsString := left.(string)
+	rightString, rightIsString := right.(string)
+	switch {
+	case leftIsNumber && rightIsNumber:
+		switch {
+		case leftNumber < rightNumber:
+			order = -1
+		case leftNumber > rightNumber:
+			order = 1
+		}
+	case leftIsString && rightIsString:
+		order = strings.Compare(leftString, rightString)
+	default:
+		return nil, fmt.Errorf("can not compare %s and %s", typeName(left), typeName(right))
+	}
+	switch n.operator {
+	case "<":
+		return order < 0, nil
+	case "<=":
+		return order <= 0, nil
+	case ">":
+		return order > 0, nil
+	}
+	return order >= 0, nil
+}
+
+type callNode struct {
+	name string
+	fn   func(args []interface{}) (interface{}, error)
+	args []node
+}
+
+func (n callNode) eval(env map[string]interface{}) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+	result, err := n.fn(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", n.name, err)
+	}
+	return result, nil
+}
+
+func evalBool(n node, env map[string]interface{}) (bool, error) {
+	value, err := n.eval(env)
+	if err != nil {
+		return false, err
+	}
+	result, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("operand is %s, not a boolean", typeName(value))
+	}
+	return result, nil
+}
+
+// asNumber converts all numeric types, WAMP serializers decode numbers into
+// different types.
+func asNumber(value interface{}) (float64, bool) {
+	if _, isBool := value.(bool); isBool {
+		return 0, false
+	}
+	return wamp.AsFloat64(value)
+}
+
+func equal(left interface{}, right interface{}) bool {
+	if leftNumber, ok := asNumber(left); ok {
+		rightNumber, ok := asNumber(right)
+		return ok && leftNumber == rightNumber
+	}
+	if leftList, ok := wamp.AsList(left); ok && left != nil {
+		rightList, ok := wamp.AsList(right)
+		if !ok || right == nil || len(leftList) != len(rightList) {
+			return false
+		}
+		for i := range leftList {
+			if !equal(leftList[i], rightList[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	if leftDict, ok := wamp.AsDict(left); ok && left != nil {
+		rightDict, ok := wamp.AsDict(right)
+		if !ok || right == nil || len(leftDict) != len(rightDict) {
+			return false
+		}
+		for key, value := range leftDict {
+			if rightValue, found := rightDict[key]; !found || !equal(value, rightValue) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(left, right)
+}
+
+// contains implements the in operator.
+func contains(container interface{}, value interface{}) (interface{}, error) {
+	switch {
+	case container == nil:
+		return false, nil
+	case isString(container):
+		substring, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("can not search %s in a string", typeName(value))
+		}
+		return strings.Contains(container.(string), substring), nil
+	}
+	if dict, ok := wamp.AsDict(container); ok {
+		key, ok := value.(string)
+		if !ok {
+			return false, nil
+		}
+		_, found := dict[key]
+		return found, nil
+	}
+	if list, ok := wamp.AsList(container); ok {
+		for _, item := range list {
+			if equal(item, value) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return nil, fmt.Errorf("can not search in %s", typeName(container))
+}
+
+func isString(value interface{}) bool {
+	_, ok := value.(string)
+	return ok
+}
+
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "a boolean"
+	case string:
+		return "a string"
+	}
+	if _, ok := asNumber(value); ok {
+		return "a number"
+	}
+	if _, ok := wamp.AsDict(value); ok {
+		return "a dictionary"
+	}
+	if _, ok := wamp.AsList(value); ok {
+		return "a list"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+type function struct {
+	arity int
+	call  func(args []interface{}) (interface{}, error)
+}
+
+// stringFunction wraps a function of two strings, it returns false if one of
+// the arguments is null.
+func stringFunction(fn func(string, string) bool) function {
+	return function{
+		arity: 2,
+		call: func(args []interface{}) (interface{}, error) {
+			if args[0] == nil || args[1] == nil {
+				return false, nil
+			}
+			s, ok := args[0].(string)
+			t, ok2 := args[1].(string)
+			if !ok || !ok2 {
+				return nil, fmt.Errorf("arguments are %s and %s, not strings", typeName(args[0]), typeName(args[1]))
+			}
+			return fn(s, t), nil
+		},
+	}
+}
+
+// functions are the functions available in expressions.
+var functions = map[string]function{
+	"startsWith": stringFunction(strings.HasPrefix),
+	"endsWith":   stringFunction(strings.HasSuffix),
+	// matches tests whether a string matches a regular expression literal.
+	"matches": {
+		arity: 2,
+		call: func(args []interface{}) (interface{}, error) {
+			if args[0] == nil {
+				return false, nil
+			}
+			s, ok := args[0].(string)
+			if !ok {
+				return nil, fmt.Errorf("argument is %s, not a string", typeName(args[0]))
+			}
+			return args[1].(*regexp.Regexp).MatchString(s), nil
+		},
+	},
+	// len returns the length of a string, a list or a dictionary, 0 for null.
+	"len": {
+		arity: 1,
+		call: func(args []interface{}) (interface{}, error) {
+			if args[0] == nil {
+				return float64(0), nil
+			}
+			if s, ok := args[0].(string); ok {
+				return float64(len(s)), nil
+			}
+			if dict, ok := wamp.AsDict(args[0]); ok {
+				return float64(len(dict)), nil
+			}
+			if list, ok := wamp.AsList(args[0]); ok {
+				return float64(len(list)), nil
+			}
+			return nil, fmt.Errorf("%s has no length", typeName(args[0]))
+		},
+	},
+	"lower": {
+		arity: 1,
+		call: func(args []interface{}) (interface{}, error) {
+			if args[0] == nil {
+				return nil, nil
+			}
+			s, ok := args[0].(string)
+			if !ok {
+				return nil, fmt.Errorf("argument is %s, not a string", typeName(args[0]))
+			}
+			return strings.ToLower(s), nil
+		},
+	},
+}
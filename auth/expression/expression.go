@@ -0,0 +1,75 @@
+// Package expression implements a small expression language to evaluate
+// conditions on session attributes, e.g.
+//
+//	authextra.tenant == segments[2] && "admin" in authrole
+//
+// Expressions are compiled once and can be evaluated concurrently.
+//
+// Values are null, booleans, numbers, strings, lists and dictionaries.
+// Attributes of dictionaries are accessed with `.name` or `["name"]`, list
+// elements with `[index]`. Missing attributes and elements are null instead
+// of an error, so optional attributes can be compared with null.
+//
+// Operators are `||`, `&&`, `!`, `==`, `!=`, `<`, `<=`, `>`, `>=`, `-`
+// (negation) and `in`, which tests whether a list contains a value, a
+// dictionary contains a key or a string contains a substring. The functions
+// are startsWith(s, prefix), endsWith(s, suffix), matches(s, "regexp"),
+// len(value) and lower(s).
+package expression
+
+import (
+	"fmt"
+)
+
+// Expression is a compiled expression.
+type Expression struct {
+	source string
+	root   node
+}
+
+// Compile parses source. If variables are given, all other variables are
+// rejected.
+func Compile(source string, variables ...string) (*Expression, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	if len(variables) > 0 {
+		p.variables = make(map[string]bool, len(variables))
+		for _, variable := range variables {
+			p.variables[variable] = true
+		}
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenEOF {
+		return nil, p.unexpected("expected end of expression")
+	}
+	return &Expression{source: source, root: root}, nil
+}
+
+// String returns the source of the expression.
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Eval evaluates the expression, the variables are taken from env.
+func (e *Expression) Eval(env map[string]interface{}) (interface{}, error) {
+	return e.root.eval(env)
+}
+
+// EvalBool evaluates a condition, it fails if the result is not a boolean.
+func (e *Expression) EvalBool(env map[string]interface{}) (bool, error) {
+	value, err := e.Eval(env)
+	if err != nil {
+		return false, err
+	}
+	result, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s is %s, not a boolean", e.source, typeName(value))
+	}
+	return result, nil
+}
@@ -0,0 +1,90 @@
+package expression
+
+import (
+	"testing"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+func TestEval(t *testing.T) {
+	env := map[string]interface{}{
+		"authid":    "alice",
+		"authrole":  wamp.List{"user", "tenant-admin"},
+		"authextra": wamp.Dict{"tenant": "acme", "level": int64(3)},
+		"segments":  wamp.List{"com", "tenant", "acme", "report"},
+		"action":    "call",
+	}
+	tests := []struct {
+		source string
+		result bool
+	}{
+		{`authextra.tenant == segments[2]`, true},
+		{`authextra["tenant"] != segments[1]`, true},
+		{`"tenant-admin" in authrole && action == 'call'`, true},
+		{`"admin" in authrole || authextra.level >= 3`, true},
+		{`authextra.level < -1`, false},
+		{`!(authextra.missing == null)`, false},
+		{`authextra.missing.deeper == null`, true},
+		{`segments[10] == null`, true},
+		{`startsWith(authid, "al") && endsWith(authid, "ce")`, true},
+		{`matches(authid, "^[a-z]+$") && len(segments) == 4`, true},
+		{`lower("ACME") in ["foo", authextra.tenant]`, true},
+		{`"level" in authextra && "lic" in authid`, true},
+		// The right side is not evaluated, otherwise it would fail.
+		{`false && authid < 1`, false},
+	}
+	for _, test := range tests {
+		expr, err := Compile(test.source)
+		if err != nil {
+			t.Errorf("%s: %v", test.source, err)
+			continue
+		}
+		result, err := expr.EvalBool(env)
+		if err != nil {
+			t.Errorf("%s: %v", test.source, err)
+		} else if result != test.result {
+			t.Errorf("%s: got %v, expected %v", test.source, result, test.result)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	env := map[string]interface{}{
+		"authid": "alice",
+	}
+	for _, source := range []string{
+		`authid < 1`,
+		`authid`,
+		`!authid`,
+		`authid.name`,
+	} {
+		expr, err := Compile(source)
+		if err != nil {
+			t.Errorf("%s: %v", source, err)
+			continue
+		}
+		if _, err := expr.EvalBool(env); err == nil {
+			t.Errorf("%s: expected an error", source)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, source := range []string{
+		``,
+		`authid ==`,
+		`(authid == "a"`,
+		`authid == "a`,
+		`unknown == 1`,
+		`nosuchfunction(authid)`,
+		`len(authid, authid)`,
+		`matches(authid, authid)`,
+		`matches(authid, "(")`,
+		`authid == 1 2`,
+		`authid # 1`,
+	} {
+		if _, err := Compile(source, "authid"); err == nil {
+			t.Errorf("%s: expected an error", source)
+		}
+	}
+}
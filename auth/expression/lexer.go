@@ -0,0 +1,118 @@
+package expression
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOperator
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value interface{}
+	pos   int
+}
+
+// operators are sorted by length, so the longest operator matches first.
+var operators = []string{
+	"&&", "||", "==", "!=", "<=", ">=",
+	"!", "<", ">", "-", ".", ",", "(", ")", "[", "]",
+}
+
+// tokenize splits source into tokens, the last token is always tokenEOF.
+func tokenize(source string) ([]token, error) {
+	var tokens []token
+	pos := 0
+	for pos < len(source) {
+		c := source[pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos++
+		case isIdentStart(c):
+			start := pos
+			for pos < len(source) && isIdentPart(source[pos]) {
+				pos++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: source[start:pos], pos: start})
+		case c >= '0' && c <= '9':
+			start := pos
+			for pos < len(source) && (source[pos] >= '0' && source[pos] <= '9' || source[pos] == '.') {
+				pos++
+			}
+			number, err := strconv.ParseFloat(source[start:pos], 64)
+			if err != nil {
+				return nil, fmt.Errorf("position %d: invalid number %s", start, source[start:pos])
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: source[start:pos], value: number, pos: start})
+		case c == '"' || c == '\'':
+			start := pos
+			text, end, err := readString(source, pos)
+			if err != nil {
+				return nil, err
+			}
+			pos = end
+			tokens = append(tokens, token{kind: tokenString, text: source[start:pos], value: text, pos: start})
+		default:
+			operator := ""
+			for _, candidate := range operators {
+				if strings.HasPrefix(source[pos:], candidate) {
+					operator = candidate
+					break
+				}
+			}
+			if operator == "" {
+				return nil, fmt.Errorf("position %d: unexpected character %q", pos, c)
+			}
+			tokens = append(tokens, token{kind: tokenOperator, text: operator, pos: pos})
+			pos += len(operator)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: pos}), nil
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || c >= '0' && c <= '9'
+}
+
+// readString reads the string literal starting with the quote at pos and
+// returns its content and the position after the closing quote.
+func readString(source string, pos int) (string, int, error) {
+	quote := source[pos]
+	var text strings.Builder
+	for i := pos + 1; i < len(source); i++ {
+		switch c := source[i]; c {
+		case quote:
+			return text.String(), i + 1, nil
+		case '\\':
+			i++
+			if i == len(source) {
+				break
+			}
+			switch escaped := source[i]; escaped {
+			case 'n':
+				text.WriteByte('\n')
+			case 't':
+				text.WriteByte('\t')
+			default:
+				text.WriteByte(escaped)
+			}
+		default:
+			text.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("position %d: unterminated string", pos)
+}
@@ -0,0 +1,246 @@
+package expression
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// parser is a recursive descent parser, each method parses one precedence
+// level:
+//
+//	or      = and { "||" and }
+//	and     = compare { "&&" compare }
+//	compare = unary [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" | "in" ) unary ]
+//	unary   = ( "!" | "-" ) unary | postfix
+//	postfix = primary { "." ident | "[" or "]" }
+//	primary = number | string | "true" | "false" | "null" | "[" [ or { "," or } ] "]"
+//	        | ident | ident "(" [ or { "," or } ] ")" | "(" or ")"
+type parser struct {
+	tokens    []token
+	pos       int
+	variables map[string]bool
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is the operator or keyword text.
+func (p *parser) accept(text string) bool {
+	t := p.peek()
+	if (t.kind == tokenOperator || t.kind == tokenIdent) && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		return p.unexpected(fmt.Sprintf("expected %s", text))
+	}
+	return nil
+}
+
+func (p *parser) unexpected(reason string) error {
+	t := p.peek()
+	if t.kind == tokenEOF {
+		return fmt.Errorf("position %d: %s, got end of expression", t.pos, reason)
+	}
+	return fmt.Errorf("position %d: %s, got %s", t.pos, reason, t.text)
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalNode{or: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseCompare()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseCompare()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseCompare() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for _, operator := range []string{"==", "!=", "<=", ">=", "<", ">", "in"} {
+		if p.accept(operator) {
+			right, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			return compareNode{operator: operator, left: left, right: right}, nil
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.accept("!") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand: operand}, nil
+	}
+	if p.accept("-") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return negateNode{operand: operand}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *parser) parsePostfix() (node, error) {
+	value, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			t := p.peek()
+			if t.kind != tokenIdent {
+				return nil, p.unexpected("expected attribute name")
+			}
+			p.next()
+			value = memberNode{value: value, key: constantNode{value: t.text}}
+		case p.accept("["):
+			key, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			value = memberNode{value: value, key: key}
+		default:
+			return value, nil
+		}
+	}
+}
+
+func (p *parser) parseList(end string) ([]node, error) {
+	var items []node
+	if p.accept(end) {
+		return items, nil
+	}
+	for {
+		item, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		if p.accept(end) {
+			return items, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.peek()
+	if t.kind == tokenEOF || t.kind == tokenIdent && t.text == "in" {
+		return nil, p.unexpected("expected value")
+	}
+	p.next()
+	switch t.kind {
+	case tokenNumber, tokenString:
+		return constantNode{value: t.value}, nil
+	case tokenOperator:
+		switch t.text {
+		case "(":
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return inner, p.expect(")")
+		case "[":
+			items, err := p.parseList("]")
+			if err != nil {
+				return nil, err
+			}
+			return listNode{items: items}, nil
+		}
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return constantNode{value: true}, nil
+		case "false":
+			return constantNode{value: false}, nil
+		case "null":
+			return constantNode{value: nil}, nil
+		}
+		if p.accept("(") {
+			return p.parseCall(t)
+		}
+		if p.variables != nil && !p.variables[t.text] {
+			return nil, fmt.Errorf("position %d: unknown variable %s", t.pos, t.text)
+		}
+		return variableNode{name: t.text}, nil
+	}
+	return nil, fmt.Errorf("position %d: expected value, got %s", t.pos, t.text)
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	fn, ok := functions[name.text]
+	if !ok {
+		return nil, fmt.Errorf("position %d: unknown function %s", name.pos, name.text)
+	}
+	args, err := p.parseList(")")
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != fn.arity {
+		return nil, fmt.Errorf("position %d: %s takes %d arguments, got %d", name.pos, name.text, fn.arity, len(args))
+	}
+	call := callNode{name: name.text, fn: fn.call, args: args}
+	// Regular expressions are compiled once, so they have to be literals.
+	if name.text == "matches" {
+		pattern, ok := args[1].(constantNode)
+		source, isString := pattern.value.(string)
+		if !ok || !isString {
+			return nil, fmt.Errorf("position %d: the pattern of matches has to be a string literal", name.pos)
+		}
+		re, err := regexp.Compile(source)
+		if err != nil {
+			return nil, fmt.Errorf("position %d: %v", name.pos, err)
+		}
+		call.args[1] = constantNode{value: re}
+	}
+	return call, nil
+}
@@ -3,7 +3,12 @@ package auth
 import (
 	"context"
 	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/EmbeddedEnterprises/autobahnkreuz/auth/multiauthorizer"
 	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
 
 	mapset "github.com/deckarep/golang-set"
@@ -13,21 +18,72 @@ import (
 )
 
 type FeatureAuthorizer struct {
+	// CallCounter is updated atomically, it has to be the first field to be
+	// 64-bit aligned on 32-bit platforms.
+	CallCounter      uint64
 	PermitDefault    bool
 	MatrixURI        string
 	MappingURI       string
 	TrustedAuthRoles mapset.Set
-	FeatureMatrix    *FeatureMatrix
-	FeatureMapping   *FeatureMapping
-	CallCounter      int
+	// RolesURI returns the role hierarchy, if it is empty the hierarchy is
+	// taken from the reply of MatrixURI.
+	RolesURI string
+	// RefreshInterval is the time between two fetches of matrix and mapping,
+	// 0 disables the periodic refresh.
+	RefreshInterval time.Duration
+	// UpdateTopic receives new matrices and mappings from the providers, it
+	// may be empty.
+	UpdateTopic string
+	// RejectInvalidUpdates discards the whole update if the matrix, the
+	// mapping or the role hierarchy is invalid, instead of applying the valid
+	// parts.
+	RejectInvalidUpdates bool
+
+	// snapshot holds the current *featureSnapshot.
+	snapshot atomic.Value
+	// updateMu serializes snapshot swaps.
+	updateMu sync.Mutex
+	version  uint64
+	// done stops the loading started by Initialize when closed.
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-type FeatureMatrix map[wamp.URI]map[string]bool
-type FeatureMapping map[wamp.URI]wamp.URI
+// FeatureMatrix maps features to the permissions of each authrole.
+type FeatureMatrix map[wamp.URI]map[string]RoleGrant
+
+// FeatureMapping maps endpoint URIs to features, grouped by the WAMP match
+// policy (exact, prefix or wildcard) of the endpoint URI.
+type FeatureMapping map[string]map[wamp.URI]wamp.URI
+
+// add maps the endpoint pattern to the feature. If the pattern is mapped to
+// multiple features, the lexically smallest feature is used, so the result
+// does not depend on the order of the reply.
+func (m FeatureMapping) add(match string, pattern wamp.URI, feature wamp.URI) {
+	if m[match] == nil {
+		m[match] = make(map[wamp.URI]wamp.URI)
+	}
+	if existing, ok := m[match][pattern]; ok && existing < feature {
+		util.Logger.Warningf("%s is mapped to %s and %s, using %s", pattern, existing, feature, existing)
+		return
+	}
+	m[match][pattern] = feature
+}
+
+// Len returns the number of endpoint patterns.
+func (m FeatureMapping) Len() int {
+	count := 0
+	for _, patterns := range m {
+		count += len(patterns)
+	}
+	return count
+}
 
 func NewFeatureAuthorizer(permitDefault bool, matrixURI string, mappingURI string, trustedAuthRoles mapset.Set) *FeatureAuthorizer {
 
-	featureAuthorizer := FeatureAuthorizer{}
+	featureAuthorizer := &FeatureAuthorizer{
+		done: make(chan struct{}),
+	}
 
 	util.Logger.Infof("permitDefault: %v", permitDefault)
 
@@ -35,11 +91,8 @@ func NewFeatureAuthorizer(permitDefault bool, matrixURI string, mappingURI strin
 	featureAuthorizer.MatrixURI = matrixURI
 	featureAuthorizer.MappingURI = mappingURI
 	featureAuthorizer.TrustedAuthRoles = trustedAuthRoles
-	featureAuthorizer.FeatureMatrix = nil
-	featureAuthorizer.FeatureMapping = nil
-	featureAuthorizer.CallCounter = 0
 
-	return &featureAuthorizer
+	return featureAuthorizer
 }
 
 func (this *FeatureAuthorizer) Initialize() {
@@ -53,41 +106,148 @@ func (this *FeatureAuthorizer) Initialize() {
 	if err != nil {
 		util.Logger.Warningf("%v", err)
 	}
+	err = util.LocalClient.Register("ee.featureauth.status", this.Status, wamp.Dict{})
+	if err != nil {
+		util.Logger.Warningf("%v", err)
+	}
+
+	if this.UpdateTopic != "" {
+		util.Logger.Infof("Subscribing to %s", this.UpdateTopic)
+		err = util.LocalClient.Subscribe(this.UpdateTopic, this.onUpdateEvent, wamp.Dict{})
+		if err != nil {
+			util.Logger.Warningf("Failed to subscribe to %s: %v", this.UpdateTopic, err)
+		}
+	}
+
+	// The providers may register their functions after the router started.
+	go reloader{
+		name: "feature matrix and mapping",
+		load: func() error {
+			return this.update(context.Background())
+		},
+		interval: this.RefreshInterval,
+	}.run(this.done)
 }
 
-func (this *FeatureAuthorizer) Update(_ context.Context, _ *wamp.Invocation) client.InvokeResult {
-	util.Logger.Infof("Updating Matrix and Mapping.")
+// Close stops loading and refreshing matrix and mapping.
+func (this *FeatureAuthorizer) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.done)
+	})
+	return nil
+}
 
-	err := this.UpdateMatrix()
+// onUpdateEvent applies a matrix, mapping and role hierarchy pushed on
+// UpdateTopic. They may be given as positional arguments or as keyword
+// arguments `matrix`, `mapping` and `roles`, if none is given they are fetched
+// from the providers.
+func (this *FeatureAuthorizer) onUpdateEvent(event *wamp.Event) {
+	matrixRaw, mappingRaw, rolesRaw := event.ArgumentsKw["matrix"], event.ArgumentsKw["mapping"], event.ArgumentsKw["roles"]
+	if len(event.Arguments) > 0 {
+		matrixRaw = event.Arguments[0]
+	}
+	if len(event.Arguments) > 1 {
+		mappingRaw = event.Arguments[1]
+	}
+	if len(event.Arguments) > 2 {
+		rolesRaw = event.Arguments[2]
+	}
 
-	if err != nil {
-		return client.InvokeResult{
-			Err: wamp.URI("wamp.error.internal-error"),
+	if matrixRaw == nil && mappingRaw == nil && rolesRaw == nil {
+		if err := this.update(context.Background()); err != nil {
+			util.Logger.Warningf("Failed to update feature matrix and mapping: %v", err)
+		}
+		return
+	}
+
+	var matrix FeatureMatrix
+	var mapping FeatureMapping
+	var roles RoleHierarchy
+	var err error
+	if matrixRaw != nil {
+		if matrix, err = parseFeatureMatrix(matrixRaw); err != nil {
+			util.Logger.Warningf("Invalid pushed feature matrix: %v", err)
 		}
 	}
+	if mappingRaw != nil {
+		if mapping, err = parseFeatureMapping(mappingRaw); err != nil {
+			util.Logger.Warningf("Invalid pushed feature mapping: %v", err)
+		}
+	}
+	if rolesRaw != nil {
+		if roles, err = parseRoleHierarchy(rolesRaw); err != nil {
+			util.Logger.Warningf("Invalid pushed role hierarchy: %v", err)
+		}
+	}
+	if this.RejectInvalidUpdates && (matrixRaw != nil && matrix == nil || mappingRaw != nil && mapping == nil || rolesRaw != nil && roles == nil) {
+		util.Logger.Warningf("Rejected pushed feature update")
+		return
+	}
+	if matrix != nil || mapping != nil || roles != nil {
+		this.swap(matrix, mapping, roles)
+	}
+}
 
-	err = this.UpdateMapping()
+// updateError maps errors of FetchMatrix, FetchMapping and FetchRoles to an
+// error URI.
+func updateError(err error) wamp.URI {
+	if upstreamErr, ok := err.(*util.UpstreamError); ok {
+		return upstreamErr.URI
+	}
+	return wamp.URI("wamp.error.internal-error")
+}
+
+// update fetches the matrix, the mapping and the role hierarchy from the
+// providers and swaps them at once. If one of them fails, the others are
+// applied on their own, unless RejectInvalidUpdates is set.
+func (this *FeatureAuthorizer) update(ctx context.Context) error {
+	matrix, roles, matrixErr := this.FetchMatrix(ctx)
+	mapping, mappingErr := this.FetchMapping(ctx)
+	var rolesErr error
+	if this.RolesURI != "" {
+		roles, rolesErr = this.FetchRoles(ctx)
+	}
+	fetchErr := matrixErr
+	if fetchErr == nil {
+		fetchErr = mappingErr
+	}
+	if fetchErr == nil {
+		fetchErr = rolesErr
+	}
+	if fetchErr != nil && (this.RejectInvalidUpdates || matrix == nil && mapping == nil && roles == nil) {
+		return fetchErr
+	}
+	if _, err := this.swap(matrix, mapping, roles); err != nil {
+		return err
+	}
+	return fetchErr
+}
+
+// Update fetches the matrix, the mapping and the role hierarchy again. Canceling the invocation
+// cancels the pending upstream calls.
+func (this *FeatureAuthorizer) Update(ctx context.Context, _ *wamp.Invocation) client.InvokeResult {
+	util.Logger.Infof("Updating Matrix and Mapping.")
+
+	err := this.update(ctx)
 
 	if err != nil {
 		return client.InvokeResult{
-			Err: wamp.URI("wamp.error.internal-error"),
+			Err: updateError(err),
 		}
 	}
 
 	return client.InvokeResult{}
 }
 
-func (this *FeatureAuthorizer) UpdateMapping() error {
-	ctx := context.Background()
-
+// FetchMapping calls the mapping provider and returns its mapping.
+func (this *FeatureAuthorizer) FetchMapping(ctx context.Context) (FeatureMapping, error) {
 	// callArguments is empty right now, but maybe not forever.
 	callArguments := wamp.List{}
-	callRes, callErr := util.LocalClient.Call(ctx, this.MappingURI, nil, callArguments, nil, nil)
+	callRes, callErr := callUpstream(ctx, this.MappingURI, callArguments, nil)
 
 	if callErr != nil {
-		util.Logger.Warningf("%s was not callable.", this.MappingURI)
-		util.Logger.Warningf("%v", callErr)
-		return callErr
+		warnUpstreamFailure(this.MappingURI, callErr)
+		return nil, callErr
 	}
 
 	util.Logger.Infof("Got callRes: %v", callRes)
@@ -95,15 +255,55 @@ func (this *FeatureAuthorizer) UpdateMapping() error {
 	if len(callRes.Arguments) < 1 {
 		// First Element cannot be accessed -> Segfault
 		util.Logger.Warningf("Invalid Reply from MappingURI")
-		return errors.New("Invalid Reply from MappingURI")
+		return nil, errors.New("Invalid Reply from MappingURI")
+	}
+
+	newFeatureMapping, err := parseFeatureMapping(callRes.Arguments[0])
+	if err != nil {
+		util.Logger.Warningf("Invalid Reply from MappingURI: %v", err)
+		return nil, errors.New("Invalid Reply from MappingURI")
+	}
+
+	return newFeatureMapping, nil
+}
+
+// parseMappingEntry reads an endpoint of the mapping, which is either a URI
+// or a dict containing `uri` and `match`. URIs with empty components are
+// wildcard patterns, unless a match policy is given.
+func parseMappingEntry(entry interface{}) (wamp.URI, string, error) {
+	if endpointString, ok := wamp.AsString(entry); ok {
+		endpointURI := wamp.URI(endpointString)
+		if endpointURI.ValidURI(false, wamp.MatchExact) {
+			return endpointURI, wamp.MatchExact, nil
+		}
+		return endpointURI, wamp.MatchWildcard, nil
+	}
+	dict, ok := wamp.AsDict(entry)
+	if !ok || dict == nil {
+		return "", "", errors.New("Cast with wamp.AsString was not successful")
 	}
+	endpointString, ok := wamp.AsString(dict["uri"])
+	if !ok || endpointString == "" {
+		return "", "", errors.New("Endpoint has no uri")
+	}
+	match := wamp.OptionString(dict, "match")
+	switch match {
+	case "":
+		match = wamp.MatchExact
+	case wamp.MatchExact, wamp.MatchPrefix, wamp.MatchWildcard:
+	default:
+		return "", "", errors.New("Unknown match policy " + match)
+	}
+	return wamp.URI(endpointString), match, nil
+}
 
-	util.Logger.Infof("%v", callRes.Arguments[0])
-	mappingRaw, castOkay := callRes.Arguments[0].(map[string]interface{})
+// parseFeatureMapping converts a map of features to lists of endpoint URIs
+// into a FeatureMapping.
+func parseFeatureMapping(raw interface{}) (FeatureMapping, error) {
+	mappingRaw, castOkay := wamp.AsDict(raw)
 
-	if !castOkay {
-		util.Logger.Warningf("Invalid Reply from MappingURI, Cast to map[string][]interface{} was not successful.")
-		return errors.New("Invalid Reply from MappingURI")
+	if !castOkay || mappingRaw == nil {
+		return nil, errors.New("Cast to map[string][]interface{} was not successful")
 	}
 
 	newFeatureMapping := make(FeatureMapping)
@@ -113,42 +313,36 @@ func (this *FeatureAuthorizer) UpdateMapping() error {
 
 		endpointURIs, castOkay := wamp.AsList(endpointURIs)
 		if !castOkay {
-			util.Logger.Warningf("Invalid Reply from MappingURI, Cast with wamp.AsList was not successful.")
-			return errors.New("Invalid Reply from MappingURI")
+			return nil, errors.New("Cast with wamp.AsList was not successful")
 		}
 
 		for _, endpointInterface := range endpointURIs {
 
-			endpointString, castOkay := wamp.AsString(endpointInterface)
+			endpointURI, match, err := parseMappingEntry(endpointInterface)
 
-			if !castOkay {
-				util.Logger.Warningf("Invalid Reply from MappingURI, Cast with wamp.AsString was not successful.")
-				return errors.New("Invalid Reply from MappingURI")
+			if err != nil {
+				return nil, err
 			}
 
-			endpointURI := wamp.URI(endpointString)
-			newFeatureMapping[endpointURI] = featureItemURI
+			newFeatureMapping.add(match, endpointURI, featureItemURI)
 		}
 	}
 
-	this.FeatureMapping = &newFeatureMapping
-	util.Logger.Infof("Assigned new Feature Mapping: %v", this.FeatureMapping)
-
-	return nil
+	return newFeatureMapping, nil
 }
 
-func (this *FeatureAuthorizer) UpdateMatrix() error {
-
-	ctx := context.Background()
+// FetchMatrix calls the matrix provider and returns its matrix. The role
+// hierarchy may be returned as second argument or as keyword argument `roles`,
+// it is empty if the reply does not contain one.
+func (this *FeatureAuthorizer) FetchMatrix(ctx context.Context) (FeatureMatrix, RoleHierarchy, error) {
 
 	// callArguments is empty right now, but maybe not forever.
 	callArguments := wamp.List{}
-	callRes, callErr := util.LocalClient.Call(ctx, this.MatrixURI, nil, callArguments, nil, nil)
+	callRes, callErr := callUpstream(ctx, this.MatrixURI, callArguments, nil)
 
 	if callErr != nil {
-		util.Logger.Warningf("%s was not callable.", this.MatrixURI)
-		util.Logger.Warningf("%v", callErr)
-		return callErr
+		warnUpstreamFailure(this.MatrixURI, callErr)
+		return nil, nil, callErr
 	}
 
 	util.Logger.Infof("Got callRes: %v", callRes)
@@ -156,128 +350,215 @@ func (this *FeatureAuthorizer) UpdateMatrix() error {
 	if len(callRes.Arguments) < 1 {
 		// First Element cannot be accessed -> Segfault
 		util.Logger.Warningf("Invalid Reply from MatrixURI")
-		return errors.New("Invalid Reply from MatrixURI")
+		return nil, nil, errors.New("Invalid Reply from MatrixURI")
+	}
+
+	newFeatureMatrix, err := parseFeatureMatrix(callRes.Arguments[0])
+	if err != nil {
+		util.Logger.Warningf("Invalid Reply from MatrixURI: %v", err)
+		return nil, nil, errors.New("Invalid Reply from MatrixURI")
+	}
+
+	rolesRaw := callRes.ArgumentsKw["roles"]
+	if len(callRes.Arguments) > 1 {
+		rolesRaw = callRes.Arguments[1]
+	}
+	if rolesRaw == nil {
+		return newFeatureMatrix, RoleHierarchy{}, nil
+	}
+	roles, err := parseRoleHierarchy(rolesRaw)
+	if err != nil {
+		util.Logger.Warningf("Invalid role hierarchy from MatrixURI: %v", err)
+		return newFeatureMatrix, nil, errors.New("Invalid Reply from MatrixURI")
+	}
+
+	return newFeatureMatrix, roles, nil
+}
+
+// FetchRoles calls the role hierarchy provider and returns its hierarchy.
+func (this *FeatureAuthorizer) FetchRoles(ctx context.Context) (RoleHierarchy, error) {
+	callRes, callErr := callUpstream(ctx, this.RolesURI, wamp.List{}, nil)
+
+	if callErr != nil {
+		warnUpstreamFailure(this.RolesURI, callErr)
+		return nil, callErr
+	}
+
+	if len(callRes.Arguments) < 1 {
+		util.Logger.Warningf("Invalid Reply from RolesURI")
+		return nil, errors.New("Invalid Reply from RolesURI")
+	}
+
+	roles, err := parseRoleHierarchy(callRes.Arguments[0])
+	if err != nil {
+		util.Logger.Warningf("Invalid Reply from RolesURI: %v", err)
+		return nil, errors.New("Invalid Reply from RolesURI")
 	}
 
-	featureMatrixRaw, ok := callRes.Arguments[0].(map[string]interface{})
+	return roles, nil
+}
+
+// parseFeatureMatrix converts a map of features to authrole permissions into
+// a FeatureMatrix, see parseRoleGrant for the permissions.
+func parseFeatureMatrix(raw interface{}) (FeatureMatrix, error) {
+	featureMatrixRaw, ok := wamp.AsDict(raw)
 	newFeatureMatrix := make(FeatureMatrix)
 
-	if !ok {
-		util.Logger.Warningf("Invalid Reply from MatrixURI")
-		return errors.New("Invalid Reply from MatrixURI")
+	if !ok || featureMatrixRaw == nil {
+		return nil, errors.New("Feature matrix is not a dictionary")
 	}
 
 	for featureItem, authRoleList := range featureMatrixRaw {
 
 		featureItemUri := wamp.URI(featureItem)
 
-		newFeatureMatrix[featureItemUri] = make(map[string]bool)
+		newFeatureMatrix[featureItemUri] = make(map[string]RoleGrant)
 
 		authRoleList, ok := wamp.AsDict(authRoleList)
 
 		if !ok {
-			util.Logger.Warningf("Invalid Reply from MatrixURI")
-			return errors.New("Invalid Reply from MatrixURI")
+			return nil, errors.New("Permissions of a feature are not a dictionary")
 		}
 
-		for authRole, isAllowed := range authRoleList {
-			isAllowed, castOkay := isAllowed.(bool)
+		for authRole, permissionsRaw := range authRoleList {
+			grant, err := parseRoleGrant(permissionsRaw)
 
-			if !castOkay {
-				isAllowed = false
+			if err != nil {
+				return nil, fmt.Errorf("Permissions of %s for %s: %v", authRole, featureItem, err)
 			}
 
-			newFeatureMatrix[featureItemUri][authRole] = isAllowed
+			newFeatureMatrix[featureItemUri][authRole] = grant
 		}
 
 	}
 
-	// Assign newFeatureMatrix to existing matrix
-	this.FeatureMatrix = &newFeatureMatrix
-	util.Logger.Infof("Assigned new featureMatrix: %v", this.FeatureMatrix)
-
-	return nil
+	return newFeatureMatrix, nil
 }
 
+// Authorize permits or denies msg, if the feature matrix has no opinion about
+// it, PermitDefault is used.
 func (this *FeatureAuthorizer) Authorize(sess *wamp.Session, msg wamp.Message) (bool, error) {
+	decision, err := this.Decide(sess, msg)
+	return decision.Permitted(this.PermitDefault), err
+}
+
+// Decide abstains if the endpoint is not mapped to a feature or none of the
+// authroles of the session is mentioned for the feature.
+func (this *FeatureAuthorizer) Decide(sess *wamp.Session, msg wamp.Message) (multiauthorizer.Decision, error) {
+	return this.decide(sess, msg, nil), nil
+}
+
+// Explain returns the decision, the matched mapping entry and the authrole the
+// permission was taken from.
+func (this *FeatureAuthorizer) Explain(sess *wamp.Session, msg wamp.Message) multiauthorizer.Explanation {
+	details := wamp.Dict{}
+	decision := this.decide(sess, msg, details)
+	return multiauthorizer.Explanation{
+		Decision:  decision,
+		Permitted: decision.Permitted(this.PermitDefault),
+		Details:   details,
+	}
+}
+
+// decide makes the decision, the reasons are added to details if it is not
+// nil.
+func (this *FeatureAuthorizer) decide(sess *wamp.Session, msg wamp.Message, details wamp.Dict) multiauthorizer.Decision {
 
-	util.Logger.Debugf("Pointer Address from FeatureAuthorizer: %p", &this)
-	this.CallCounter++
-	util.Logger.Debugf("Call Counter from FeatureAuthorizer: %v", this.CallCounter)
+	util.Logger.Debugf("Pointer Address from FeatureAuthorizer: %p", this)
+	callCounter := atomic.AddUint64(&this.CallCounter, 1)
+	util.Logger.Debugf("Call Counter from FeatureAuthorizer: %v", callCounter)
 
 	roles, err := extractAuthRoles(sess.Details["authrole"])
 
 	util.Logger.Debugf("Request: %v Session: %v", msg, sess)
 
 	if err != nil {
-		return this.PermitDefault, nil
+		return multiauthorizer.Abstain
 	}
 
 	util.Logger.Infof("Check for trustedAuthRoles")
 	isTrustedAuthRole := roles.checkTrustedAuthRoles(this.TrustedAuthRoles)
+	if details != nil {
+		details["trusted"] = isTrustedAuthRole
+	}
 
 	if isTrustedAuthRole {
 		util.Logger.Infof("Call was from trusted auth role. Access granted.")
-		return true, nil
+		return multiauthorizer.Permit
 	}
 
-	if this.FeatureMatrix == nil || this.FeatureMapping == nil {
+	// Matrix and mapping are read from the same snapshot, so an update in
+	// between can not mix an old mapping with a new matrix.
+	snap := this.currentSnapshot()
+	if !snap.loaded() {
 		util.Logger.Warningf("FeatureMatrix or FeatureMapping is not defined.")
-		util.Logger.Warningf("FeatureMapping: %v", this.FeatureMapping)
-		util.Logger.Warningf("FeatureMatrix: %v", this.FeatureMatrix)
-		return this.PermitDefault, nil
+		return multiauthorizer.Abstain
+	}
+	if details != nil {
+		details["version"] = snap.Version
 	}
 
 	// Transform endpointURI to featureItem
 
-	var messageURI wamp.URI
-
-	switch msg.MessageType() {
-	case wamp.CALL:
-		messageURI = msg.(*wamp.Call).Procedure
-	case wamp.REGISTER:
-		messageURI = msg.(*wamp.Register).Procedure
-	case wamp.SUBSCRIBE:
-		messageURI = msg.(*wamp.Subscribe).Topic
-	case wamp.PUBLISH:
-		messageURI = msg.(*wamp.Publish).Topic
-	default:
+	messageURI, action := resolveMessageAction(sess, msg)
+	if action == "" {
 		// I am pretty sure, I changed this earlier to true.
-		// It is important to allow every other call than
-		// CALL, REGISTER, SUBSCRIBE and PUBLISH to allow nexus to function correctly.
-		return true, nil
+		// It is important to allow every other message than the authorized
+		// actions to allow nexus to function correctly.
+		return multiauthorizer.Permit
 	}
 
-	featureMapping := *this.FeatureMapping
-	featureURI, isOkay := featureMapping[messageURI]
+	featureURI, pattern, match, isOkay := snap.matcher.Lookup(messageURI)
+	util.Logger.Debugf("messsageURI: %v, featureURI: %v, isMatching: %v", messageURI, featureURI, isOkay)
 
 	if !isOkay {
-
-		for potentialMessageURI, tFeatureURI := range featureMapping {
-			isMatchingWildcard := messageURI.WildcardMatch(potentialMessageURI)
-			util.Logger.Debugf("messsageURI: %v, potentialMessageURI: %v, isMatchingWildcard: %v", messageURI, potentialMessageURI, isMatchingWildcard)
-
-			if isMatchingWildcard {
-				featureURI = tFeatureURI
-				isOkay = true
-				break
-			}
+		return multiauthorizer.Abstain
+	}
+	if details != nil {
+		details["feature"] = featureURI
+		details["mapping"] = wamp.Dict{
+			"uri":   pattern,
+			"match": match,
 		}
 	}
 
-	if !isOkay {
-		return this.PermitDefault, nil
+	// Scheduled grants are evaluated at the time of the authorization.
+	now := time.Now()
+	if details != nil {
+		details["time"] = now.UTC().Format(time.RFC3339)
 	}
 
-	featureMatrix := *this.FeatureMatrix
-
+	// An explicit deny of any authrole wins over the allows of the others.
+	isAllowed := false
+	var allowedBy wamp.List
 	for _, authRole := range *roles {
-		hasPermission := featureMatrix[featureURI][authRole]
+		switch permission, from := snap.Matrix.permission(featureURI, authRole, action, snap.Roles, now); permission {
+		case PermissionDeny:
+			util.Logger.Debugf("%v on %v denied for authrole %v", action, messageURI, authRole)
+			if details != nil {
+				details["denied_by"] = wamp.Dict{
+					"authrole": authRole,
+					"from":     from,
+				}
+			}
+			return multiauthorizer.Deny
+		case PermissionAllow:
+			isAllowed = true
+			if details != nil {
+				allowedBy = append(allowedBy, wamp.Dict{
+					"authrole": authRole,
+					"from":     from,
+				})
+			}
+		}
+	}
 
-		if hasPermission {
-			return true, nil
+	if isAllowed {
+		if details != nil {
+			details["allowed_by"] = allowedBy
 		}
+		return multiauthorizer.Permit
 	}
 
-	return this.PermitDefault, nil
+	return multiauthorizer.Abstain
 }
@@ -0,0 +1,255 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/EmbeddedEnterprises/autobahnkreuz/auth/multiauthorizer"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// Permission is the permission of an authrole for an action on a feature.
+type Permission int8
+
+const (
+	// PermissionNone means the authrole is not mentioned, the decision is left
+	// to the other authroles of the session.
+	PermissionNone Permission = iota
+	// PermissionAllow grants access, unless another authrole denies it.
+	PermissionAllow
+	// PermissionDeny rejects access, even if another authrole allows it.
+	PermissionDeny
+)
+
+// featureActionAll is the action key applying to all actions without an own
+// entry, except the meta API.
+const featureActionAll = "*"
+
+// featureActionMeta is the action of calls to meta procedures and
+// subscriptions to meta events, it is only permitted explicitly.
+const featureActionMeta = multiauthorizer.ActionMeta
+
+var featureActions = map[string]bool{
+	featureActionAll:  true,
+	"call":            true,
+	"register":        true,
+	"subscribe":       true,
+	"publish":         true,
+	"unsubscribe":     true,
+	"unregister":      true,
+	"cancel":          true,
+	featureActionMeta: true,
+}
+
+// RolePermissions maps actions (call, register, subscribe, publish,
+// unsubscribe, unregister, cancel, meta or * for all of them but meta) to the
+// permission of an authrole.
+type RolePermissions map[string]Permission
+
+// get returns the permission for action, falling back to the entry for all
+// actions.
+func (p RolePermissions) get(action string) Permission {
+	if permission := p[action]; permission != PermissionNone || action == featureActionMeta {
+		return permission
+	}
+	return p[featureActionAll]
+}
+
+// RoleGrant is the grant of an authrole on a feature, it only applies while
+// its Schedule is active.
+type RoleGrant struct {
+	Permissions RolePermissions
+	// Schedule is nil for grants which always apply.
+	Schedule *Schedule
+}
+
+// get returns the permission for action at now, it is PermissionNone outside
+// of the schedule.
+func (g RoleGrant) get(action string, now time.Time) Permission {
+	if g.Schedule != nil && !g.Schedule.Active(now) {
+		return PermissionNone
+	}
+	return g.Permissions.get(action)
+}
+
+// MarshalJSON encodes grants without schedule like their permissions, so the
+// hash of a matrix without schedules does not change.
+func (g RoleGrant) MarshalJSON() ([]byte, error) {
+	if g.Schedule == nil {
+		return json.Marshal(g.Permissions)
+	}
+	return json.Marshal(struct {
+		Permissions RolePermissions `json:"permissions"`
+		Schedule    interface{}     `json:"schedule"`
+	}{g.Permissions, g.Schedule.source})
+}
+
+// RoleHierarchy maps authroles to the authroles they inherit the permissions
+// of, e.g. admin inherits operator.
+type RoleHierarchy map[string][]string
+
+// parsePermission reads a single permission. true allows and false leaves the
+// decision to other authroles, like it always did, "allow" and "deny" are
+// explicit.
+func parsePermission(raw interface{}) (Permission, error) {
+	if allowed, ok := raw.(bool); ok {
+		if allowed {
+			return PermissionAllow, nil
+		}
+		return PermissionNone, nil
+	}
+	value, _ := wamp.AsString(raw)
+	switch value {
+	case "allow":
+		return PermissionAllow, nil
+	case "deny":
+		return PermissionDeny, nil
+	}
+	return PermissionNone, fmt.Errorf("Invalid permission %v", raw)
+}
+
+// parseRolePermissions reads the permissions of an authrole, which are either
+// a single permission for all actions or a dict of actions to permissions.
+func parseRolePermissions(raw interface{}) (RolePermissions, error) {
+	actionsRaw, ok := wamp.AsDict(raw)
+	if !ok {
+		permission, err := parsePermission(raw)
+		if err != nil {
+			return nil, err
+		}
+		return RolePermissions{featureActionAll: permission}, nil
+	}
+
+	permissions := make(RolePermissions)
+	for action, permissionRaw := range actionsRaw {
+		if !featureActions[action] {
+			return nil, errors.New("Unknown action " + action)
+		}
+		permission, err := parsePermission(permissionRaw)
+		if err != nil {
+			return nil, err
+		}
+		permissions[action] = permission
+	}
+	return permissions, nil
+}
+
+// parseRoleGrant reads the grant of an authrole, which are its permissions,
+// see parseRolePermissions. Per-action permissions can be restricted to a
+// schedule with the key `schedule`, see ParseSchedule.
+func parseRoleGrant(raw interface{}) (RoleGrant, error) {
+	actionsRaw, ok := wamp.AsDict(raw)
+	scheduleRaw, scheduled := actionsRaw["schedule"]
+	if !ok || !scheduled {
+		permissions, err := parseRolePermissions(raw)
+		return RoleGrant{Permissions: permissions}, err
+	}
+
+	schedule, err := ParseSchedule(scheduleRaw)
+	if err != nil {
+		return RoleGrant{}, err
+	}
+	withoutSchedule := make(wamp.Dict, len(actionsRaw)-1)
+	for action, permissionRaw := range actionsRaw {
+		if action != "schedule" {
+			withoutSchedule[action] = permissionRaw
+		}
+	}
+	permissions, err := parseRolePermissions(withoutSchedule)
+	return RoleGrant{Permissions: permissions, Schedule: schedule}, err
+}
+
+// parseRoleHierarchy converts a map of authroles to lists of inherited
+// authroles into a RoleHierarchy. Cyclic hierarchies are rejected.
+func parseRoleHierarchy(raw interface{}) (RoleHierarchy, error) {
+	hierarchyRaw, ok := wamp.AsDict(raw)
+	if !ok || hierarchyRaw == nil {
+		return nil, errors.New("Role hierarchy is not a dictionary")
+	}
+
+	hierarchy := make(RoleHierarchy)
+	for role, inheritedRaw := range hierarchyRaw {
+		inheritedList, ok := wamp.AsList(inheritedRaw)
+		if !ok {
+			return nil, errors.New("Inherited roles of " + role + " are not a list")
+		}
+		for _, inheritedRole := range inheritedList {
+			inherited, ok := wamp.AsString(inheritedRole)
+			if !ok || inherited == "" {
+				return nil, errors.New("Inherited roles of " + role + " are not strings")
+			}
+			hierarchy[role] = append(hierarchy[role], inherited)
+		}
+	}
+
+	if err := hierarchy.checkCycles(); err != nil {
+		return nil, err
+	}
+	return hierarchy, nil
+}
+
+// checkCycles returns an error if an authrole inherits itself.
+func (h RoleHierarchy) checkCycles() error {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+	var visit func(role string) error
+	visit = func(role string) error {
+		switch state[role] {
+		case visiting:
+			return errors.New("Role hierarchy contains a cycle at " + role)
+		case done:
+			return nil
+		}
+		state[role] = visiting
+		for _, inherited := range h[role] {
+			if err := visit(inherited); err != nil {
+				return err
+			}
+		}
+		state[role] = done
+		return nil
+	}
+	for role := range h {
+		if err := visit(role); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve returns the permission of role and the authrole it was taken from,
+// given the permissions each authrole has on its own. An own permission wins
+// over the inherited ones, among the inherited roles a deny wins over an
+// allow. The hierarchy has to be free of cycles.
+func (h RoleHierarchy) resolve(role string, own func(role string) Permission) (Permission, string) {
+	if permission := own(role); permission != PermissionNone {
+		return permission, role
+	}
+	result, resultRole := PermissionNone, ""
+	for _, inherited := range h[role] {
+		switch permission, from := h.resolve(inherited, own); permission {
+		case PermissionDeny:
+			return PermissionDeny, from
+		case PermissionAllow:
+			if result == PermissionNone {
+				result, resultRole = PermissionAllow, from
+			}
+		}
+	}
+	return result, resultRole
+}
+
+// permission resolves the permission of role for action on feature at now and
+// returns the authrole it was taken from.
+func (m FeatureMatrix) permission(feature wamp.URI, role string, action string, hierarchy RoleHierarchy, now time.Time) (Permission, string) {
+	return hierarchy.resolve(role, func(role string) Permission {
+		return m[feature][role].get(action, now)
+	})
+}
@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
+
+	"github.com/gammazero/nexus/v3/client"
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// featureSnapshot is an immutable set of matrix, mapping and role hierarchy,
+// it is never modified after it was stored in the FeatureAuthorizer.
+type featureSnapshot struct {
+	Matrix  FeatureMatrix
+	Mapping FeatureMapping
+	Roles   RoleHierarchy
+	Version uint64
+	Hash    string
+	Updated time.Time
+	// matcher is compiled from Mapping.
+	matcher *uriMatcher
+}
+
+// loaded reports whether both matrix and mapping are available.
+func (s *featureSnapshot) loaded() bool {
+	return s != nil && s.Matrix != nil && s.Mapping != nil
+}
+
+// hashFeatures returns a hash of matrix, mapping and role hierarchy, which is
+// equal on all routers using the same values.
+func hashFeatures(matrix FeatureMatrix, mapping FeatureMapping, roles RoleHierarchy) string {
+	// Map keys are sorted by json.Marshal, so the encoding is stable.
+	content, err := json.Marshal(struct {
+		Matrix  FeatureMatrix  `json:"matrix"`
+		Mapping FeatureMapping `json:"mapping"`
+		Roles   RoleHierarchy  `json:"roles"`
+	}{matrix, mapping, roles})
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// validateFeatures checks that every feature used in the mapping is part of
+// the matrix.
+func validateFeatures(matrix FeatureMatrix, mapping FeatureMapping) error {
+	if matrix == nil || mapping == nil {
+		return nil
+	}
+	for _, patterns := range mapping {
+		for endpointURI, featureURI := range patterns {
+			if _, ok := matrix[featureURI]; !ok {
+				return fmt.Errorf("Feature %s of %s is not part of the feature matrix", featureURI, endpointURI)
+			}
+		}
+	}
+	return nil
+}
+
+// currentSnapshot returns the snapshot used for authorization, it is nil until
+// the first update.
+func (this *FeatureAuthorizer) currentSnapshot() *featureSnapshot {
+	snap, _ := this.snapshot.Load().(*featureSnapshot)
+	return snap
+}
+
+// swap replaces the current snapshot. A nil matrix, mapping or role hierarchy
+// is taken from the current snapshot, so each can be updated independently.
+func (this *FeatureAuthorizer) swap(matrix FeatureMatrix, mapping FeatureMapping, roles RoleHierarchy) (*featureSnapshot, error) {
+	this.updateMu.Lock()
+	defer this.updateMu.Unlock()
+
+	if current := this.currentSnapshot(); current != nil {
+		if matrix == nil {
+			matrix = current.Matrix
+		}
+		if mapping == nil {
+			mapping = current.Mapping
+		}
+		if roles == nil {
+			roles = current.Roles
+		}
+	}
+	if err := validateFeatures(matrix, mapping); err != nil {
+		if this.RejectInvalidUpdates {
+			util.Logger.Warningf("Rejected feature update: %v", err)
+			return nil, err
+		}
+		util.Logger.Warningf("Applying inconsistent feature update: %v", err)
+	}
+
+	this.version++
+	snap := &featureSnapshot{
+		Matrix:  matrix,
+		Mapping: mapping,
+		Roles:   roles,
+		Version: this.version,
+		Hash:    hashFeatures(matrix, mapping, roles),
+		Updated: time.Now(),
+		matcher: newURIMatcher(mapping),
+	}
+	this.snapshot.Store(snap)
+	util.Logger.Infof("Assigned feature matrix and mapping version %d (%s)", snap.Version, snap.Hash)
+	return snap, nil
+}
+
+// Status returns version and hash of the current snapshot, as well as the
+// number of authorized messages.
+func (this *FeatureAuthorizer) Status(_ context.Context, _ *wamp.Invocation) client.InvokeResult {
+	status := wamp.Dict{
+		"loaded": false,
+		"calls":  atomic.LoadUint64(&this.CallCounter),
+	}
+	if snap := this.currentSnapshot(); snap != nil {
+		status["loaded"] = snap.loaded()
+		status["version"] = snap.Version
+		status["hash"] = snap.Hash
+		status["updated"] = snap.Updated.UTC().Format(time.RFC3339)
+		status["features"] = len(snap.Matrix)
+		status["endpoints"] = snap.Mapping.Len()
+		status["roles"] = len(snap.Roles)
+	}
+	return client.InvokeResult{
+		Args: wamp.List{
+			status,
+		},
+	}
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"github.com/EmbeddedEnterprises/autobahnkreuz/auth/multiauthorizer"
+
+	mapset "github.com/deckarep/golang-set"
+
+	nexus "github.com/gammazero/nexus/v3/router"
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// Policies for the meta API.
+const (
+	// MetaAPITrusted permits the meta API only to trusted authroles.
+	MetaAPITrusted = "trusted"
+	// MetaAPIAuthorize lets the authorizers decide about the action meta.
+	MetaAPIAuthorize = "authorize"
+	// MetaAPIPermit permits the meta API to all sessions.
+	MetaAPIPermit = "permit"
+)
+
+// MessageGuard is the authorizer of the realm. It decides about the message
+// classes the authorizers do not handle by default and passes everything
+// else to Authorizer.
+type MessageGuard struct {
+	// Authorizer authorizes the actions, all actions are permitted if it is
+	// nil.
+	Authorizer       nexus.Authorizer
+	TrustedAuthRoles mapset.Set
+	// MetaAPIPolicy decides about calls to meta procedures and subscriptions
+	// to meta events.
+	MetaAPIPolicy string
+	// AuthorizeWithdrawals passes UNSUBSCRIBE, UNREGISTER and CANCEL to
+	// Authorizer, otherwise they are always permitted. It requires
+	// TrackEndpoints.
+	AuthorizeWithdrawals bool
+}
+
+// Authorize implements nexus.Authorizer. If withdrawals are authorized, the
+// procedures of permitted calls are remembered, so the authorizers know the
+// procedure a CANCEL refers to.
+func (g *MessageGuard) Authorize(sess *wamp.Session, msg wamp.Message) (bool, error) {
+	permitted, decided := g.decide(sess, msg)
+	var err error
+	if !decided {
+		permitted, err = g.Authorizer.Authorize(sess, msg)
+	}
+	if call, ok := msg.(*wamp.Call); ok && permitted && err == nil && g.AuthorizeWithdrawals {
+		endpoints.addCall(sess.ID, call.Request, call.Procedure)
+	}
+	return permitted, err
+}
+
+// decide reports whether the guard decides about msg itself, instead of
+// asking Authorizer.
+func (g *MessageGuard) decide(sess *wamp.Session, msg wamp.Message) (bool, bool) {
+	_, action := multiauthorizer.MessageAction(msg)
+	switch action {
+	case featureActionMeta:
+		switch g.MetaAPIPolicy {
+		case MetaAPIPermit:
+			return true, true
+		case MetaAPIAuthorize:
+			if g.Authorizer == nil {
+				return g.trusted(sess), true
+			}
+		default:
+			return g.trusted(sess), true
+		}
+	case "unsubscribe", "unregister", "cancel":
+		if !g.AuthorizeWithdrawals {
+			return true, true
+		}
+	}
+	if g.Authorizer == nil {
+		return true, true
+	}
+	return false, false
+}
+
+// trusted reports whether sess has a trusted authrole.
+func (g *MessageGuard) trusted(sess *wamp.Session) bool {
+	roles, err := extractAuthRoles(sess.Details["authrole"])
+	return err == nil && roles.checkTrustedAuthRoles(g.TrustedAuthRoles)
+}
@@ -0,0 +1,455 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
+	mapset "github.com/deckarep/golang-set"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// JWTConfig contains the settings used to validate tokens and to map their
+// claims to the session details.
+type JWTConfig struct {
+	JWKSFile         string
+	PEMKeyFiles      []string
+	Issuer           string
+	Audience         string
+	AuthIDClaim      string
+	AuthRolesClaim   string
+	AuthExtraClaims  []string
+	Leeway           time.Duration
+	UpstreamRoleFunc string
+}
+
+// JWTAuth is an authenticator which validates JSON Web Tokens issued by an
+// identity provider against keys loaded at startup.
+// The token is transmitted as response to the challenge, like a ticket.
+type JWTAuth struct {
+	SharedSecretAuthenticator
+	Config JWTConfig
+	// Map from key id -> key.
+	Keys map[string]interface{}
+	// UnnamedKeys are the keys without id, in the order they were loaded.
+	UnnamedKeys []interface{}
+}
+
+// NewJWTAuth creates a new JWTAuth object and loads the configured keys.
+func NewJWTAuth(config JWTConfig, realm string, invalid mapset.Set) (*JWTAuth, error) {
+	if config.AuthIDClaim == "" {
+		config.AuthIDClaim = "sub"
+	}
+	if config.AuthRolesClaim == "" && config.UpstreamRoleFunc == "" {
+		return nil, errors.New("Either an authroles claim or a role function is required")
+	}
+	x := &JWTAuth{
+		SharedSecretAuthenticator: SharedSecretAuthenticator{
+			AuthMethodValue:          "jwt",
+			InvalidAuthRoles:         invalid,
+			Realm:                    realm,
+			UpstreamGetAuthRolesFunc: config.UpstreamRoleFunc,
+		},
+		Config: config,
+		Keys:   make(map[string]interface{}),
+	}
+	if config.JWKSFile != "" {
+		if err := x.loadJWKS(config.JWKSFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, file := range config.PEMKeyFiles {
+		if err := x.loadPEM(file); err != nil {
+			return nil, err
+		}
+	}
+	if len(x.Keys) == 0 && len(x.UnnamedKeys) == 0 {
+		return nil, errors.New("No keys for JWT validation configured")
+	}
+	return x, nil
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+func decodeSegment(seg string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(seg, "="))
+}
+
+func (j jwk) publicKey() (interface{}, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeSegment(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeSegment(j.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if j.Crv != "P-256" {
+			return nil, fmt.Errorf("Unsupported curve %s", j.Crv)
+		}
+		x, err := decodeSegment(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeSegment(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		// Points off the curve enable invalid curve attacks.
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC key is not a point on P-256")
+		}
+		return key, nil
+	case "OKP":
+		if j.Crv != "Ed25519" {
+			return nil, fmt.Errorf("Unsupported curve %s", j.Crv)
+		}
+		x, err := decodeSegment(j.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("Invalid Ed25519 key length")
+		}
+		return ed25519.PublicKey(x), nil
+	case "oct":
+		return decodeSegment(j.K)
+	}
+	return nil, fmt.Errorf("Unsupported key type %s", j.Kty)
+}
+
+func (a *JWTAuth) loadJWKS(file string) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(content, &set); err != nil {
+		return fmt.Errorf("Failed to parse JWKS file %s: %v", file, err)
+	}
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return fmt.Errorf("Failed to load key %s from %s: %v", k.Kid, file, err)
+		}
+		if err := a.addKey(k.Kid, key); err != nil {
+			return fmt.Errorf("Failed to load key %s from %s: %v", k.Kid, file, err)
+		}
+	}
+	return nil
+}
+
+// addKey stores key by its id, keys without id are appended to UnnamedKeys.
+func (a *JWTAuth) addKey(kid string, key interface{}) error {
+	if kid == "" {
+		a.UnnamedKeys = append(a.UnnamedKeys, key)
+		return nil
+	}
+	if _, ok := a.Keys[kid]; ok {
+		return fmt.Errorf("Duplicate key id %s", kid)
+	}
+	a.Keys[kid] = key
+	return nil
+}
+
+// loadPEM loads a PEM encoded public key. The file name may be prefixed by
+// a key id, separated by a semicolon (kid;/path/to/key.pem).
+func (a *JWTAuth) loadPEM(spec string) error {
+	kid, file := "", spec
+	if parts := strings.SplitN(spec, ";", 2); len(parts) == 2 {
+		kid, file = parts[0], parts[1]
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return fmt.Errorf("Failed to parse PEM data of %s", file)
+	}
+	var key interface{}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		key = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to parse key %s: %v", file, err)
+	}
+	if err := a.addKey(kid, key); err != nil {
+		return fmt.Errorf("Failed to load key %s: %v", file, err)
+	}
+	return nil
+}
+
+// verifySignature checks the signature of the signing input using the given
+// algorithm. The key type has to match the algorithm.
+func verifyJWTSignature(alg string, key interface{}, input, signature []byte) error {
+	digest := sha256.Sum256(input)
+	switch alg {
+	case "RS256":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("Key type does not match algorithm")
+		}
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature)
+	case "ES256":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("Key type does not match algorithm")
+		}
+		if len(signature) != 64 {
+			return errors.New("Invalid signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return errors.New("Invalid signature")
+		}
+		return nil
+	case "EdDSA":
+		k, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return errors.New("Key type does not match algorithm")
+		}
+		if !ed25519.Verify(k, input, signature) {
+			return errors.New("Invalid signature")
+		}
+		return nil
+	case "HS256":
+		k, ok := key.([]byte)
+		if !ok {
+			return errors.New("Key type does not match algorithm")
+		}
+		mac := hmac.New(sha256.New, k)
+		mac.Write(input)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("Invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("Unsupported algorithm %s", alg)
+}
+
+// claimTime returns the numeric date stored in claim, if present.
+func claimTime(claims map[string]interface{}, claim string) (time.Time, bool) {
+	value, ok := wamp.AsFloat64(claims[claim])
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(value), 0), true
+}
+
+// allKeys returns the keys without id followed by those with id.
+func (a *JWTAuth) allKeys() []interface{} {
+	keys := make([]interface{}, 0, len(a.UnnamedKeys)+len(a.Keys))
+	keys = append(keys, a.UnnamedKeys...)
+	for _, key := range a.Keys {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Validate checks the signature and the registered claims of the given token
+// and returns its claims.
+func (a *JWTAuth) Validate(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Malformed token")
+	}
+	headerRaw, err := decodeSegment(parts[0])
+	if err != nil {
+		return nil, errors.New("Malformed token header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerRaw, &header); err != nil {
+		return nil, errors.New("Malformed token header")
+	}
+	signature, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, errors.New("Malformed token signature")
+	}
+
+	input := []byte(parts[0] + "." + parts[1])
+	if header.Kid == "" {
+		// Tokens without key id are checked against all keys.
+		err = errors.New("No matching key")
+		for _, key := range a.allKeys() {
+			if verifyJWTSignature(header.Alg, key, input, signature) == nil {
+				err = nil
+				break
+			}
+		}
+	} else if key, ok := a.Keys[header.Kid]; ok {
+		err = verifyJWTSignature(header.Alg, key, input, signature)
+	} else {
+		err = fmt.Errorf("Unknown key id %s", header.Kid)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := decodeSegment(parts[1])
+	if err != nil {
+		return nil, errors.New("Malformed token payload")
+	}
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.New("Malformed token payload")
+	}
+
+	now := time.Now()
+	exp, ok := claimTime(claims, "exp")
+	if !ok || now.After(exp.Add(a.Config.Leeway)) {
+		return nil, errors.New("Token expired")
+	}
+	if nbf, ok := claimTime(claims, "nbf"); ok && now.Add(a.Config.Leeway).Before(nbf) {
+		return nil, errors.New("Token not yet valid")
+	}
+	if a.Config.Issuer != "" && wamp.OptionString(claims, "iss") != a.Config.Issuer {
+		return nil, errors.New("Invalid issuer")
+	}
+	if a.Config.Audience != "" {
+		found := false
+		if aud, ok := wamp.AsString(claims["aud"]); ok {
+			found = aud == a.Config.Audience
+		} else if auds, ok := wamp.AsList(claims["aud"]); ok {
+			for _, x := range auds {
+				if aud, ok := wamp.AsString(x); ok && aud == a.Config.Audience {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return nil, errors.New("Invalid audience")
+		}
+	}
+	return claims, nil
+}
+
+// Authenticate requests the token from the client and validates it.
+func (a *JWTAuth) Authenticate(sid wamp.ID, details wamp.Dict, client wamp.Peer) (*wamp.Welcome, error) {
+	// Challenge Extra map is empty since the jwt challenge only asks for a
+	// token (using authmethod) and provides no additional challenge info.
+	err := client.Send(&wamp.Challenge{
+		AuthMethod: a.AuthMethod(),
+		Extra:      wamp.Dict{},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Read AUTHENTICATE response from client.
+	// A timeout of 5 seconds should be enough for slow clients...
+	msg, err := wamp.RecvTimeout(client, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	authRsp, ok := msg.(*wamp.Authenticate)
+	if !ok {
+		util.Logger.Warningf("Protocol violation from %v: %v", client, msg.MessageType())
+		return nil, errors.New(string(wamp.ErrProtocolViolation))
+	}
+
+	claims, err := a.Validate(authRsp.Signature)
+	if err != nil {
+		util.Logger.Infof("JWT validation failed: %v", err)
+		return nil, errors.New("wamp.error.invalid-token")
+	}
+
+	authid, ok := wamp.AsString(claims[a.Config.AuthIDClaim])
+	if !ok || authid == "" {
+		util.Logger.Infof("JWT has no %s claim", a.Config.AuthIDClaim)
+		return nil, errors.New("wamp.error.invalid-token")
+	}
+	requested := wamp.OptionString(details, "authid")
+	if requested != "" && requested != authid {
+		return nil, errors.New("wamp.error.wrong-auth-id")
+	}
+
+	var welcome *wamp.Welcome
+	if a.Config.AuthRolesClaim != "" {
+		rawRoles := claims[a.Config.AuthRolesClaim]
+		roles, ok := wamp.AsList(rawRoles)
+		if role, isStr := wamp.AsString(rawRoles); isStr {
+			roles, ok = wamp.List{role}, true
+		}
+		if !ok {
+			util.Logger.Infof("JWT has no %s claim", a.Config.AuthRolesClaim)
+			return nil, errors.New("wamp.error.invalid-token")
+		}
+		welcome = &wamp.Welcome{
+			Details: wamp.Dict{
+				"authid":       authid,
+				"authrole":     filterAuthRoles(roles, a.InvalidAuthRoles),
+				"authextra":    wamp.Dict{},
+				"authprovider": "static",
+				"authmethod":   a.AuthMethod(),
+			},
+		}
+	} else {
+		welcome, err = a.FetchAndFilterAuthRoles(authid)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	authextra, _ := wamp.AsDict(welcome.Details["authextra"])
+	for _, claim := range a.Config.AuthExtraClaims {
+		if value, ok := claims[claim]; ok {
+			authextra[claim] = value
+		}
+	}
+	welcome.Details["authextra"] = authextra
+	return welcome, nil
+}
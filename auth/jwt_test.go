@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type jwtTestKeys struct {
+	rsa     *rsa.PrivateKey
+	ec      *ecdsa.PrivateKey
+	ed      ed25519.PrivateKey
+	hmac    []byte
+	otherEC *ecdsa.PrivateKey
+}
+
+func newJWTTestKeys(t *testing.T) *jwtTestKeys {
+	keys := &jwtTestKeys{hmac: []byte("a shared secret of sufficient length")}
+	var err error
+	if keys.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if keys.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if keys.otherEC, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if _, keys.ed, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// signJWT creates a token signed with key using alg, the key id is omitted if
+// kid is empty.
+func signJWT(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	header := map[string]interface{}{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	headerRaw, _ := json.Marshal(header)
+	claimsRaw, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(headerRaw) + "." + base64.RawURLEncoding.EncodeToString(claimsRaw)
+	digest := sha256.Sum256([]byte(input))
+
+	var signature []byte
+	var err error
+	switch alg {
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+	case "ES256":
+		r, s, signErr := ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), digest[:])
+		err = signErr
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	case "EdDSA":
+		signature = ed25519.Sign(key.(ed25519.PrivateKey), []byte(input))
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(input))
+		signature = mac.Sum(nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTValidate(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	rsaPublic, err := x509.MarshalPKIXPublicKey(&keys.rsa.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &JWTAuth{
+		Config: JWTConfig{
+			Issuer:   "https://idp.example.com",
+			Audience: "autobahnkreuz",
+			Leeway:   30 * time.Second,
+		},
+		Keys: map[string]interface{}{
+			"rsa":  &keys.rsa.PublicKey,
+			"ec":   &keys.ec.PublicKey,
+			"ed":   keys.ed.Public(),
+			"hmac": keys.hmac,
+		},
+		UnnamedKeys: []interface{}{&keys.otherEC.PublicKey},
+	}
+
+	now := time.Now().Unix()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		result := map[string]interface{}{
+			"sub": "alice",
+			"iss": "https://idp.example.com",
+			"aud": "autobahnkreuz",
+			"exp": now + 60,
+		}
+		for key, value := range changes {
+			if value == nil {
+				delete(result, key)
+			} else {
+				result[key] = value
+			}
+		}
+		return result
+	}
+
+	cases := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"RS256", signJWT(t, "RS256", "rsa", keys.rsa, claims(nil)), true},
+		{"ES256", signJWT(t, "ES256", "ec", keys.ec, claims(nil)), true},
+		{"EdDSA", signJWT(t, "EdDSA", "ed", keys.ed, claims(nil)), true},
+		{"HS256", signJWT(t, "HS256", "hmac", keys.hmac, claims(nil)), true},
+		// The public key of an asymmetric algorithm must not be usable as
+		// HMAC secret.
+		{"HS256 with RSA key", signJWT(t, "HS256", "rsa", rsaPublic, claims(nil)), false},
+		{"ES256 with RSA key", signJWT(t, "ES256", "rsa", keys.ec, claims(nil)), false},
+		{"wrong kid", signJWT(t, "ES256", "ed", keys.ec, claims(nil)), false},
+		{"unknown kid", signJWT(t, "ES256", "unknown", keys.ec, claims(nil)), false},
+		{"unsupported alg", signJWT(t, "none", "", nil, claims(nil)), false},
+		// Tokens without kid are checked against all keys, both with and
+		// without id.
+		{"no kid, unnamed key", signJWT(t, "ES256", "", keys.otherEC, claims(nil)), true},
+		{"no kid, named key", signJWT(t, "EdDSA", "", keys.ed, claims(nil)), true},
+		{"no kid, unknown key", signJWT(t, "HS256", "", []byte("another secret"), claims(nil)), false},
+		{"expired", signJWT(t, "ES256", "ec", keys.ec, claims(map[string]interface{}{"exp": now - 60})), false},
+		{"expired within leeway", signJWT(t, "ES256", "ec", keys.ec, claims(map[string]interface{}{"exp": now - 10})), true},
+		{"no exp", signJWT(t, "ES256", "ec", keys.ec, claims(map[string]interface{}{"exp": nil})), false},
+		{"not yet valid", signJWT(t, "ES256", "ec", keys.ec, claims(map[string]interface{}{"nbf": now + 60})), false},
+		{"not yet valid within leeway", signJWT(t, "ES256", "ec", keys.ec, claims(map[string]interface{}{"nbf": now + 10})), true},
+		{"wrong iss", signJWT(t, "ES256", "ec", keys.ec, claims(map[string]interface{}{"iss": "https://evil.example.com"})), false},
+		{"no iss", signJWT(t, "ES256", "ec", keys.ec, claims(map[string]interface{}{"iss": nil})), false},
+		{"wrong aud", signJWT(t, "ES256", "ec", keys.ec, claims(map[string]interface{}{"aud": "other"})), false},
+		{"aud list", signJWT(t, "ES256", "ec", keys.ec, claims(map[string]interface{}{"aud": []string{"other", "autobahnkreuz"}})), true},
+		{"aud list without audience", signJWT(t, "ES256", "ec", keys.ec, claims(map[string]interface{}{"aud": []string{"other"}})), false},
+		{"malformed", "not.a-token", false},
+	}
+	for _, c := range cases {
+		_, err := auth.Validate(c.token)
+		if valid := err == nil; valid != c.valid {
+			t.Errorf("%s: expected valid %v, got error %v", c.name, c.valid, err)
+		}
+	}
+}
+
+func TestJWTSignatureErrors(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	cases := []struct {
+		alg       string
+		key       interface{}
+		signature []byte
+		expected  string
+	}{
+		{"ES256", &keys.ec.PublicKey, make([]byte, 63), "Invalid signature"},
+		{"ES256", &keys.rsa.PublicKey, make([]byte, 64), "Key type does not match algorithm"},
+		{"RS256", keys.hmac, make([]byte, 256), "Key type does not match algorithm"},
+		{"HS256", &keys.rsa.PublicKey, make([]byte, 32), "Key type does not match algorithm"},
+		{"EdDSA", keys.ed.Public(), make([]byte, 64), "Invalid signature"},
+	}
+	for _, c := range cases {
+		err := verifyJWTSignature(c.alg, c.key, []byte("input"), c.signature)
+		if err == nil || err.Error() != c.expected {
+			t.Errorf("%s with %T: expected %q, got %v", c.alg, c.key, c.expected, err)
+		}
+	}
+}
+
+func TestJWTLoadKeys(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	dir := t.TempDir()
+	writePEM := func(name string, key interface{}) string {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	ec := writePEM("ec.pem", &keys.ec.PublicKey)
+	otherEC := writePEM("other-ec.pem", &keys.otherEC.PublicKey)
+	ed := writePEM("ed.pem", keys.ed.Public())
+
+	config := JWTConfig{AuthRolesClaim: "roles", PEMKeyFiles: []string{ec, otherEC, "ed;" + ed}}
+	auth, err := NewJWTAuth(config, "realm", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(auth.UnnamedKeys) != 2 || len(auth.Keys) != 1 {
+		t.Fatalf("Expected 2 unnamed and 1 named key, got %d and %d", len(auth.UnnamedKeys), len(auth.Keys))
+	}
+	// A rotated key without id does not replace the previous one.
+	for _, key := range []*ecdsa.PrivateKey{keys.ec, keys.otherEC} {
+		token := signJWT(t, "ES256", "", key, map[string]interface{}{"exp": time.Now().Unix() + 60})
+		if _, err := auth.Validate(token); err != nil {
+			t.Errorf("Expected a valid token, got %v", err)
+		}
+	}
+
+	config.PEMKeyFiles = []string{"ec;" + ec, "ec;" + otherEC}
+	if _, err := NewJWTAuth(config, "realm", nil); err == nil {
+		t.Error("Expected an error for duplicate key ids")
+	}
+}
@@ -0,0 +1,57 @@
+package multiauthorizer
+
+import (
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// ActionMeta is the action of calls to meta procedures and subscriptions to
+// meta events.
+const ActionMeta = "meta"
+
+// metaURIPrefixes are the prefixes of the meta procedures and events, which
+// expose and modify the sessions, registrations and subscriptions of other
+// clients.
+var metaURIPrefixes = []wamp.URI{
+	"wamp.session.",
+	"wamp.registration.",
+	"wamp.subscription.",
+}
+
+// IsMetaURI reports whether uri belongs to the meta API.
+func IsMetaURI(uri wamp.URI) bool {
+	for _, prefix := range metaURIPrefixes {
+		if uri.PrefixMatch(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// MessageAction returns the URI and the action of msg, if it is one of the
+// authorized actions. Calls to meta procedures and subscriptions to meta
+// events are ActionMeta. UNSUBSCRIBE, UNREGISTER and CANCEL carry no URI.
+func MessageAction(msg wamp.Message) (wamp.URI, string) {
+	switch msg := msg.(type) {
+	case *wamp.Call:
+		if IsMetaURI(msg.Procedure) {
+			return msg.Procedure, ActionMeta
+		}
+		return msg.Procedure, "call"
+	case *wamp.Register:
+		return msg.Procedure, "register"
+	case *wamp.Subscribe:
+		if IsMetaURI(msg.Topic) {
+			return msg.Topic, ActionMeta
+		}
+		return msg.Topic, "subscribe"
+	case *wamp.Publish:
+		return msg.Topic, "publish"
+	case *wamp.Unsubscribe:
+		return "", "unsubscribe"
+	case *wamp.Unregister:
+		return "", "unregister"
+	case *wamp.Cancel:
+		return "", "cancel"
+	}
+	return "", ""
+}
@@ -0,0 +1,137 @@
+package multiauthorizer
+
+import (
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// Explanation describes how an authorizer came to its decision.
+type Explanation struct {
+	Decision Decision
+	// Permitted is the result Authorize returns, deciders which are no
+	// nexus.Authorizer report whether they do not deny.
+	Permitted bool
+	Err       error
+	// Details are specific to the authorizer, e.g. the matched rule.
+	Details wamp.Dict
+}
+
+// Explainer is an authorizer which can explain its decision.
+type Explainer interface {
+	Explain(sess *wamp.Session, msg wamp.Message) Explanation
+}
+
+// explain asks the authorizer for an explanation, other authorizers only
+// report their decision.
+func (n namedAuthorizer) explain(sess *wamp.Session, msg wamp.Message) Explanation {
+	var explainer interface{} = n.authorizer
+	if n.authorizer == nil {
+		explainer = n.decider
+	}
+	if explainer, ok := explainer.(Explainer); ok {
+		return explainer.Explain(sess, msg)
+	}
+	if n.authorizer == nil {
+		decision, err := n.decider.Decide(sess, msg)
+		return Explanation{
+			Decision:  decision,
+			Permitted: decision != Deny,
+			Err:       err,
+		}
+	}
+	var permitted bool
+	var err error
+	if evaluator, ok := n.authorizer.(Evaluator); ok {
+		permitted, err = evaluator.Evaluate(sess, msg)
+	} else {
+		permitted, err = n.authorizer.Authorize(sess, msg)
+	}
+	explanation := Explanation{
+		Decision:  boolDecision(permitted),
+		Permitted: permitted,
+		Err:       err,
+	}
+	if n.decider != nil {
+		explanation.Decision, explanation.Err = n.decider.Decide(sess, msg)
+	}
+	return explanation
+}
+
+// explainedAuthorizer replays an explanation, so the consent mode can be
+// applied without asking the authorizer again.
+type explainedAuthorizer Explanation
+
+func (e explainedAuthorizer) Authorize(*wamp.Session, wamp.Message) (bool, error) {
+	return e.Permitted, e.Err
+}
+
+func (e explainedAuthorizer) Decide(*wamp.Session, wamp.Message) (Decision, error) {
+	return e.Decision, e.Err
+}
+
+func (e Explanation) dict(name string, asked bool) wamp.Dict {
+	res := wamp.Dict{
+		"authorizer": name,
+		"decision":   e.Decision.String(),
+		"permit":     e.Permitted,
+		"asked":      asked,
+	}
+	if e.Err != nil {
+		res["error"] = e.Err.Error()
+	}
+	for key, value := range e.Details {
+		res[key] = value
+	}
+	return res
+}
+
+// Explain asks every authorizer, including those the consent mode would skip
+// and the shadow authorizers, and returns their decisions as well as the
+// combined result. `asked` tells which authorizers are asked when the message
+// is authorized.
+func (mAuth *MultiAuthorizer) Explain(sess *wamp.Session, msg wamp.Message) wamp.Dict {
+	replay := &MultiAuthorizer{
+		PermitDefault: mAuth.PermitDefault,
+		consentMode:   mAuth.consentMode,
+	}
+	explanations := make([]Explanation, 0, len(mAuth.authorizerList))
+	for _, singleAuthorizer := range mAuth.authorizerList {
+		explanation := singleAuthorizer.explain(sess, msg)
+		explanations = append(explanations, explanation)
+		replayed := namedAuthorizer{
+			name:    singleAuthorizer.name,
+			decider: explainedAuthorizer(explanation),
+		}
+		if singleAuthorizer.authorizer != nil {
+			replayed.authorizer = explainedAuthorizer(explanation)
+		}
+		replay.authorizerList = append(replay.authorizerList, replayed)
+	}
+
+	var verdicts []verdict
+	permitted, err := replay.authorize(sess, msg, &verdicts)
+
+	asked := make(map[string]bool, len(verdicts))
+	for _, v := range verdicts {
+		asked[v.name] = true
+	}
+	authorizers := wamp.List{}
+	for i, explanation := range explanations {
+		name := mAuth.authorizerList[i].name
+		authorizers = append(authorizers, explanation.dict(name, asked[name]))
+	}
+	shadow := wamp.List{}
+	for _, shadowAuthorizer := range mAuth.shadowList {
+		shadow = append(shadow, shadowAuthorizer.explain(sess, msg).dict(shadowAuthorizer.name, false))
+	}
+
+	res := wamp.Dict{
+		"permit":       permitted,
+		"consent_mode": mAuth.consentMode.String(),
+		"authorizers":  authorizers,
+		"shadow":       shadow,
+	}
+	if err != nil {
+		res["error"] = err.Error()
+	}
+	return res
+}
@@ -11,11 +11,157 @@ type ConsentMode int
 const (
 	ConsentModeAll ConsentMode = iota
 	ConsentModeOne
+	// ConsentModeFirstApplicable uses the decision of the first authorizer
+	// which does not abstain.
+	ConsentModeFirstApplicable
+	// ConsentModeDenyOverrides denies if any authorizer denies, otherwise it
+	// permits if any authorizer permits.
+	ConsentModeDenyOverrides
+	// ConsentModePermitOverrides permits if any authorizer permits, otherwise
+	// it denies if any authorizer denies.
+	ConsentModePermitOverrides
+	// ConsentModeMajority uses the decision of the majority of the authorizers
+	// which do not abstain.
+	ConsentModeMajority
 )
 
+func (m ConsentMode) String() string {
+	switch m {
+	case ConsentModeOne:
+		return "one"
+	case ConsentModeFirstApplicable:
+		return "first-applicable"
+	case ConsentModeDenyOverrides:
+		return "deny-overrides"
+	case ConsentModePermitOverrides:
+		return "permit-overrides"
+	case ConsentModeMajority:
+		return "majority"
+	}
+	return "all"
+}
+
+// Decision is the result of an authorizer, which may have no opinion about a
+// message.
+type Decision int
+
+const (
+	Abstain Decision = iota
+	Permit
+	Deny
+)
+
+func (d Decision) String() string {
+	switch d {
+	case Permit:
+		return "permit"
+	case Deny:
+		return "deny"
+	}
+	return "abstain"
+}
+
+// Permitted converts the decision into the result of a nexus.Authorizer, an
+// abstention results in permitDefault.
+func (d Decision) Permitted(permitDefault bool) bool {
+	if d == Abstain {
+		return permitDefault
+	}
+	return d == Permit
+}
+
+// Decider decides about a message and may abstain. Deciders which are no
+// nexus.Authorizer are added using AddDecider, they restrict the actions,
+// like rate limits. In the consent modes all and one, they are skipped when
+// they abstain and deny the message when they deny.
+type Decider interface {
+	Decide(sess *wamp.Session, msg wamp.Message) (Decision, error)
+}
+
+// DecisionAuthorizer is an authorizer which may abstain. Its Authorize method
+// is used by the consent modes all and one, Decide by all other modes.
+type DecisionAuthorizer interface {
+	nexus.Authorizer
+	Decider
+}
+
+// Evaluator is an authorizer whose Authorize has side effects on the message,
+// like applying directives. Evaluate makes the same decision without them,
+// it is used for decisions which are not enforced.
+type Evaluator interface {
+	Evaluate(sess *wamp.Session, msg wamp.Message) (bool, error)
+}
+
+// evaluate is decide, but uses Evaluate instead of Authorize.
+func (n namedAuthorizer) evaluate(sess *wamp.Session, msg wamp.Message) (Decision, error) {
+	evaluator, ok := n.authorizer.(Evaluator)
+	if !ok || n.decider != nil {
+		return n.decide(sess, msg)
+	}
+	authResult, authErr := evaluator.Evaluate(sess, msg)
+	if authErr != nil {
+		return Deny, authErr
+	}
+	return boolDecision(authResult), nil
+}
+
+// decide asks for a decision, plain authorizers never abstain.
+func (n namedAuthorizer) decide(sess *wamp.Session, msg wamp.Message) (Decision, error) {
+	if n.decider != nil {
+		return n.decider.Decide(sess, msg)
+	}
+	authResult, authErr := n.authorizer.Authorize(sess, msg)
+	if authErr != nil {
+		return Deny, authErr
+	}
+	return boolDecision(authResult), nil
+}
+
+// authorize asks for the result of Authorize, only deciders which are no
+// nexus.Authorizer may abstain.
+func (n namedAuthorizer) authorize(sess *wamp.Session, msg wamp.Message) (Decision, error) {
+	if n.authorizer == nil {
+		return n.decider.Decide(sess, msg)
+	}
+	authResult, authErr := n.authorizer.Authorize(sess, msg)
+	return boolDecision(authResult), authErr
+}
+
+// boolDecision converts the result of a nexus.Authorizer into a decision.
+func boolDecision(authResult bool) Decision {
+	if authResult {
+		return Permit
+	}
+	return Deny
+}
+
 type MultiAuthorizer struct {
+	// PermitDefault is used if all authorizers abstain.
+	PermitDefault  bool
 	consentMode    ConsentMode
-	authorizerList []nexus.Authorizer
+	authorizerList []namedAuthorizer
+	// shadowList contains authorizers which are evaluated, but not enforced.
+	shadowList []namedAuthorizer
+	// shadowQueue passes the messages to the shadow workers.
+	shadowQueue chan shadowJob
+}
+
+type namedAuthorizer struct {
+	name string
+	// authorizer is nil for deciders added by AddDecider.
+	authorizer nexus.Authorizer
+	// decider is nil for authorizers which can not abstain.
+	decider Decider
+}
+
+// newNamedAuthorizer uses Decide of authorizer, if it implements it.
+func newNamedAuthorizer(authName string, authorizer nexus.Authorizer) namedAuthorizer {
+	decider, _ := authorizer.(Decider)
+	return namedAuthorizer{
+		name:       authName,
+		authorizer: authorizer,
+		decider:    decider,
+	}
 }
 
 func New(mode ConsentMode) *MultiAuthorizer {
@@ -23,7 +169,7 @@ func New(mode ConsentMode) *MultiAuthorizer {
 	util.Logger.Info("Created MultiAuthorizer")
 	util.Logger.Infof("Consent Mode: %v", mode)
 
-	var authorizerList []nexus.Authorizer
+	var authorizerList []namedAuthorizer
 
 	return &MultiAuthorizer{
 		consentMode:    mode,
@@ -35,23 +181,80 @@ func (mAuth *MultiAuthorizer) Add(authName string, authorizer nexus.Authorizer)
 
 	util.Logger.Info("Adding Authorizer to MultiAuthorizer")
 	util.Logger.Infof("Name: %s", authName)
-	mAuth.authorizerList = append(mAuth.authorizerList, authorizer)
+	mAuth.authorizerList = append(mAuth.authorizerList, newNamedAuthorizer(authName, authorizer))
+}
+
+// AddDecider adds a decider which is no nexus.Authorizer.
+func (mAuth *MultiAuthorizer) AddDecider(authName string, decider Decider) {
+
+	util.Logger.Info("Adding Decider to MultiAuthorizer")
+	util.Logger.Infof("Name: %s", authName)
+	mAuth.authorizerList = append(mAuth.authorizerList, namedAuthorizer{
+		name:    authName,
+		decider: decider,
+	})
 }
 
 func (mAuth *MultiAuthorizer) Authorize(sess *wamp.Session, msg wamp.Message) (bool, error) {
+	if len(mAuth.shadowList) == 0 {
+		return mAuth.authorize(sess, msg, nil)
+	}
+	// The copies are taken before the enforced authorizers may modify msg.
+	job := shadowJob{
+		sess: copySession(sess),
+		msg:  copyMessage(msg),
+	}
+	authResult, authErr := mAuth.authorize(sess, msg, &job.verdicts)
+	job.enforced = authResult
+	mAuth.enqueueShadow(job)
+	return authResult, authErr
+}
+
+// authorize evaluates the enforced authorizers, their verdicts are appended
+// to verdicts, if it is not nil.
+func (mAuth *MultiAuthorizer) authorize(sess *wamp.Session, msg wamp.Message, verdicts *[]verdict) (bool, error) {
+
+	if mAuth.consentMode != ConsentModeAll && mAuth.consentMode != ConsentModeOne {
+		decision, err := mAuth.decide(sess, msg, verdicts)
+		if err != nil {
+			return false, err
+		}
+		return decision.Permitted(mAuth.PermitDefault), nil
+	}
 
 	lastAuthResult := false
+	decided := false
+	approved := false
 
 	for _, singleAuthorizer := range mAuth.authorizerList {
-		authResult, authErr := singleAuthorizer.Authorize(sess, msg)
+		// Once an authorizer approved the message in consent mode one, only
+		// the deciders may still reject it.
+		if approved && singleAuthorizer.authorizer != nil {
+			continue
+		}
+		decision, authErr := singleAuthorizer.authorize(sess, msg)
+		record(verdicts, singleAuthorizer.name, decision, authErr)
 
 		if authErr != nil {
 			return false, authErr
 		}
 
-		// If one authorizer approves this message, nothing more must be checked and the message gets approved.
+		if decision == Abstain {
+			continue
+		}
+		decided = true
+		authResult := decision == Permit
+
+		// Deciders restrict the actions, so their denial is final even if
+		// only one authorizer has to approve.
+		if !authResult && singleAuthorizer.authorizer == nil {
+			return false, nil
+		}
+
+		// If one authorizer approves this message, only the deciders must be checked and the message gets approved.
 		if authResult && mAuth.consentMode == ConsentModeOne {
-			return true, nil
+			approved = true
+			continue
 		}
 
 		// If one authorizer denies this message, nothing more must be checked and the message gets rejected.
@@ -64,6 +267,84 @@ func (mAuth *MultiAuthorizer) Authorize(sess *wamp.Session, msg wamp.Message) (b
 		lastAuthResult = authResult
 	}
 
+	if approved {
+		return true, nil
+	}
+	if !decided {
+		return mAuth.PermitDefault, nil
+	}
 	return lastAuthResult, nil
 
 }
+
+// Decide combines the decisions of all authorizers according to the consent
+// mode, it abstains if all authorizers abstain. In the consent modes all and
+// one, only deciders can abstain.
+func (mAuth *MultiAuthorizer) Decide(sess *wamp.Session, msg wamp.Message) (Decision, error) {
+	if len(mAuth.shadowList) == 0 {
+		return mAuth.decide(sess, msg, nil)
+	}
+	job := shadowJob{
+		sess: copySession(sess),
+		msg:  copyMessage(msg),
+	}
+	decision, err := mAuth.decide(sess, msg, &job.verdicts)
+	job.enforced = err == nil && decision.Permitted(mAuth.PermitDefault)
+	mAuth.enqueueShadow(job)
+	return decision, err
+}
+
+func (mAuth *MultiAuthorizer) decide(sess *wamp.Session, msg wamp.Message, verdicts *[]verdict) (Decision, error) {
+
+	if mAuth.consentMode == ConsentModeAll || mAuth.consentMode == ConsentModeOne {
+		authResult, authErr := mAuth.authorize(sess, msg, verdicts)
+		if authErr != nil {
+			return Deny, authErr
+		}
+		return boolDecision(authResult), nil
+	}
+
+	permits, denies := 0, 0
+
+	for _, singleAuthorizer := range mAuth.authorizerList {
+		decision, authErr := singleAuthorizer.decide(sess, msg)
+		record(verdicts, singleAuthorizer.name, decision, authErr)
+
+		if authErr != nil {
+			return Deny, authErr
+		}
+
+		switch decision {
+		case Permit:
+			permits++
+		case Deny:
+			denies++
+		default:
+			continue
+		}
+
+		switch mAuth.consentMode {
+		case ConsentModeFirstApplicable:
+			return decision, nil
+		case ConsentModeDenyOverrides:
+			if decision == Deny {
+				return Deny, nil
+			}
+		case ConsentModePermitOverrides:
+			if decision == Permit {
+				return Permit, nil
+			}
+		}
+	}
+
+	// Deny-overrides only gets here without denies and permit-overrides
+	// without permits, so only the majority mode compares both. A tie is no
+	// majority.
+	switch {
+	case permits > denies:
+		return Permit, nil
+	case denies > permits:
+		return Deny, nil
+	}
+	return Abstain, nil
+}
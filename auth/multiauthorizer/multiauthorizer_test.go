@@ -0,0 +1,210 @@
+package multiauthorizer
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+var errTest = errors.New("test error")
+
+// stubAuthorizer is a plain nexus.Authorizer, it can not abstain.
+type stubAuthorizer struct {
+	permit bool
+	err    error
+}
+
+func (a stubAuthorizer) Authorize(*wamp.Session, wamp.Message) (bool, error) {
+	return a.permit, a.err
+}
+
+// stubDecisionAuthorizer is a DecisionAuthorizer, like the real ones its
+// Authorize uses its own permitDefault when it abstains.
+type stubDecisionAuthorizer struct {
+	decision      Decision
+	permitDefault bool
+	err           error
+}
+
+func (a stubDecisionAuthorizer) Authorize(*wamp.Session, wamp.Message) (bool, error) {
+	return a.decision.Permitted(a.permitDefault), a.err
+}
+
+func (a stubDecisionAuthorizer) Decide(*wamp.Session, wamp.Message) (Decision, error) {
+	return a.decision, a.err
+}
+
+// stubDecider is a Decider which is no nexus.Authorizer.
+type stubDecider struct {
+	decision Decision
+	err      error
+}
+
+func (d stubDecider) Decide(*wamp.Session, wamp.Message) (Decision, error) {
+	return d.decision, d.err
+}
+
+var (
+	permit      = stubAuthorizer{permit: true}
+	deny        = stubAuthorizer{}
+	failing     = stubAuthorizer{err: errTest}
+	decPermit   = stubDecisionAuthorizer{decision: Permit}
+	decDeny     = stubDecisionAuthorizer{decision: Deny}
+	decAbstain  = stubDecisionAuthorizer{decision: Abstain}
+	decFailing  = stubDecisionAuthorizer{decision: Deny, err: errTest}
+	limitOk     = stubDecider{decision: Abstain}
+	limitDeny   = stubDecider{decision: Deny}
+	limitFailed = stubDecider{decision: Deny, err: errTest}
+)
+
+// newTestMultiAuthorizer adds the authorizers, named by their index. Those
+// which are no nexus.Authorizer are added as deciders.
+func newTestMultiAuthorizer(mode ConsentMode, permitDefault bool, authorizers []interface{}) *MultiAuthorizer {
+	util.Init()
+	mAuth := New(mode)
+	mAuth.PermitDefault = permitDefault
+	for i, authorizer := range authorizers {
+		name := fmt.Sprint(i)
+		switch authorizer := authorizer.(type) {
+		case stubDecider:
+			mAuth.AddDecider(name, authorizer)
+		case stubAuthorizer:
+			mAuth.Add(name, authorizer)
+		case stubDecisionAuthorizer:
+			mAuth.Add(name, authorizer)
+		}
+	}
+	return mAuth
+}
+
+func TestMultiAuthorizerAuthorize(t *testing.T) {
+	cases := []struct {
+		mode          ConsentMode
+		permitDefault bool
+		authorizers   []interface{}
+		permitted     bool
+		err           bool
+	}{
+		{ConsentModeAll, false, []interface{}{permit, permit}, true, false},
+		{ConsentModeAll, false, []interface{}{permit, deny}, false, false},
+		{ConsentModeAll, false, []interface{}{deny, permit}, false, false},
+		{ConsentModeAll, true, []interface{}{permit, failing}, false, true},
+		{ConsentModeAll, false, []interface{}{permit, decPermit}, true, false},
+		// Authorize of decision authorizers decides about their abstention.
+		{ConsentModeAll, true, []interface{}{permit, decAbstain}, false, false},
+		{ConsentModeAll, false, []interface{}{permit, stubDecisionAuthorizer{permitDefault: true}}, true, false},
+		// Deciders are skipped when they abstain.
+		{ConsentModeAll, false, []interface{}{limitOk, permit}, true, false},
+		{ConsentModeAll, false, []interface{}{permit, limitDeny}, false, false},
+		{ConsentModeAll, false, []interface{}{limitFailed, permit}, false, true},
+		// Without a decision, PermitDefault is used.
+		{ConsentModeAll, false, []interface{}{}, false, false},
+		{ConsentModeAll, true, []interface{}{}, true, false},
+		{ConsentModeAll, false, []interface{}{limitOk}, false, false},
+		{ConsentModeAll, true, []interface{}{limitOk}, true, false},
+
+		{ConsentModeOne, false, []interface{}{deny, permit}, true, false},
+		{ConsentModeOne, false, []interface{}{permit, deny}, true, false},
+		{ConsentModeOne, false, []interface{}{deny, deny}, false, false},
+		{ConsentModeOne, true, []interface{}{deny, decAbstain}, false, false},
+		{ConsentModeOne, false, []interface{}{failing, permit}, false, true},
+		// Authorizers after an approval are not asked.
+		{ConsentModeOne, false, []interface{}{permit, failing}, true, false},
+		// The denial of a decider is final, wherever it is in the chain.
+		{ConsentModeOne, false, []interface{}{limitDeny, permit}, false, false},
+		{ConsentModeOne, false, []interface{}{permit, limitDeny}, false, false},
+		{ConsentModeOne, false, []interface{}{permit, limitOk}, true, false},
+		{ConsentModeOne, false, []interface{}{permit, limitFailed}, false, true},
+		{ConsentModeOne, false, []interface{}{limitOk}, false, false},
+		{ConsentModeOne, true, []interface{}{limitOk}, true, false},
+
+		{ConsentModeFirstApplicable, false, []interface{}{decAbstain, decDeny, decPermit}, false, false},
+		{ConsentModeFirstApplicable, false, []interface{}{decAbstain, decPermit, decDeny}, true, false},
+		{ConsentModeFirstApplicable, false, []interface{}{limitOk, permit}, true, false},
+		{ConsentModeFirstApplicable, false, []interface{}{decAbstain, decFailing, decPermit}, false, true},
+		{ConsentModeFirstApplicable, false, []interface{}{decAbstain, limitOk}, false, false},
+		{ConsentModeFirstApplicable, true, []interface{}{decAbstain, limitOk}, true, false},
+
+		{ConsentModeDenyOverrides, false, []interface{}{decPermit, decDeny}, false, false},
+		{ConsentModeDenyOverrides, false, []interface{}{decPermit, decAbstain, permit}, true, false},
+		{ConsentModeDenyOverrides, true, []interface{}{decPermit, limitDeny}, false, false},
+		{ConsentModeDenyOverrides, false, []interface{}{decPermit, decFailing}, false, true},
+		{ConsentModeDenyOverrides, true, []interface{}{decAbstain, decAbstain}, true, false},
+		{ConsentModeDenyOverrides, false, []interface{}{decAbstain, decAbstain}, false, false},
+
+		{ConsentModePermitOverrides, false, []interface{}{decDeny, decPermit}, true, false},
+		{ConsentModePermitOverrides, true, []interface{}{decDeny, decAbstain}, false, false},
+		{ConsentModePermitOverrides, false, []interface{}{decDeny, failing}, false, true},
+		{ConsentModePermitOverrides, true, []interface{}{limitOk, decAbstain}, true, false},
+		{ConsentModePermitOverrides, false, []interface{}{limitOk, decAbstain}, false, false},
+
+		{ConsentModeMajority, false, []interface{}{decPermit, decPermit, decDeny}, true, false},
+		{ConsentModeMajority, true, []interface{}{decPermit, decDeny, decDeny}, false, false},
+		{ConsentModeMajority, false, []interface{}{decPermit, decAbstain, decAbstain}, true, false},
+		{ConsentModeMajority, false, []interface{}{decPermit, decAbstain, failing}, false, true},
+		// A tie is no majority, so PermitDefault is used.
+		{ConsentModeMajority, true, []interface{}{decPermit, decDeny}, true, false},
+		{ConsentModeMajority, false, []interface{}{decPermit, decDeny}, false, false},
+		{ConsentModeMajority, true, []interface{}{decAbstain, limitOk}, true, false},
+		{ConsentModeMajority, false, []interface{}{decAbstain, limitOk}, false, false},
+	}
+	for i, c := range cases {
+		mAuth := newTestMultiAuthorizer(c.mode, c.permitDefault, c.authorizers)
+		permitted, err := mAuth.Authorize(&wamp.Session{}, &wamp.Call{Procedure: "com.app.test"})
+		if permitted != c.permitted || (err != nil) != c.err {
+			t.Errorf("Case %d (%v): expected %v (error %v), got %v (error %v)", i, c.mode, c.permitted, c.err, permitted, err)
+		}
+	}
+}
+
+func TestMultiAuthorizerDecide(t *testing.T) {
+	cases := []struct {
+		mode        ConsentMode
+		authorizers []interface{}
+		decision    Decision
+		err         bool
+	}{
+		{ConsentModeFirstApplicable, []interface{}{decAbstain, decDeny}, Deny, false},
+		{ConsentModeFirstApplicable, []interface{}{decAbstain, limitOk}, Abstain, false},
+		{ConsentModeDenyOverrides, []interface{}{decPermit, decAbstain}, Permit, false},
+		{ConsentModeDenyOverrides, []interface{}{decAbstain}, Abstain, false},
+		{ConsentModeDenyOverrides, []interface{}{decPermit, decFailing}, Deny, true},
+		{ConsentModePermitOverrides, []interface{}{decDeny, decAbstain}, Deny, false},
+		{ConsentModePermitOverrides, []interface{}{}, Abstain, false},
+		{ConsentModeMajority, []interface{}{decPermit, decDeny}, Abstain, false},
+		{ConsentModeMajority, []interface{}{decDeny, decDeny, permit}, Deny, false},
+		// In the consent modes all and one, the multi authorizer only
+		// abstains through PermitDefault.
+		{ConsentModeAll, []interface{}{limitOk}, Deny, false},
+		{ConsentModeOne, []interface{}{deny, permit}, Permit, false},
+		{ConsentModeOne, []interface{}{failing}, Deny, true},
+	}
+	for i, c := range cases {
+		mAuth := newTestMultiAuthorizer(c.mode, false, c.authorizers)
+		decision, err := mAuth.Decide(&wamp.Session{}, &wamp.Call{Procedure: "com.app.test"})
+		if decision != c.decision || (err != nil) != c.err {
+			t.Errorf("Case %d (%v): expected %v (error %v), got %v (error %v)", i, c.mode, c.decision, c.err, decision, err)
+		}
+	}
+}
+
+func TestMultiAuthorizerExplain(t *testing.T) {
+	mAuth := newTestMultiAuthorizer(ConsentModeOne, false, []interface{}{deny, permit, decDeny, limitDeny})
+	explanation := mAuth.Explain(&wamp.Session{}, &wamp.Call{Procedure: "com.app.test"})
+	if explanation["permit"] != false {
+		t.Errorf("Expected the decider to deny, got %v", explanation["permit"])
+	}
+	authorizers := explanation["authorizers"].(wamp.List)
+	// The authorizer after the approval is not asked, but the decider is.
+	expectedAsked := []bool{true, true, false, true}
+	for i, raw := range authorizers {
+		entry := raw.(wamp.Dict)
+		if entry["asked"] != expectedAsked[i] {
+			t.Errorf("Authorizer %d: expected asked %v, got %v", i, expectedAsked[i], entry["asked"])
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package multiauthorizer
+
+import (
+	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
+	nexus "github.com/gammazero/nexus/v3/router"
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// ShadowMismatchTopic receives an event whenever a shadow authorizer
+// disagrees with the enforced decision.
+const ShadowMismatchTopic = "ee.authorizer.shadow-mismatch"
+
+const (
+	// shadowQueueSize is the number of messages waiting for the shadow
+	// authorizers, further messages are not evaluated by them.
+	shadowQueueSize = 1024
+	// shadowWorkers is the number of messages evaluated concurrently by the
+	// shadow authorizers.
+	shadowWorkers = 4
+)
+
+// shadowJob is a message to be evaluated by the shadow authorizers. The
+// session and the message are copies, so they can be read while nexus
+// handles the original ones.
+type shadowJob struct {
+	sess     *wamp.Session
+	msg      wamp.Message
+	enforced bool
+	verdicts []verdict
+}
+
+// verdict is the result of a single authorizer.
+type verdict struct {
+	name     string
+	decision Decision
+	err      error
+}
+
+func (v verdict) dict() wamp.Dict {
+	res := wamp.Dict{
+		"authorizer": v.name,
+		"decision":   v.decision.String(),
+	}
+	if v.err != nil {
+		res["error"] = v.err.Error()
+	}
+	return res
+}
+
+func (v verdict) String() string {
+	if v.err != nil {
+		return v.name + ": " + v.decision.String() + " (" + v.err.Error() + ")"
+	}
+	return v.name + ": " + v.decision.String()
+}
+
+func verdictList(verdicts []verdict) wamp.List {
+	list := make(wamp.List, 0, len(verdicts))
+	for _, v := range verdicts {
+		list = append(list, v.dict())
+	}
+	return list
+}
+
+func record(verdicts *[]verdict, name string, decision Decision, err error) {
+	if verdicts != nil {
+		*verdicts = append(*verdicts, verdict{
+			name:     name,
+			decision: decision,
+			err:      err,
+		})
+	}
+}
+
+// AddShadow adds an authorizer which is evaluated for every message, but not
+// enforced. Disagreements with the enforced decision are logged and published
+// on ShadowMismatchTopic.
+func (mAuth *MultiAuthorizer) AddShadow(authName string, authorizer nexus.Authorizer) {
+
+	util.Logger.Info("Adding Shadow Authorizer to MultiAuthorizer")
+	util.Logger.Infof("Name: %s", authName)
+	mAuth.addShadow(newNamedAuthorizer(authName, authorizer))
+}
+
+// AddShadowDecider adds a decider which is no nexus.Authorizer as shadow
+// authorizer.
+func (mAuth *MultiAuthorizer) AddShadowDecider(authName string, decider Decider) {
+
+	util.Logger.Info("Adding Shadow Decider to MultiAuthorizer")
+	util.Logger.Infof("Name: %s", authName)
+	mAuth.addShadow(namedAuthorizer{
+		name:    authName,
+		decider: decider,
+	})
+}
+
+// addShadow adds a shadow authorizer and starts the shadow workers with the
+// first one.
+func (mAuth *MultiAuthorizer) addShadow(shadowAuthorizer namedAuthorizer) {
+	mAuth.shadowList = append(mAuth.shadowList, shadowAuthorizer)
+	if mAuth.shadowQueue == nil {
+		mAuth.shadowQueue = make(chan shadowJob, shadowQueueSize)
+		for i := 0; i < shadowWorkers; i++ {
+			go func() {
+				for job := range mAuth.shadowQueue {
+					mAuth.shadow(job.sess, job.msg, job.enforced, job.verdicts)
+				}
+			}()
+		}
+	}
+}
+
+// enqueueShadow passes job to the shadow workers. It is dropped if they are
+// too busy, so the shadow authorizers never slow down the enforced ones.
+func (mAuth *MultiAuthorizer) enqueueShadow(job shadowJob) {
+	select {
+	case mAuth.shadowQueue <- job:
+	default:
+		util.Logger.Debugf("Shadow authorizers are busy, skipped message of session %v", job.sess.ID)
+	}
+}
+
+// copySession copies the ID and the details of sess.
+func copySession(sess *wamp.Session) *wamp.Session {
+	return &wamp.Session{
+		ID:      sess.ID,
+		Details: copyDict(sess.Details),
+	}
+}
+
+// copyMessage copies the authorized messages including their options and
+// arguments, other messages are returned as they are.
+func copyMessage(msg wamp.Message) wamp.Message {
+	switch msg := msg.(type) {
+	case *wamp.Call:
+		c := *msg
+		c.Options, c.Arguments, c.ArgumentsKw = copyDict(msg.Options), copyList(msg.Arguments), copyDict(msg.ArgumentsKw)
+		return &c
+	case *wamp.Publish:
+		c := *msg
+		c.Options, c.Arguments, c.ArgumentsKw = copyDict(msg.Options), copyList(msg.Arguments), copyDict(msg.ArgumentsKw)
+		return &c
+	case *wamp.Register:
+		c := *msg
+		c.Options = copyDict(msg.Options)
+		return &c
+	case *wamp.Subscribe:
+		c := *msg
+		c.Options = copyDict(msg.Options)
+		return &c
+	case *wamp.Cancel:
+		c := *msg
+		c.Options = copyDict(msg.Options)
+		return &c
+	case *wamp.Unsubscribe:
+		c := *msg
+		return &c
+	case *wamp.Unregister:
+		c := *msg
+		return &c
+	}
+	return msg
+}
+
+func copyDict(dict wamp.Dict) wamp.Dict {
+	if dict == nil {
+		return nil
+	}
+	c := make(wamp.Dict, len(dict))
+	for key, value := range dict {
+		c[key] = value
+	}
+	return c
+}
+
+func copyList(list wamp.List) wamp.List {
+	if list == nil {
+		return nil
+	}
+	return append(wamp.List{}, list...)
+}
+
+// shadow evaluates the shadow authorizers and reports those disagreeing with
+// the enforced result. An error of a shadow authorizer counts as deny, like
+// it would if it was enforced.
+func (mAuth *MultiAuthorizer) shadow(sess *wamp.Session, msg wamp.Message, enforced bool, verdicts []verdict) {
+	mismatch := false
+	var shadowVerdicts []verdict
+	for _, shadowAuthorizer := range mAuth.shadowList {
+		decision, err := shadowAuthorizer.evaluate(sess, msg)
+		if err != nil {
+			decision = Deny
+		}
+		record(&shadowVerdicts, shadowAuthorizer.name, decision, err)
+		if decision.Permitted(mAuth.PermitDefault) != enforced {
+			mismatch = true
+		}
+	}
+	if !mismatch {
+		return
+	}
+
+	uri, action := MessageAction(msg)
+	util.Logger.Warningf("Shadow authorizers disagree on %v of %v by session %v: enforced %v, shadow %v", action, uri, sess.ID, verdicts, shadowVerdicts)
+
+	if util.LocalClient == nil {
+		return
+	}
+	event := wamp.Dict{
+		"session":  sess.ID,
+		"authid":   sess.Details["authid"],
+		"authrole": sess.Details["authrole"],
+		"uri":      uri,
+		"action":   action,
+		"permit":   enforced,
+		"enforced": verdictList(verdicts),
+		"shadow":   verdictList(shadowVerdicts),
+	}
+	if err := util.LocalClient.Publish(ShadowMismatchTopic, nil, wamp.List{event}, nil); err != nil {
+		util.Logger.Warningf("Failed to publish shadow mismatch: %v", err)
+	}
+}
@@ -0,0 +1,219 @@
+package multiauthorizer
+
+import (
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
+
+	"github.com/gammazero/nexus/v3/client"
+	"github.com/gammazero/nexus/v3/router"
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+const testRealm = "test.realm"
+
+// setupShadowRouter starts an in-process router and connects util.LocalClient
+// and a client subscribed to ShadowMismatchTopic, whose events are returned.
+func setupShadowRouter(t *testing.T) (router.Router, <-chan *wamp.Event) {
+	util.Init()
+	logger := log.New(ioutil.Discard, "", 0)
+	r, err := router.NewRouter(&router.Config{
+		RealmConfigs: []*router.RealmConfig{
+			{URI: wamp.URI(testRealm)},
+		},
+	}, logger)
+	if err != nil {
+		t.Fatalf("Failed to start router: %v", err)
+	}
+	util.LocalClient, err = client.ConnectLocal(r, client.Config{Realm: testRealm, Logger: logger})
+	if err != nil {
+		t.Fatalf("Failed to connect local client: %v", err)
+	}
+	subscriber, err := client.ConnectLocal(r, client.Config{Realm: testRealm, Logger: logger})
+	if err != nil {
+		t.Fatalf("Failed to connect subscriber: %v", err)
+	}
+	events := make(chan *wamp.Event, 16)
+	err = subscriber.Subscribe(ShadowMismatchTopic, func(event *wamp.Event) {
+		events <- event
+	}, wamp.Dict{})
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	return r, events
+}
+
+// funcAuthorizer is a nexus.Authorizer calling authorize.
+type funcAuthorizer func(sess *wamp.Session, msg wamp.Message) (bool, error)
+
+func (f funcAuthorizer) Authorize(sess *wamp.Session, msg wamp.Message) (bool, error) {
+	return f(sess, msg)
+}
+
+func testShadowSession() *wamp.Session {
+	return &wamp.Session{
+		ID: 42,
+		Details: wamp.Dict{
+			"authid":   "alice",
+			"authrole": "user",
+		},
+	}
+}
+
+func TestShadowMismatchEvent(t *testing.T) {
+	r, events := setupShadowRouter(t)
+	defer r.Close()
+	defer util.LocalClient.Close()
+
+	mAuth := New(ConsentModeAll)
+	mAuth.Add("enforced", stubAuthorizer{permit: true})
+	mAuth.AddShadow("agreeing", stubAuthorizer{permit: true})
+	mAuth.AddShadow("shadow", stubAuthorizer{err: errTest})
+
+	permitted, err := mAuth.Authorize(testShadowSession(), &wamp.Call{Procedure: "com.app.test"})
+	if !permitted || err != nil {
+		t.Fatalf("Expected the enforced authorizer to permit, got %v (error %v)", permitted, err)
+	}
+
+	var event *wamp.Event
+	select {
+	case event = <-events:
+	case <-time.After(time.Second):
+		t.Fatal("No shadow mismatch was published")
+	}
+	expected := wamp.Dict{
+		"session":  wamp.ID(42),
+		"authid":   "alice",
+		"authrole": "user",
+		"uri":      wamp.URI("com.app.test"),
+		"action":   "call",
+		"permit":   true,
+		"enforced": wamp.List{
+			wamp.Dict{"authorizer": "enforced", "decision": "permit"},
+		},
+		"shadow": wamp.List{
+			wamp.Dict{"authorizer": "agreeing", "decision": "permit"},
+			wamp.Dict{"authorizer": "shadow", "decision": "deny", "error": errTest.Error()},
+		},
+	}
+	if len(event.Arguments) != 1 {
+		t.Fatalf("Expected one argument, got %v", event.Arguments)
+	}
+	// The local transport passes the values as they are, so they keep their
+	// types.
+	if payload, _ := wamp.AsDict(event.Arguments[0]); !reflect.DeepEqual(payload, expected) {
+		t.Errorf("Expected %v, got %v", expected, payload)
+	}
+
+	// Agreeing shadow authorizers are not reported.
+	mAuth = New(ConsentModeAll)
+	mAuth.Add("enforced", stubAuthorizer{permit: true})
+	mAuth.AddShadow("agreeing", stubAuthorizer{permit: true})
+	mAuth.Authorize(testShadowSession(), &wamp.Call{Procedure: "com.app.test"})
+	select {
+	case event = <-events:
+		t.Errorf("Unexpected shadow mismatch %v", event.Arguments)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestShadowEvaluatesCopies(t *testing.T) {
+	util.Init()
+	// The enforced authorizer modifies the message and the session, like
+	// authorizers applying directives.
+	enforced := funcAuthorizer(func(sess *wamp.Session, msg wamp.Message) (bool, error) {
+		call := msg.(*wamp.Call)
+		call.Arguments[0] = "modified"
+		call.Options["directive"] = true
+		sess.Details["authid"] = "modified"
+		return true, nil
+	})
+	seen := make(chan *wamp.Call, 1)
+	seenAuthID := make(chan interface{}, 1)
+	shadow := funcAuthorizer(func(sess *wamp.Session, msg wamp.Message) (bool, error) {
+		seen <- msg.(*wamp.Call)
+		seenAuthID <- sess.Details["authid"]
+		return true, nil
+	})
+
+	mAuth := New(ConsentModeAll)
+	mAuth.Add("enforced", enforced)
+	mAuth.AddShadow("shadow", shadow)
+	mAuth.Authorize(testShadowSession(), &wamp.Call{
+		Procedure: "com.app.test",
+		Options:   wamp.Dict{},
+		Arguments: wamp.List{"original"},
+	})
+
+	select {
+	case call := <-seen:
+		if call.Arguments[0] != "original" {
+			t.Errorf("The shadow authorizer saw the modified arguments %v", call.Arguments)
+		}
+		if _, ok := call.Options["directive"]; ok {
+			t.Errorf("The shadow authorizer saw the modified options %v", call.Options)
+		}
+		if authid := <-seenAuthID; authid != "alice" {
+			t.Errorf("The shadow authorizer saw the modified authid %v", authid)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The shadow authorizer was not asked")
+	}
+}
+
+func TestShadowDropsJobsWhenBusy(t *testing.T) {
+	util.Init()
+	started := make(chan struct{}, shadowWorkers)
+	release := make(chan struct{})
+	var evaluated int32
+	shadow := funcAuthorizer(func(*wamp.Session, wamp.Message) (bool, error) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		atomic.AddInt32(&evaluated, 1)
+		return true, nil
+	})
+
+	mAuth := New(ConsentModeAll)
+	mAuth.Add("enforced", stubAuthorizer{permit: true})
+	mAuth.AddShadow("shadow", shadow)
+	authorize := func() {
+		mAuth.Authorize(testShadowSession(), &wamp.Call{Procedure: "com.app.test"})
+	}
+
+	// Block all workers, then fill the queue and overflow it.
+	for i := 0; i < shadowWorkers; i++ {
+		authorize()
+		<-started
+	}
+	finished := make(chan struct{})
+	go func() {
+		for i := 0; i < shadowQueueSize+100; i++ {
+			authorize()
+		}
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Authorize was blocked by the shadow authorizers")
+	}
+
+	close(release)
+	const expected = shadowWorkers + shadowQueueSize
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&evaluated) < expected && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if count := atomic.LoadInt32(&evaluated); count != expected {
+		t.Errorf("Expected %d evaluated messages, got %d", expected, count)
+	}
+}
@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// redactedValue replaces the values of redacted keys.
+const redactedValue = "[redacted]"
+
+// PayloadConfig selects the actions whose arguments and options are
+// forwarded to the upstream authorizer.
+type PayloadConfig struct {
+	// All forwards the payload of all actions, otherwise only those matching
+	// the patterns are forwarded.
+	All bool
+	// MaxSize is the maximum size of the JSON encoded payload in bytes,
+	// larger payloads are replaced by `truncated: true`. 0 disables the limit.
+	MaxSize int
+	// Redact contains dictionary keys whose values are never forwarded.
+	Redact map[string]bool
+
+	matcher *uriMatcher
+}
+
+// NewPayloadConfig creates a PayloadConfig. Patterns are URIs, optionally
+// prefixed by their match policy, e.g. `prefix:com.acme.device.`.
+func NewPayloadConfig(all bool, patterns []string, maxSize int, redact []string) (*PayloadConfig, error) {
+	mapping := FeatureMapping{}
+	for _, pattern := range patterns {
+		var entry interface{} = pattern
+		if i := strings.IndexByte(pattern, ':'); i >= 0 {
+			entry = wamp.Dict{
+				"match": pattern[:i],
+				"uri":   pattern[i+1:],
+			}
+		}
+		uri, match, err := parseMappingEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		if uri == "" || !uri.ValidURI(false, match) {
+			return nil, fmt.Errorf("%s is not a valid %s URI", uri, match)
+		}
+		mapping.add(match, uri, uri)
+	}
+
+	config := &PayloadConfig{
+		All:     all,
+		MaxSize: maxSize,
+		Redact:  make(map[string]bool),
+		matcher: newURIMatcher(mapping),
+	}
+	for _, key := range redact {
+		config.Redact[key] = true
+	}
+	return config, nil
+}
+
+// applies reports whether the payload of actions on uri is forwarded.
+func (c *PayloadConfig) applies(uri wamp.URI) bool {
+	if c.All {
+		return true
+	}
+	_, ok := c.matcher.Match(uri)
+	return ok
+}
+
+// redact returns a copy of value, in which the values of all redacted keys
+// of nested dictionaries are replaced.
+func (c *PayloadConfig) redact(value interface{}) interface{} {
+	if len(c.Redact) == 0 {
+		return value
+	}
+	if dict, ok := wamp.AsDict(value); ok && dict != nil {
+		res := make(wamp.Dict, len(dict))
+		for key, v := range dict {
+			if c.Redact[key] {
+				res[key] = redactedValue
+			} else {
+				res[key] = c.redact(v)
+			}
+		}
+		return res
+	}
+	if list, ok := wamp.AsList(value); ok && list != nil {
+		res := make(wamp.List, len(list))
+		for i, v := range list {
+			res[i] = c.redact(v)
+		}
+		return res
+	}
+	return value
+}
+
+// payload returns the redacted arguments, keyword arguments and options of
+// msg.
+func (c *PayloadConfig) payload(msg wamp.Message) wamp.Dict {
+	var args wamp.List
+	var kwargs, options wamp.Dict
+	switch msg := msg.(type) {
+	case *wamp.Call:
+		args, kwargs, options = msg.Arguments, msg.ArgumentsKw, msg.Options
+	case *wamp.Publish:
+		args, kwargs, options = msg.Arguments, msg.ArgumentsKw, msg.Options
+	case *wamp.Register:
+		options = msg.Options
+	case *wamp.Subscribe:
+		options = msg.Options
+	}
+
+	payload := wamp.Dict{
+		"args":    c.redact(args),
+		"kwargs":  c.redact(kwargs),
+		"options": c.redact(options),
+	}
+	if c.MaxSize > 0 {
+		encoded, err := json.Marshal(payload)
+		if err != nil || len(encoded) > c.MaxSize {
+			return wamp.Dict{
+				"truncated": true,
+			}
+		}
+	}
+	return payload
+}
+
+// applyDirectives applies the directives of a permitting reply of the
+// upstream authorizer to msg. `disclose_me` discloses the caller or
+// publisher, `args` and `kwargs` replace the arguments of calls and
+// publications.
+func applyDirectives(reply interface{}, msg wamp.Message) {
+	det, ok := wamp.AsDict(reply)
+	if !ok || det == nil {
+		return
+	}
+	var options wamp.Dict
+	var args *wamp.List
+	var kwargs *wamp.Dict
+	switch msg := msg.(type) {
+	case *wamp.Call:
+		if msg.Options == nil {
+			msg.Options = wamp.Dict{}
+		}
+		options, args, kwargs = msg.Options, &msg.Arguments, &msg.ArgumentsKw
+	case *wamp.Publish:
+		if msg.Options == nil {
+			msg.Options = wamp.Dict{}
+		}
+		options, args, kwargs = msg.Options, &msg.Arguments, &msg.ArgumentsKw
+	default:
+		return
+	}
+
+	if disclose, ok := det["disclose_me"].(bool); ok {
+		options[wamp.OptDiscloseMe] = disclose
+	}
+	if rewritten, ok := wamp.AsList(det["args"]); ok {
+		*args = rewritten
+	}
+	if rewritten, ok := wamp.AsDict(det["kwargs"]); ok {
+		*kwargs = rewritten
+	}
+}
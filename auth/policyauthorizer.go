@@ -0,0 +1,397 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/EmbeddedEnterprises/autobahnkreuz/auth/multiauthorizer"
+	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
+
+	mapset "github.com/deckarep/golang-set"
+
+	"github.com/gammazero/nexus/v3/wamp"
+
+	"gopkg.in/yaml.v2"
+)
+
+// PolicyAuthorizer authorizes actions based on a static policy file, it does
+// not need any upstream service.
+type PolicyAuthorizer struct {
+	PermitDefault    bool
+	Path             string
+	TrustedAuthRoles mapset.Set
+	// PollInterval is the time between two checks whether the file changed,
+	// 0 disables the checks. The file is always reloaded on SIGHUP.
+	PollInterval time.Duration
+
+	// policy holds the current *policy.
+	policy  atomic.Value
+	modTime time.Time
+	size    int64
+	// done stops Watch when closed.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// PolicyFile is the content of a policy file, either in YAML or in JSON.
+type PolicyFile struct {
+	// Roles maps authroles to the authroles they inherit the rules of.
+	Roles map[string][]string `json:"roles" yaml:"roles"`
+	Rules []PolicyRule        `json:"rules" yaml:"rules"`
+}
+
+// PolicyRule allows or denies actions on URIs matching a pattern for some
+// authroles.
+type PolicyRule struct {
+	URI string `json:"uri" yaml:"uri"`
+	// Match is the WAMP match policy of URI, by default URIs with empty
+	// components are wildcard patterns and all others are exact.
+	Match string `json:"match" yaml:"match"`
+	// Roles are the authroles the rule applies to, * applies to all of them.
+	Roles []string `json:"roles" yaml:"roles"`
+	// Actions are call, register, subscribe, publish, unsubscribe,
+	// unregister, cancel and meta, all of them but meta if empty or *.
+	Actions []string `json:"actions" yaml:"actions"`
+	// Effect is either allow (default) or deny.
+	Effect string `json:"effect" yaml:"effect"`
+}
+
+// ruleTarget selects the actions and URIs a rule applies to.
+type ruleTarget struct {
+	uri   wamp.URI
+	match string
+	// actions is empty if the rule applies to all actions.
+	actions map[string]bool
+}
+
+// policyRule is a validated PolicyRule.
+type policyRule struct {
+	ruleTarget
+	roles  map[string]bool
+	effect Permission
+}
+
+// policy is an immutable, validated policy file.
+type policy struct {
+	rules []policyRule
+	roles RoleHierarchy
+}
+
+// NewPolicyAuthorizer creates an authorizer using the policy file at path. The
+// file has to exist and to be valid.
+func NewPolicyAuthorizer(permitDefault bool, path string, trustedAuthRoles mapset.Set) (*PolicyAuthorizer, error) {
+	policyAuthorizer := &PolicyAuthorizer{
+		PermitDefault:    permitDefault,
+		Path:             path,
+		TrustedAuthRoles: trustedAuthRoles,
+		done:             make(chan struct{}),
+	}
+	if err := policyAuthorizer.Load(); err != nil {
+		return nil, err
+	}
+	return policyAuthorizer, nil
+}
+
+// readRuleFile parses the file at path into file, files ending with .json are
+// read as JSON, all others as YAML.
+func readRuleFile(path string, file interface{}) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if filepath.Ext(path) == ".json" {
+		return json.Unmarshal(content, file)
+	}
+	return yaml.UnmarshalStrict(content, file)
+}
+
+// compileRuleTarget validates the URI, match policy and actions of a rule. By
+// default URIs with empty components are wildcard patterns and all others are
+// exact.
+func compileRuleTarget(uri wamp.URI, match string, actions []string) (ruleTarget, error) {
+	switch match {
+	case "":
+		match = wamp.MatchExact
+		if !uri.ValidURI(false, wamp.MatchExact) {
+			match = wamp.MatchWildcard
+		}
+	case wamp.MatchExact, wamp.MatchPrefix, wamp.MatchWildcard:
+	default:
+		return ruleTarget{}, fmt.Errorf("unknown match policy %s", match)
+	}
+	if uri == "" || !uri.ValidURI(false, match) {
+		return ruleTarget{}, fmt.Errorf("%s is not a valid %s URI", uri, match)
+	}
+
+	compiledActions, err := compileRuleActions(actions)
+	if err != nil {
+		return ruleTarget{}, err
+	}
+	return ruleTarget{
+		uri:     uri,
+		match:   match,
+		actions: compiledActions,
+	}, nil
+}
+
+// compileRuleActions validates the actions of a rule, the result is empty if
+// the rule applies to all actions.
+func compileRuleActions(actions []string) (map[string]bool, error) {
+	compiled := make(map[string]bool)
+	for _, action := range actions {
+		if !featureActions[action] {
+			return nil, fmt.Errorf("unknown action %s", action)
+		}
+		if action == featureActionAll {
+			return map[string]bool{}, nil
+		}
+		compiled[action] = true
+	}
+	return compiled, nil
+}
+
+// parseEffect converts the effect of a rule, allow is the default.
+func parseEffect(effect string) (Permission, error) {
+	switch effect {
+	case "", "allow":
+		return PermissionAllow, nil
+	case "deny":
+		return PermissionDeny, nil
+	}
+	return PermissionNone, fmt.Errorf("unknown effect %s", effect)
+}
+
+// compilePolicy validates the policy file.
+func compilePolicy(file *PolicyFile) (*policy, error) {
+	hierarchy := RoleHierarchy(file.Roles)
+	if hierarchy == nil {
+		hierarchy = RoleHierarchy{}
+	}
+	if err := hierarchy.checkCycles(); err != nil {
+		return nil, err
+	}
+
+	compiled := &policy{
+		roles: hierarchy,
+		rules: make([]policyRule, 0, len(file.Rules)),
+	}
+	for i, rule := range file.Rules {
+		target, err := compileRuleTarget(wamp.URI(rule.URI), rule.Match, rule.Actions)
+		if err != nil {
+			return nil, fmt.Errorf("Rule %d: %v", i, err)
+		}
+		if len(rule.Roles) == 0 {
+			return nil, fmt.Errorf("Rule %d: no roles given", i)
+		}
+		effect, err := parseEffect(rule.Effect)
+		if err != nil {
+			return nil, fmt.Errorf("Rule %d: %v", i, err)
+		}
+
+		compiledRule := policyRule{
+			ruleTarget: target,
+			roles:      make(map[string]bool),
+			effect:     effect,
+		}
+		for _, role := range rule.Roles {
+			compiledRule.roles[role] = true
+		}
+		compiled.rules = append(compiled.rules, compiledRule)
+	}
+	return compiled, nil
+}
+
+// Load reads and validates the policy file. If it is invalid, the previous
+// policy stays active.
+func (this *PolicyAuthorizer) Load() error {
+	info, err := os.Stat(this.Path)
+	if err != nil {
+		return err
+	}
+	file := &PolicyFile{}
+	if err := readRuleFile(this.Path, file); err != nil {
+		return fmt.Errorf("Failed to read policy file %s: %v", this.Path, err)
+	}
+	compiled, err := compilePolicy(file)
+	if err != nil {
+		return fmt.Errorf("Invalid policy file %s: %v", this.Path, err)
+	}
+	this.modTime, this.size = info.ModTime(), info.Size()
+	this.policy.Store(compiled)
+	util.Logger.Infof("Loaded %d rules from policy file %s", len(compiled.rules), this.Path)
+	return nil
+}
+
+// changed reports whether the policy file was modified since the last load.
+func (this *PolicyAuthorizer) changed() bool {
+	info, err := os.Stat(this.Path)
+	if err != nil {
+		return false
+	}
+	return !info.ModTime().Equal(this.modTime) || info.Size() != this.size
+}
+
+// Watch reloads the policy file on SIGHUP and whenever it changes, until
+// Close is called.
+func (this *PolicyAuthorizer) Watch() {
+	reloader{
+		name:     "policy file " + this.Path,
+		load:     this.Load,
+		loaded:   true,
+		interval: this.PollInterval,
+		changed:  this.changed,
+		hangup:   true,
+	}.run(this.done)
+}
+
+// Close stops Watch.
+func (this *PolicyAuthorizer) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.done)
+	})
+	return nil
+}
+
+// matches reports whether the rule applies to action on uri. Rules for all
+// actions do not apply to the meta API.
+func (r *ruleTarget) matches(uri wamp.URI, action string) bool {
+	if len(r.actions) > 0 && !r.actions[action] || len(r.actions) == 0 && action == featureActionMeta {
+		return false
+	}
+	switch r.match {
+	case wamp.MatchPrefix:
+		return uri.PrefixMatch(r.uri)
+	case wamp.MatchWildcard:
+		return uri.WildcardMatch(r.uri)
+	}
+	return uri == r.uri
+}
+
+// permission returns the permission of role for action on uri and the
+// authrole it was taken from. A deny rule wins over an allow rule, rules of
+// inherited authroles only apply if the authrole has no own rule.
+func (p *policy) permission(uri wamp.URI, role string, action string) (Permission, string) {
+	return p.roles.resolve(role, func(role string) Permission {
+		result := PermissionNone
+		for i := range p.rules {
+			rule := &p.rules[i]
+			if !rule.roles[role] && !rule.roles["*"] || !rule.matches(uri, action) {
+				continue
+			}
+			if rule.effect == PermissionDeny {
+				return PermissionDeny
+			}
+			result = PermissionAllow
+		}
+		return result
+	})
+}
+
+// explainRule describes the rule of the authrole from, which decided about
+// action on uri for the authrole role.
+func (p *policy) explainRule(uri wamp.URI, role string, from string, action string) wamp.Dict {
+	res := wamp.Dict{
+		"authrole": role,
+		"from":     from,
+	}
+	decisive := -1
+	for i := range p.rules {
+		rule := &p.rules[i]
+		if !rule.roles[from] && !rule.roles["*"] || !rule.matches(uri, action) {
+			continue
+		}
+		if decisive < 0 || rule.effect == PermissionDeny {
+			decisive = i
+		}
+		if rule.effect == PermissionDeny {
+			break
+		}
+	}
+	if decisive >= 0 {
+		res["rule"] = decisive
+		res["uri"] = p.rules[decisive].uri
+		res["match"] = p.rules[decisive].match
+	}
+	return res
+}
+
+// Authorize permits or denies msg, if no rule applies PermitDefault is used.
+func (this *PolicyAuthorizer) Authorize(sess *wamp.Session, msg wamp.Message) (bool, error) {
+	decision, err := this.Decide(sess, msg)
+	return decision.Permitted(this.PermitDefault), err
+}
+
+// Decide abstains if no rule applies to msg.
+func (this *PolicyAuthorizer) Decide(sess *wamp.Session, msg wamp.Message) (multiauthorizer.Decision, error) {
+	return this.decide(sess, msg, nil), nil
+}
+
+// Explain returns the decision and the rule it was taken from.
+func (this *PolicyAuthorizer) Explain(sess *wamp.Session, msg wamp.Message) multiauthorizer.Explanation {
+	details := wamp.Dict{}
+	decision := this.decide(sess, msg, details)
+	return multiauthorizer.Explanation{
+		Decision:  decision,
+		Permitted: decision.Permitted(this.PermitDefault),
+		Details:   details,
+	}
+}
+
+// decide makes the decision, the reasons are added to details if it is not
+// nil.
+func (this *PolicyAuthorizer) decide(sess *wamp.Session, msg wamp.Message, details wamp.Dict) multiauthorizer.Decision {
+	roles, err := extractAuthRoles(sess.Details["authrole"])
+	if err != nil {
+		return multiauthorizer.Abstain
+	}
+
+	isTrustedAuthRole := roles.checkTrustedAuthRoles(this.TrustedAuthRoles)
+	if details != nil {
+		details["trusted"] = isTrustedAuthRole
+	}
+	if isTrustedAuthRole {
+		return multiauthorizer.Permit
+	}
+
+	uri, action := resolveMessageAction(sess, msg)
+	if action == "" {
+		// Like the feature authorizer, all other messages are required by
+		// nexus to function correctly.
+		return multiauthorizer.Permit
+	}
+
+	current := this.policy.Load().(*policy)
+
+	isAllowed := false
+	var allowedBy wamp.List
+	for _, authRole := range *roles {
+		switch permission, from := current.permission(uri, authRole, action); permission {
+		case PermissionDeny:
+			util.Logger.Debugf("%v on %v denied by policy for authrole %v", action, uri, authRole)
+			if details != nil {
+				details["denied_by"] = current.explainRule(uri, authRole, from, action)
+			}
+			return multiauthorizer.Deny
+		case PermissionAllow:
+			isAllowed = true
+			if details != nil {
+				allowedBy = append(allowedBy, current.explainRule(uri, authRole, from, action))
+			}
+		}
+	}
+
+	if isAllowed {
+		if details != nil {
+			details["allowed_by"] = allowedBy
+		}
+		return multiauthorizer.Permit
+	}
+
+	return multiauthorizer.Abstain
+}
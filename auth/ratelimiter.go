@@ -0,0 +1,364 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EmbeddedEnterprises/autobahnkreuz/auth/multiauthorizer"
+	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
+
+	mapset "github.com/deckarep/golang-set"
+
+	"github.com/gammazero/nexus/v3/client"
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+const (
+	// ErrRateLimited is the error of actions exceeding a rate limit. nexus
+	// rejects them with wamp.error.authorization_failed, which carries it
+	// as argument.
+	ErrRateLimited wamp.URI = "ee.error.rate-limited"
+	// RateLimitUsageProcedure returns the current usage of the rate limits.
+	RateLimitUsageProcedure = "ee.ratelimit.usage"
+)
+
+// Scopes of rate limits, they define who shares a token bucket.
+const (
+	RateLimitScopeSession  = "session"
+	RateLimitScopeAuthID   = "authid"
+	RateLimitScopeAuthRole = "authrole"
+)
+
+// rateLimitSweepInterval is the time between two removals of full buckets.
+const rateLimitSweepInterval = time.Minute
+
+// RateLimitError is returned when an action exceeds a rate limit. Its error
+// string is ErrRateLimited, which nexus passes to the client as argument of
+// wamp.error.authorization_failed.
+type RateLimitError struct {
+	// Limit is the index of the exceeded limit.
+	Limit int
+	Scope string
+	Key   string
+}
+
+func (e *RateLimitError) Error() string {
+	return string(ErrRateLimited)
+}
+
+// RateLimitFile contains the rate limits, either in YAML or in JSON.
+type RateLimitFile struct {
+	Limits []RateLimit `json:"limits" yaml:"limits"`
+}
+
+// RateLimit allows Rate actions Per duration on URIs matching a pattern, with
+// bursts of up to Burst actions.
+type RateLimit struct {
+	// Scope is session, authid or authrole. Sessions with multiple authroles
+	// use the bucket of each authrole.
+	Scope string `json:"scope" yaml:"scope"`
+	// URI is the pattern of the URIs the limit applies to, it applies to all
+	// URIs if empty.
+	URI string `json:"uri" yaml:"uri"`
+	// Match is the WAMP match policy of URI, by default URIs with empty
+	// components are wildcard patterns and all others are exact.
+	Match string `json:"match" yaml:"match"`
+	// Actions are call, register, subscribe, publish, unsubscribe,
+	// unregister, cancel and meta, all of them but meta if empty or *.
+	Actions []string `json:"actions" yaml:"actions"`
+	Rate    float64  `json:"rate" yaml:"rate"`
+	// Per is a duration like 1s or 1m, 1s by default.
+	Per string `json:"per" yaml:"per"`
+	// Burst is the size of the bucket, by default Rate rounded up.
+	Burst int `json:"burst" yaml:"burst"`
+}
+
+// rateLimit is a validated RateLimit.
+type rateLimit struct {
+	ruleTarget
+	scope string
+	// rate is in tokens per second.
+	rate  float64
+	burst float64
+}
+
+type bucketKey struct {
+	limit int
+	key   string
+}
+
+// tokenBucket holds the tokens left at the time last.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a multiauthorizer.Decider limiting the rate of actions with
+// token buckets. It abstains as long as there are tokens left, so it has to
+// be combined with the other authorizers, and denies with a RateLimitError
+// afterwards. Actions of trusted authroles are not limited.
+type RateLimiter struct {
+	TrustedAuthRoles mapset.Set
+
+	limits  []rateLimit
+	mu      sync.Mutex
+	buckets map[bucketKey]*tokenBucket
+	// now returns the current time, it is replaced by tests.
+	now func() time.Time
+	// done stops the sweeper started by Initialize when closed.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// compileRateLimits validates the rate limits.
+func compileRateLimits(file *RateLimitFile) ([]rateLimit, error) {
+	limits := make([]rateLimit, 0, len(file.Limits))
+	for i, limit := range file.Limits {
+		var target ruleTarget
+		var err error
+		if limit.URI == "" && limit.Match == "" {
+			target.match = wamp.MatchPrefix
+			target.actions, err = compileRuleActions(limit.Actions)
+		} else {
+			target, err = compileRuleTarget(wamp.URI(limit.URI), limit.Match, limit.Actions)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Limit %d: %v", i, err)
+		}
+		switch limit.Scope {
+		case RateLimitScopeSession, RateLimitScopeAuthID, RateLimitScopeAuthRole:
+		default:
+			return nil, fmt.Errorf("Limit %d: unknown scope %s", i, limit.Scope)
+		}
+		per := time.Second
+		if limit.Per != "" {
+			per, err = time.ParseDuration(limit.Per)
+			if err != nil || per <= 0 {
+				return nil, fmt.Errorf("Limit %d: invalid duration %s", i, limit.Per)
+			}
+		}
+		if limit.Rate <= 0 || limit.Burst < 0 {
+			return nil, fmt.Errorf("Limit %d: rate and burst must be positive", i)
+		}
+		burst := float64(limit.Burst)
+		if burst == 0 {
+			burst = math.Ceil(limit.Rate)
+		}
+		limits = append(limits, rateLimit{
+			ruleTarget: target,
+			scope:      limit.Scope,
+			rate:       limit.Rate / per.Seconds(),
+			burst:      burst,
+		})
+	}
+	return limits, nil
+}
+
+// NewRateLimiter creates a rate limiter using the limits of the file at path.
+func NewRateLimiter(path string, trustedAuthRoles mapset.Set) (*RateLimiter, error) {
+	file := &RateLimitFile{}
+	if err := readRuleFile(path, file); err != nil {
+		return nil, fmt.Errorf("Failed to read rate limit file %s: %v", path, err)
+	}
+	limits, err := compileRateLimits(file)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid rate limit file %s: %v", path, err)
+	}
+	util.Logger.Infof("Loaded %d rate limits from %s", len(limits), path)
+	return newRateLimiter(limits, trustedAuthRoles), nil
+}
+
+func newRateLimiter(limits []rateLimit, trustedAuthRoles mapset.Set) *RateLimiter {
+	return &RateLimiter{
+		TrustedAuthRoles: trustedAuthRoles,
+		limits:           limits,
+		buckets:          make(map[bucketKey]*tokenBucket),
+		now:              time.Now,
+		done:             make(chan struct{}),
+	}
+}
+
+// Initialize registers RateLimitUsageProcedure and starts removing full
+// buckets, which are equal to new ones. The caller is disclosed, so only
+// trusted authroles can see the usage of others.
+func (l *RateLimiter) Initialize() {
+	err := util.LocalClient.Register(RateLimitUsageProcedure, l.usage, wamp.Dict{
+		wamp.OptDiscloseCaller: true,
+	})
+	if err != nil {
+		util.Logger.Warningf("Failed to register %s: %v", RateLimitUsageProcedure, err)
+	}
+	go func() {
+		ticker := time.NewTicker(rateLimitSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.done:
+				return
+			case <-ticker.C:
+				l.sweep(l.now())
+			}
+		}
+	}()
+}
+
+// Close stops removing full buckets.
+func (l *RateLimiter) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+// tokens returns the tokens of bucket at now.
+func (l *RateLimiter) tokens(bucket *tokenBucket, limit *rateLimit, now time.Time) float64 {
+	return math.Min(limit.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*limit.rate)
+}
+
+func (l *RateLimiter) sweep(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, bucket := range l.buckets {
+		if l.tokens(bucket, &l.limits[key.limit], now) >= l.limits[key.limit].burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// scopeKeys returns the buckets of the session in scope.
+func scopeKeys(sess *wamp.Session, roles *authRoles, scope string) []string {
+	switch scope {
+	case RateLimitScopeSession:
+		return []string{fmt.Sprint(sess.ID)}
+	case RateLimitScopeAuthID:
+		authid, _ := wamp.AsString(sess.Details["authid"])
+		return []string{authid}
+	}
+	return *roles
+}
+
+// Decide takes a token from every bucket msg is limited by. It abstains if
+// all of them have tokens left, otherwise it denies without taking any.
+func (l *RateLimiter) Decide(sess *wamp.Session, msg wamp.Message) (multiauthorizer.Decision, error) {
+	return l.decide(sess, msg, nil, true)
+}
+
+// Explain returns the decision and the exceeded limit without taking tokens.
+func (l *RateLimiter) Explain(sess *wamp.Session, msg wamp.Message) multiauthorizer.Explanation {
+	details := wamp.Dict{}
+	decision, err := l.decide(sess, msg, details, false)
+	return multiauthorizer.Explanation{
+		Decision:  decision,
+		Permitted: decision != multiauthorizer.Deny,
+		Err:       err,
+		Details:   details,
+	}
+}
+
+// decide makes the decision, the reasons are added to details if it is not
+// nil. Tokens are only taken if take is true.
+func (l *RateLimiter) decide(sess *wamp.Session, msg wamp.Message, details wamp.Dict, take bool) (multiauthorizer.Decision, error) {
+	roles, err := extractAuthRoles(sess.Details["authrole"])
+	if err != nil {
+		return multiauthorizer.Abstain, nil
+	}
+	isTrustedAuthRole := roles.checkTrustedAuthRoles(l.TrustedAuthRoles)
+	if details != nil {
+		details["trusted"] = isTrustedAuthRole
+	}
+	uri, action := resolveMessageAction(sess, msg)
+	if isTrustedAuthRole || action == "" {
+		return multiauthorizer.Abstain, nil
+	}
+
+	now := l.now()
+	var taken []*tokenBucket
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.limits {
+		limit := &l.limits[i]
+		if !limit.matches(uri, action) {
+			continue
+		}
+		for _, key := range scopeKeys(sess, roles, limit.scope) {
+			bucket, ok := l.buckets[bucketKey{i, key}]
+			if !ok {
+				bucket = &tokenBucket{tokens: limit.burst, last: now}
+				if take {
+					l.buckets[bucketKey{i, key}] = bucket
+				}
+			}
+			tokens := l.tokens(bucket, limit, now)
+			if tokens < 1 {
+				util.Logger.Debugf("%v on %v exceeds rate limit %d of %s %s", action, uri, i, limit.scope, key)
+				if details != nil {
+					details["limited_by"] = wamp.Dict{
+						"limit": i,
+						"scope": limit.scope,
+						"key":   key,
+					}
+				}
+				return multiauthorizer.Deny, &RateLimitError{Limit: i, Scope: limit.scope, Key: key}
+			}
+			if take {
+				bucket.tokens, bucket.last = tokens, now
+				taken = append(taken, bucket)
+			}
+		}
+	}
+	// The tokens are only taken if no limit is exceeded, so denied actions do
+	// not count.
+	for _, bucket := range taken {
+		bucket.tokens -= 1
+	}
+	return multiauthorizer.Abstain, nil
+}
+
+// usage returns the buckets in use, optionally only those of a
+// scope (keyword argument `scope`) and key (`key`). It may only be called by
+// trusted authroles.
+func (l *RateLimiter) usage(_ context.Context, invk *wamp.Invocation) client.InvokeResult {
+	if !trustedCaller(invk, l.TrustedAuthRoles) {
+		return client.InvokeResult{Err: wamp.ErrNotAuthorized}
+	}
+	scope := wamp.OptionString(invk.ArgumentsKw, "scope")
+	key := wamp.OptionString(invk.ArgumentsKw, "key")
+
+	now := l.now()
+	l.mu.Lock()
+	result := wamp.List{}
+	for bucketKey, bucket := range l.buckets {
+		limit := &l.limits[bucketKey.limit]
+		if scope != "" && limit.scope != scope || key != "" && bucketKey.key != key {
+			continue
+		}
+		result = append(result, wamp.Dict{
+			"limit":  bucketKey.limit,
+			"scope":  limit.scope,
+			"key":    bucketKey.key,
+			"uri":    limit.uri,
+			"match":  limit.match,
+			"tokens": l.tokens(bucket, limit, now),
+			"burst":  limit.burst,
+			"rate":   limit.rate,
+		})
+	}
+	l.mu.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i].(wamp.Dict), result[j].(wamp.Dict)
+		if a["limit"] != b["limit"] {
+			return a["limit"].(int) < b["limit"].(int)
+		}
+		return a["key"].(string) < b["key"].(string)
+	})
+	return client.InvokeResult{
+		Args: wamp.List{
+			result,
+		},
+	}
+}
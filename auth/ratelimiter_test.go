@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/EmbeddedEnterprises/autobahnkreuz/auth/multiauthorizer"
+	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
+
+	mapset "github.com/deckarep/golang-set"
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// testRateLimiter creates a rate limiter using limits and a clock which is
+// advanced by the returned function.
+func testRateLimiter(t *testing.T, limits ...RateLimit) (*RateLimiter, func(time.Duration)) {
+	util.Init()
+	compiled, err := compileRateLimits(&RateLimitFile{Limits: limits})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := newRateLimiter(compiled, mapset.NewSet("trusted"))
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time {
+		return now
+	}
+	return limiter, func(d time.Duration) {
+		now = now.Add(d)
+	}
+}
+
+func rateLimitSession(id wamp.ID, authid string, authrole interface{}) *wamp.Session {
+	return &wamp.Session{
+		ID: id,
+		Details: wamp.Dict{
+			"authid":   authid,
+			"authrole": authrole,
+		},
+	}
+}
+
+func TestRateLimiterRefillAndBurst(t *testing.T) {
+	limiter, advance := testRateLimiter(t, RateLimit{Scope: RateLimitScopeSession, Rate: 2, Per: "1s", Burst: 3})
+	sess := rateLimitSession(1, "alice", "user")
+	msg := &wamp.Call{Procedure: "com.app.test"}
+
+	steps := []struct {
+		advance  time.Duration
+		expected []multiauthorizer.Decision
+	}{
+		// The bucket starts full.
+		{0, []multiauthorizer.Decision{multiauthorizer.Abstain, multiauthorizer.Abstain, multiauthorizer.Abstain, multiauthorizer.Deny}},
+		// Half a second refills one token.
+		{500 * time.Millisecond, []multiauthorizer.Decision{multiauthorizer.Abstain, multiauthorizer.Deny}},
+		// A quarter second refills half a token, which is not enough.
+		{250 * time.Millisecond, []multiauthorizer.Decision{multiauthorizer.Deny}},
+		{250 * time.Millisecond, []multiauthorizer.Decision{multiauthorizer.Abstain, multiauthorizer.Deny}},
+		// The bucket never holds more than the burst.
+		{time.Minute, []multiauthorizer.Decision{multiauthorizer.Abstain, multiauthorizer.Abstain, multiauthorizer.Abstain, multiauthorizer.Deny}},
+	}
+	for i, step := range steps {
+		advance(step.advance)
+		for j, expected := range step.expected {
+			decision, err := limiter.Decide(sess, msg)
+			if decision != expected {
+				t.Errorf("Step %d, action %d: expected %v, got %v", i, j, expected, decision)
+			}
+			if _, limited := err.(*RateLimitError); limited != (expected == multiauthorizer.Deny) {
+				t.Errorf("Step %d, action %d: unexpected error %v", i, j, err)
+			}
+		}
+	}
+}
+
+func TestRateLimiterDeniedActionsTakeNoTokens(t *testing.T) {
+	limiter, _ := testRateLimiter(t,
+		RateLimit{Scope: RateLimitScopeSession, Rate: 5},
+		RateLimit{Scope: RateLimitScopeSession, URI: "com.app.limited", Rate: 1},
+	)
+	sess := rateLimitSession(1, "alice", "user")
+	limited := &wamp.Call{Procedure: "com.app.limited"}
+	other := &wamp.Call{Procedure: "com.app.other"}
+
+	if decision, _ := limiter.Decide(sess, limited); decision != multiauthorizer.Abstain {
+		t.Fatalf("First action: expected abstain, got %v", decision)
+	}
+	for i := 0; i < 3; i++ {
+		if decision, _ := limiter.Decide(sess, limited); decision != multiauthorizer.Deny {
+			t.Fatalf("Limited action: expected deny, got %v", decision)
+		}
+	}
+	// Only the first action took a token from the limit for all URIs.
+	for i := 0; i < 4; i++ {
+		if decision, _ := limiter.Decide(sess, other); decision != multiauthorizer.Abstain {
+			t.Fatalf("Action %d: expected abstain, got %v", i, decision)
+		}
+	}
+	if decision, _ := limiter.Decide(sess, other); decision != multiauthorizer.Deny {
+		t.Fatalf("Last action: expected deny, got %v", decision)
+	}
+}
+
+func TestRateLimiterScopeKeys(t *testing.T) {
+	cases := []struct {
+		scope string
+		// second is the session acting after first used up the bucket.
+		first, second *wamp.Session
+		expected      multiauthorizer.Decision
+	}{
+		{RateLimitScopeSession, rateLimitSession(1, "alice", "user"), rateLimitSession(1, "alice", "user"), multiauthorizer.Deny},
+		{RateLimitScopeSession, rateLimitSession(1, "alice", "user"), rateLimitSession(2, "alice", "user"), multiauthorizer.Abstain},
+		{RateLimitScopeAuthID, rateLimitSession(1, "alice", "user"), rateLimitSession(2, "alice", "admin"), multiauthorizer.Deny},
+		{RateLimitScopeAuthID, rateLimitSession(1, "alice", "user"), rateLimitSession(2, "bob", "user"), multiauthorizer.Abstain},
+		{RateLimitScopeAuthRole, rateLimitSession(1, "alice", "user"), rateLimitSession(2, "bob", "user"), multiauthorizer.Deny},
+		{RateLimitScopeAuthRole, rateLimitSession(1, "alice", "user"), rateLimitSession(2, "bob", "admin"), multiauthorizer.Abstain},
+		// Sessions with multiple authroles use the bucket of each authrole.
+		{RateLimitScopeAuthRole, rateLimitSession(1, "alice", "user"), rateLimitSession(2, "bob", wamp.List{"admin", "user"}), multiauthorizer.Deny},
+		// Trusted authroles are not limited.
+		{RateLimitScopeAuthID, rateLimitSession(1, "alice", "user"), rateLimitSession(2, "alice", "trusted"), multiauthorizer.Abstain},
+	}
+	msg := &wamp.Publish{Topic: "com.app.test"}
+	for i, c := range cases {
+		limiter, _ := testRateLimiter(t, RateLimit{Scope: c.scope, Rate: 1})
+		if decision, _ := limiter.Decide(c.first, msg); decision != multiauthorizer.Abstain {
+			t.Errorf("Case %d: first action: expected abstain, got %v", i, decision)
+		}
+		if decision, _ := limiter.Decide(c.second, msg); decision != c.expected {
+			t.Errorf("Case %d: second action: expected %v, got %v", i, c.expected, decision)
+		}
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	limiter, advance := testRateLimiter(t, RateLimit{Scope: RateLimitScopeSession, Rate: 1, Per: "1m", Burst: 2})
+	msg := &wamp.Call{Procedure: "com.app.test"}
+	limiter.Decide(rateLimitSession(1, "alice", "user"), msg)
+	advance(30 * time.Second)
+	limiter.Decide(rateLimitSession(2, "bob", "user"), msg)
+
+	// The bucket of session 1 is full again, the one of session 2 is not.
+	advance(30 * time.Second)
+	limiter.sweep(limiter.now())
+	if len(limiter.buckets) != 1 {
+		t.Fatalf("Expected 1 bucket, got %d", len(limiter.buckets))
+	}
+	if _, ok := limiter.buckets[bucketKey{0, "2"}]; !ok {
+		t.Error("The bucket of session 2 was removed")
+	}
+
+	advance(30 * time.Second)
+	limiter.sweep(limiter.now())
+	if len(limiter.buckets) != 0 {
+		t.Errorf("Expected no buckets, got %d", len(limiter.buckets))
+	}
+}
+
+func TestRateLimiterUsageRequiresTrustedCaller(t *testing.T) {
+	limiter, _ := testRateLimiter(t, RateLimit{Scope: RateLimitScopeAuthID, Rate: 2})
+	limiter.Decide(rateLimitSession(1, "alice", "user"), &wamp.Call{Procedure: "com.app.test"})
+
+	res := limiter.usage(context.Background(), &wamp.Invocation{
+		Details: wamp.Dict{"caller_authrole": "user"},
+	})
+	if res.Err != wamp.ErrNotAuthorized {
+		t.Errorf("Untrusted caller: expected %v, got %v", wamp.ErrNotAuthorized, res.Err)
+	}
+	res = limiter.usage(context.Background(), &wamp.Invocation{
+		Details: wamp.Dict{"caller_authrole": "trusted"},
+	})
+	if res.Err != "" || len(res.Args) != 1 {
+		t.Fatalf("Trusted caller: unexpected result %v", res)
+	}
+	if buckets, _ := wamp.AsList(res.Args[0]); len(buckets) != 1 {
+		t.Errorf("Expected 1 bucket, got %v", res.Args[0])
+	}
+}
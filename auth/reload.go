@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
+)
+
+const (
+	reloadInitialBackoff = time.Second
+	reloadMaxBackoff     = time.Minute
+)
+
+// reloader keeps the rules of an authorizer up to date.
+type reloader struct {
+	// name describes the rules in log messages.
+	name string
+	load func() error
+	// loaded is set if the rules were loaded before, otherwise they are
+	// loaded until they are available, as the providers may register their
+	// functions after the router started.
+	loaded bool
+	// interval is the time between two periodic reloads, 0 disables them.
+	interval time.Duration
+	// changed decides whether a periodic reload is needed, the rules are
+	// always reloaded if it is nil.
+	changed func() bool
+	// hangup reloads the rules on SIGHUP as well.
+	hangup bool
+}
+
+// run loads the rules until done is closed.
+func (r reloader) run(done <-chan struct{}) {
+	for backoff := reloadInitialBackoff; !r.loaded; {
+		err := r.load()
+		if err == nil {
+			break
+		}
+		util.Logger.Warningf("Initial load of %s failed, retrying in %v: %v", r.name, backoff, err)
+		select {
+		case <-done:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > reloadMaxBackoff {
+			backoff = reloadMaxBackoff
+		}
+	}
+
+	var hangup chan os.Signal
+	if r.hangup {
+		hangup = make(chan os.Signal, 1)
+		signal.Notify(hangup, syscall.SIGHUP)
+		defer signal.Stop(hangup)
+	}
+	var refresh <-chan time.Time
+	if r.interval > 0 {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		refresh = ticker.C
+	}
+	if hangup == nil && refresh == nil {
+		return
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-hangup:
+			util.Logger.Infof("SIGHUP received, reloading %s", r.name)
+		case <-refresh:
+			if r.changed != nil {
+				if !r.changed() {
+					continue
+				}
+				util.Logger.Infof("%s changed, reloading", r.name)
+			}
+		}
+		if err := r.load(); err != nil {
+			util.Logger.Warningf("Failed to reload %s, keeping the previous version: %v", r.name, err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
+)
+
+// runReloader runs r until stop is closed and fails if it does not return
+// afterwards.
+func runReloader(t *testing.T, r reloader, stop func(done chan struct{})) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		r.run(done)
+		close(finished)
+	}()
+	stop(done)
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("The reloader did not stop")
+	}
+}
+
+func TestReloaderStopsWhileRetrying(t *testing.T) {
+	util.Init()
+	var loads int32
+	runReloader(t, reloader{
+		name: "test rules",
+		load: func() error {
+			atomic.AddInt32(&loads, 1)
+			return errors.New("unavailable")
+		},
+		interval: time.Millisecond,
+	}, func(done chan struct{}) {
+		time.Sleep(10 * time.Millisecond)
+		close(done)
+	})
+	if loads != 1 {
+		t.Errorf("Expected 1 load within the first backoff, got %d", loads)
+	}
+}
+
+func TestReloaderReloadsChangedRules(t *testing.T) {
+	util.Init()
+	var loads, checks int32
+	runReloader(t, reloader{
+		name: "test rules",
+		load: func() error {
+			atomic.AddInt32(&loads, 1)
+			return nil
+		},
+		loaded:   true,
+		interval: time.Millisecond,
+		changed: func() bool {
+			// Every second check reports a change.
+			return atomic.AddInt32(&checks, 1)%2 == 0
+		},
+	}, func(done chan struct{}) {
+		for atomic.LoadInt32(&checks) < 10 {
+			time.Sleep(time.Millisecond)
+		}
+		close(done)
+	})
+	if l, c := atomic.LoadInt32(&loads), atomic.LoadInt32(&checks); l != c/2 {
+		t.Errorf("Expected %d loads for %d checks, got %d", c/2, c, l)
+	}
+}
+
+func TestReloaderWithoutTriggers(t *testing.T) {
+	util.Init()
+	var loads int32
+	// Without interval and SIGHUP, the rules are loaded once.
+	runReloader(t, reloader{
+		name: "test rules",
+		load: func() error {
+			atomic.AddInt32(&loads, 1)
+			return nil
+		},
+	}, func(chan struct{}) {})
+	if loads != 1 {
+		t.Errorf("Expected 1 load, got %d", loads)
+	}
+}
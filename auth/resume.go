@@ -6,6 +6,9 @@ import (
 	"encoding/hex"
 	"errors"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
@@ -23,9 +26,26 @@ func randomHex(n int) (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
-type token struct {
-	AuthID     string
-	ExpireDate time.Time
+// ResumeTokenPolicy determines the lifetime and the number of resume tokens.
+type ResumeTokenPolicy struct {
+	// Lifetime is the absolute lifetime of a token after it was issued.
+	Lifetime time.Duration
+	// IdleLifetime invalidates tokens which were not used for the given time,
+	// zero disables the idle lifetime. For tokens which are not rotated, every
+	// use extends the lifetime up to the absolute lifetime.
+	IdleLifetime time.Duration
+	// Rotate determines whether a token is replaced by a new one on every use.
+	Rotate bool
+	// MaxPerAuthID is the maximum number of active tokens per authid, the
+	// oldest tokens are removed when it is exceeded. Zero means no limit.
+	MaxPerAuthID int
+}
+
+// DefaultResumeTokenPolicy issues tokens valid for one week which are rotated
+// on every use.
+var DefaultResumeTokenPolicy = ResumeTokenPolicy{
+	Lifetime: 7 * 24 * time.Hour,
+	Rotate:   true,
 }
 
 // ResumeAuthenticator is an authenticator which performs authentication based
@@ -33,12 +53,43 @@ type token struct {
 // It is designed to be used with the normal ticket authenticator.
 type ResumeAuthenticator struct {
 	SharedSecretAuthenticator
-	// Map from token -> Token
-	Tokens map[string]token
+	// Tokens stores the issued tokens, indexed by the token itself
+	Tokens TokenStore
+	// SweepInterval determines how often expired tokens are removed from the
+	// store, zero disables the sweeper.
+	SweepInterval time.Duration
+	// Policy determines the lifetime and the number of tokens.
+	Policy ResumeTokenPolicy
+	// Signer is used to issue stateless tokens, which are valid on all
+	// replicas sharing the same key set. When set, the token store is only
+	// used to remember the used tokens.
+	Signer *TokenSigner
+	// UpstreamConsumeFunc is called for every used stateless token to share
+	// the used tokens with other replicas, it has to return false if the
+	// token was used or revoked before.
+	UpstreamConsumeFunc string
+	// UpstreamRevokeFunc is called for every revocation of stateless tokens
+	// to share it with other replicas, so UpstreamConsumeFunc rejects the
+	// revoked tokens on all replicas.
+	UpstreamRevokeFunc string
+	// TrustedAuthRoles may call the token management procedures.
+	TrustedAuthRoles mapset.Set
+
+	// mu serializes compound operations on the token store, like listing and
+	// deleting tokens or reading and updating a token. Single operations are
+	// synchronized by the store itself. Upstream calls must never be made
+	// while holding mu.
+	mu sync.Mutex
+	// done stops the goroutines started by Initialize when closed.
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 // NewResumeAuthenticator creates a new ResumeAuthenticator based on the given parameters
-func NewResumeAuthenticator(authrolefunc string, realm string, invalidRoles mapset.Set) (*ResumeAuthenticator, error) {
+func NewResumeAuthenticator(authrolefunc string, realm string, invalidRoles mapset.Set, store TokenStore, sweepInterval time.Duration, policy ResumeTokenPolicy) (*ResumeAuthenticator, error) {
+	if policy.Lifetime <= 0 {
+		return nil, errors.New("The resume token lifetime has to be positive")
+	}
 	x := &ResumeAuthenticator{
 		SharedSecretAuthenticator: SharedSecretAuthenticator{
 			AuthMethodValue:          "resume",
@@ -46,12 +97,16 @@ func NewResumeAuthenticator(authrolefunc string, realm string, invalidRoles maps
 			Realm:                    realm,
 			UpstreamGetAuthRolesFunc: authrolefunc,
 		},
-		Tokens: make(map[string]token),
+		Tokens:        store,
+		SweepInterval: sweepInterval,
+		Policy:        policy,
+		done:          make(chan struct{}),
 	}
 	return x, nil
 }
 
-// Initialize registers the create-new-token-endpoint
+// Initialize registers the create-new-token-endpoint and the token management
+// endpoints, which may only be called by trusted authroles
 func (r *ResumeAuthenticator) Initialize() {
 	// Patched to ee to be similar to featureAuthorizer.
 	err := util.LocalClient.Register("ee.auth.create-token", r.createNewToken, wamp.Dict{})
@@ -59,8 +114,262 @@ func (r *ResumeAuthenticator) Initialize() {
 		util.Logger.Criticalf("Failed to register create-token method!")
 		os.Exit(1)
 	}
+	procedures := map[string]client.InvocationHandler{
+		"ee.auth.list-tokens":              r.listTokens,
+		"ee.auth.revoke-token":             r.revokeToken,
+		"ee.auth.revoke-tokens-for-authid": r.revokeTokensForAuthID,
+	}
+	for procedure, handler := range procedures {
+		// The caller is disclosed, so only trusted authroles can manage the
+		// tokens of others.
+		err := util.LocalClient.Register(procedure, r.trustedOnly(handler), wamp.Dict{
+			wamp.OptDiscloseCaller: true,
+		})
+		if err != nil {
+			util.Logger.Criticalf("Failed to register %s method: %v", procedure, err)
+			os.Exit(1)
+		}
+	}
+	if r.SweepInterval > 0 {
+		go r.sweepExpiredTokens()
+	}
+	if r.Signer != nil {
+		go r.Signer.Watch(30*time.Second, r.done)
+	}
+}
+
+// trustedOnly rejects invocations of handler by callers without a trusted
+// authrole.
+func (r *ResumeAuthenticator) trustedOnly(handler client.InvocationHandler) client.InvocationHandler {
+	return func(ctx context.Context, invk *wamp.Invocation) client.InvokeResult {
+		if !trustedCaller(invk, r.TrustedAuthRoles) {
+			return client.InvokeResult{Err: wamp.ErrNotAuthorized}
+		}
+		return handler(ctx, invk)
+	}
+}
+
+// Close stops the goroutines started by Initialize and closes the token
+// store.
+func (r *ResumeAuthenticator) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+	return r.Tokens.Close()
+}
+
+// sweepExpiredTokens periodically removes expired tokens from the store,
+// otherwise tokens which are never presented again would stay forever.
+func (r *ResumeAuthenticator) sweepExpiredTokens() {
+	ticker := time.NewTicker(r.SweepInterval)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-r.done:
+			return
+		case now = <-ticker.C:
+		}
+		count, err := r.Tokens.DeleteExpired(now)
+		if err != nil {
+			util.Logger.Warningf("Failed to remove expired resume tokens: %v", err)
+			continue
+		}
+		if r.Policy.IdleLifetime > 0 {
+			count += r.deleteIdleTokens(now)
+		}
+		if count > 0 {
+			util.Logger.Debugf("Removed %d expired resume tokens", count)
+		}
+	}
+}
+
+// deleteIdleTokens removes all tokens which exceeded their idle lifetime.
+func (r *ResumeAuthenticator) deleteIdleTokens(now time.Time) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tokens, err := r.Tokens.List()
+	if err != nil {
+		util.Logger.Warningf("Failed to list resume tokens: %v", err)
+		return 0
+	}
+	count := 0
+	for key, t := range tokens {
+		if strings.Contains(key, ":") || !t.expired(r.Policy.IdleLifetime, now) {
+			continue
+		}
+		if err := r.Tokens.Delete(key); err != nil {
+			util.Logger.Warningf("Failed to remove resume token: %v", err)
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+// enforceTokenLimit removes the oldest tokens of authid until the configured
+// maximum number of tokens per authid is reached. r.mu has to be held.
+func (r *ResumeAuthenticator) enforceTokenLimit(authid string) error {
+	if r.Policy.MaxPerAuthID <= 0 {
+		return nil
+	}
+	tokens, err := r.Tokens.ListByAuthID(authid)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for key := range tokens {
+		if !strings.Contains(key, ":") {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) <= r.Policy.MaxPerAuthID {
+		return nil
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return tokens[keys[i]].Created.Before(tokens[keys[j]].Created)
+	})
+	for _, key := range keys[:len(keys)-r.Policy.MaxPerAuthID] {
+		if err := r.Tokens.Delete(key); err != nil {
+			return err
+		}
+		util.Logger.Infof("Evicted resume token %v of %v", key, authid)
+	}
+	return nil
 }
 
+// issueToken creates a new token for authid. Without a signer, the token is
+// random and stored in the token store, otherwise it is a signed, self
+// contained token which is valid on all replicas sharing the key set.
+func (r *ResumeAuthenticator) issueToken(authid string, peer string) (string, error) {
+	now := time.Now()
+	expires := now.Add(r.Policy.Lifetime)
+	if r.Signer != nil {
+		// Stateless tokens are always rotated, so the idle lifetime is
+		// equivalent to a shorter absolute lifetime.
+		if r.Policy.IdleLifetime > 0 && r.Policy.IdleLifetime < r.Policy.Lifetime {
+			expires = now.Add(r.Policy.IdleLifetime)
+		}
+		nonce, err := randomHex(16)
+		if err != nil {
+			return "", err
+		}
+		return r.Signer.Sign(authid, now, expires, nonce)
+	}
+
+	userToken, err := randomHex(64)
+	if err != nil {
+		return "", err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Only the hash is stored, so the store can not be used to resume
+	// sessions.
+	err = r.Tokens.Put(hashToken(userToken), Token{
+		AuthID:       authid,
+		ExpireDate:   expires,
+		Created:      now,
+		LastUsedPeer: peer,
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := r.enforceTokenLimit(authid); err != nil {
+		util.Logger.Warningf("Failed to enforce resume token limit for %v: %v", authid, err)
+	}
+	return userToken, nil
+}
+
+// redeemToken checks the given token and invalidates it if tokens are
+// rotated, so it can not be used again. Signed tokens are invalidated by
+// remembering their hash until they expire, and optionally by reporting it to
+// the upstream consume function, which shares the used tokens across all
+// replicas.
+func (r *ResumeAuthenticator) redeemToken(userToken string, peer string) (Token, error) {
+	if r.Signer == nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		key := hashToken(userToken)
+		var tokenObj Token
+		var ok bool
+		var err error
+		if r.Policy.Rotate {
+			tokenObj, ok, err = r.Tokens.Take(key)
+		} else {
+			tokenObj, ok, err = r.Tokens.Get(key)
+		}
+		if err != nil {
+			util.Logger.Warningf("Failed to read resume token: %v", err)
+			return Token{}, errors.New("wamp.error.internal-error")
+		}
+		now := time.Now()
+		if !ok || tokenObj.expired(r.Policy.IdleLifetime, now) {
+			return Token{}, errors.New("wamp.error.invalid-token")
+		}
+		if !r.Policy.Rotate {
+			tokenObj.LastUsed = now
+			tokenObj.LastUsedPeer = peer
+			if err := r.Tokens.Put(key, tokenObj); err != nil {
+				util.Logger.Warningf("Failed to update resume token: %v", err)
+			}
+		}
+		return tokenObj, nil
+	}
+
+	payload, err := r.Signer.Verify(userToken)
+	if err != nil {
+		util.Logger.Infof("Rejected resume token: %v", err)
+		return Token{}, errors.New("wamp.error.invalid-token")
+	}
+	tokenObj := Token{
+		AuthID:     payload.AuthID,
+		ExpireDate: time.Unix(payload.Expires, 0),
+		Created:    time.Unix(payload.Issued, 0),
+	}
+	if time.Now().After(tokenObj.ExpireDate) {
+		return Token{}, errors.New("wamp.error.invalid-token")
+	}
+	if r.isRevoked(tokenObj) {
+		util.Logger.Infof("Rejected revoked resume token for %v", payload.AuthID)
+		return Token{}, errors.New("wamp.error.invalid-token")
+	}
+
+	id := hashToken(userToken)
+	firstUse, err := r.Tokens.PutIfAbsent(usedTokenPrefix+id, tokenObj)
+	if err != nil {
+		util.Logger.Warningf("Failed to store used resume token: %v", err)
+		return Token{}, errors.New("wamp.error.internal-error")
+	}
+	if !firstUse {
+		util.Logger.Warningf("Resume token for %v was used twice", payload.AuthID)
+		return Token{}, errors.New("wamp.error.invalid-token")
+	}
+
+	if r.UpstreamConsumeFunc != "" {
+		res, err := callUpstream(context.Background(), r.UpstreamConsumeFunc, wamp.List{
+			r.Realm,
+			id,
+			payload.AuthID,
+			tokenObj.ExpireDate.UTC().Format(time.RFC3339),
+			tokenObj.Created.UTC().Format(time.RFC3339),
+		}, nil)
+		if err != nil {
+			warnUpstreamFailure(r.UpstreamConsumeFunc, err)
+			return Token{}, upstreamFailure(err, "wamp.error.internal-error")
+		}
+		if len(res.Arguments) == 0 {
+			return Token{}, errors.New("wamp.error.invalid-token")
+		}
+		if firstUse, ok := wamp.AsBool(res.Arguments[0]); !ok || !firstUse {
+			util.Logger.Warningf("Resume token for %v was already used on another replica", payload.AuthID)
+			return Token{}, errors.New("wamp.error.invalid-token")
+		}
+	}
+	return tokenObj, nil
+}
+
+// createNewToken creates a token for the authid given as first argument.
+// The address of the client may be passed as keyword argument `peer`.
 func (r *ResumeAuthenticator) createNewToken(_ context.Context, invk *wamp.Invocation) client.InvokeResult {
 	if invk == nil {
 		return client.InvokeResult{
@@ -79,16 +388,13 @@ func (r *ResumeAuthenticator) createNewToken(_ context.Context, invk *wamp.Invoc
 			Err: wamp.ErrInvalidArgument,
 		}
 	}
-	userToken, err := randomHex(64)
+	userToken, err := r.issueToken(authid, wamp.OptionString(invk.ArgumentsKw, "peer"))
 	if err != nil {
+		util.Logger.Warningf("Failed to create resume token: %v", err)
 		return client.InvokeResult{
 			Err: wamp.URI("wamp.error.internal-error"),
 		}
 	}
-	r.Tokens[userToken] = token{
-		AuthID:     authid,
-		ExpireDate: time.Now().Add(7 * 24 * time.Hour), // one week
-	}
 	return client.InvokeResult{
 		Args: wamp.List{
 			userToken,
@@ -126,28 +432,30 @@ func (r *ResumeAuthenticator) Authenticate(sid wamp.ID, details wamp.Dict, clien
 		return nil, errors.New(string(wamp.ErrProtocolViolation))
 	}
 
-	token := authRsp.Signature
-	tokenObj, ok := r.Tokens[token]
-	delete(r.Tokens, token)
-
-	if !ok || time.Now().After(tokenObj.ExpireDate) {
-		return nil, errors.New("wamp.error.invalid-token")
+	peer := peerAddress(details)
+	tokenObj, err := r.redeemToken(authRsp.Signature, peer)
+	if err != nil {
+		return nil, err
 	}
 
 	authid = tokenObj.AuthID
 	util.Logger.Infof("Token login for user %v", authid)
-	newTokenRes := r.createNewToken(context.Background(), &wamp.Invocation{
-		Arguments: wamp.List{
-			authid,
-		},
-	})
+	// Stateless tokens can not be updated, so they are always rotated.
+	newToken := authRsp.Signature
+	if r.Policy.Rotate || r.Signer != nil {
+		newToken, err = r.issueToken(authid, peer)
+		if err != nil {
+			util.Logger.Warningf("Failed to create resume token: %v", err)
+			return nil, errors.New("wamp.error.internal-error")
+		}
+	}
 
 	welcome, err := r.FetchAndFilterAuthRoles(authid)
 	if err != nil {
 		return nil, err
 	}
 	x, _ := wamp.AsDict(welcome.Details["authextra"])
-	x["resume-token"] = newTokenRes.Args[0]
+	x["resume-token"] = newToken
 	welcome.Details["authextra"] = x
 	return welcome, nil
 }
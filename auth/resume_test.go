@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
+	mapset "github.com/deckarep/golang-set"
+
+	"github.com/gammazero/nexus/v3/client"
+	"github.com/gammazero/nexus/v3/router"
+	nexusauth "github.com/gammazero/nexus/v3/router/auth"
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+const testRealm = "test.realm"
+
+// setupResumeRouter starts an in-process router using the given resume
+// authenticator and connects util.LocalClient.
+func setupResumeRouter(t *testing.T, resume *ResumeAuthenticator) router.Router {
+	util.Init()
+	logger := log.New(ioutil.Discard, "", 0)
+	r, err := router.NewRouter(&router.Config{
+		RealmConfigs: []*router.RealmConfig{
+			{
+				URI: wamp.URI(testRealm),
+				// Local clients have to authenticate, so the resume clients
+				// are checked by the resume authenticator.
+				RequireLocalAuth: true,
+				// The token management procedures disclose their callers.
+				AllowDisclose: true,
+				Authenticators: []nexusauth.Authenticator{
+					AnonymousAuth{AuthRole: "trusted"},
+					resume,
+				},
+			},
+		},
+	}, logger)
+	if err != nil {
+		t.Fatalf("Failed to start router: %v", err)
+	}
+
+	util.LocalClient, err = client.ConnectLocal(r, client.Config{
+		Realm: testRealm,
+		HelloDetails: wamp.Dict{
+			"authmethods": wamp.List{"anonymous"},
+		},
+		Logger: logger,
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect local client: %v", err)
+	}
+	err = util.LocalClient.Register("test.get-roles", func(_ context.Context, _ *wamp.Invocation) client.InvokeResult {
+		return client.InvokeResult{
+			Args: wamp.List{wamp.List{"user"}},
+		}
+	}, wamp.Dict{})
+	if err != nil {
+		t.Fatalf("Failed to register role function: %v", err)
+	}
+	resume.Initialize()
+	return r
+}
+
+// resumeWith connects a new client using the given resume token and returns
+// the new token.
+func resumeWith(r router.Router, userToken string) (string, error) {
+	c, err := client.ConnectLocal(r, client.Config{
+		Realm: testRealm,
+		HelloDetails: wamp.Dict{
+			"authid": "resume",
+		},
+		AuthHandlers: map[string]client.AuthFunc{
+			"resume": func(_ *wamp.Challenge) (string, wamp.Dict) {
+				return userToken, wamp.Dict{}
+			},
+		},
+		Logger: log.New(ioutil.Discard, "", 0),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	authextra, _ := wamp.AsDict(c.RealmDetails()["authextra"])
+	newToken, _ := wamp.AsString(authextra["resume-token"])
+	return newToken, nil
+}
+
+func TestResumeConcurrentCreateAndResume(t *testing.T) {
+	resume, err := NewResumeAuthenticator("test.get-roles", testRealm, nil, NewMemoryTokenStore(), time.Millisecond, ResumeTokenPolicy{
+		Lifetime:     time.Hour,
+		IdleLifetime: time.Hour,
+		Rotate:       true,
+		MaxPerAuthID: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resume.TrustedAuthRoles = mapset.NewSet("trusted")
+	r := setupResumeRouter(t, resume)
+	defer r.Close()
+	defer resume.Close()
+	defer util.LocalClient.Close()
+
+	const workers = 16
+	const rounds = 10
+	var doubleUse int32
+	var resumed int32
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*rounds)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			authid := fmt.Sprintf("user-%d", w%4)
+			for i := 0; i < rounds; i++ {
+				res, err := util.LocalClient.Call(context.Background(), "ee.auth.create-token", nil, wamp.List{authid}, nil, nil)
+				if err != nil {
+					errs <- fmt.Errorf("create-token failed: %v", err)
+					return
+				}
+				userToken, _ := wamp.AsString(res.Arguments[0])
+
+				// Present the same token twice at the same time, exactly one
+				// of both attempts may succeed. Both may fail if the token
+				// was evicted by the per-authid limit in the meantime.
+				var inner sync.WaitGroup
+				var successes int32
+				for j := 0; j < 2; j++ {
+					inner.Add(1)
+					go func() {
+						defer inner.Done()
+						if newToken, err := resumeWith(r, userToken); err == nil && newToken != "" {
+							atomic.AddInt32(&successes, 1)
+						}
+					}()
+				}
+				inner.Wait()
+				atomic.AddInt32(&resumed, successes)
+				if successes > 1 {
+					atomic.AddInt32(&doubleUse, 1)
+				}
+				res, err = util.LocalClient.Call(context.Background(), "ee.auth.list-tokens", nil, wamp.List{authid}, nil, nil)
+				if err != nil {
+					errs <- fmt.Errorf("list-tokens failed: %v", err)
+					return
+				}
+				listed, _ := wamp.AsList(res.Arguments[0])
+				if len(listed) > resume.Policy.MaxPerAuthID {
+					errs <- fmt.Errorf("list-tokens returned %d tokens of %s, limit is %d", len(listed), authid, resume.Policy.MaxPerAuthID)
+				}
+				for _, entry := range listed {
+					metadata, _ := wamp.AsDict(entry)
+					if metadata["authid"] != authid {
+						errs <- fmt.Errorf("list-tokens for %s returned a token of %v", authid, metadata["authid"])
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if resumed == 0 {
+		t.Error("No client was able to resume its session")
+	}
+	if doubleUse > 0 {
+		t.Errorf("%d tokens were used more than once", doubleUse)
+	}
+
+	tokens, _ := resume.Tokens.List()
+	perAuthID := map[string]int{}
+	for _, tok := range tokens {
+		perAuthID[tok.AuthID]++
+	}
+	for authid, count := range perAuthID {
+		if count > resume.Policy.MaxPerAuthID {
+			t.Errorf("%s has %d tokens, limit is %d", authid, count, resume.Policy.MaxPerAuthID)
+		}
+	}
+}
+
+func TestResumeManagementRequiresTrustedCaller(t *testing.T) {
+	resume, err := NewResumeAuthenticator("test.get-roles", testRealm, nil, NewMemoryTokenStore(), 0, DefaultResumeTokenPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resume.TrustedAuthRoles = mapset.NewSet("trusted")
+	handler := resume.trustedOnly(resume.revokeTokensForAuthID)
+
+	cases := map[string]interface{}{
+		"user":           "user",
+		"no authrole":    nil,
+		"untrusted list": wamp.List{"user", "admin"},
+	}
+	for name, authrole := range cases {
+		res := handler(context.Background(), &wamp.Invocation{
+			Arguments: wamp.List{"alice"},
+			Details:   wamp.Dict{"caller_authrole": authrole},
+		})
+		if res.Err != wamp.ErrNotAuthorized {
+			t.Errorf("%s: expected %v, got %v", name, wamp.ErrNotAuthorized, res.Err)
+		}
+	}
+	res := handler(context.Background(), &wamp.Invocation{
+		Arguments: wamp.List{"alice"},
+		Details:   wamp.Dict{"caller_authrole": wamp.List{"user", "trusted"}},
+	})
+	if res.Err != "" {
+		t.Errorf("Trusted caller: expected no error, got %v", res.Err)
+	}
+}
@@ -0,0 +1,271 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
+
+	"github.com/gammazero/nexus/v3/client"
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+const (
+	// usedTokenPrefix marks the hashes of used stateless tokens in the store.
+	usedTokenPrefix = "used:"
+	// revokedAuthIDPrefix marks authids whose stateless tokens were revoked,
+	// all tokens issued before the marker was created are invalid.
+	revokedAuthIDPrefix = "revoked:"
+)
+
+// hashToken returns the identifier of a token which is safe to be displayed
+// and stored, as it can not be used to log in. Stored tokens are keyed by it.
+func hashToken(userToken string) string {
+	sum := sha256.Sum256([]byte(userToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// isRevoked checks whether all tokens of the authid were revoked after the
+// given stateless token was issued.
+func (r *ResumeAuthenticator) isRevoked(tokenObj Token) bool {
+	marker, ok, err := r.Tokens.Get(revokedAuthIDPrefix + tokenObj.AuthID)
+	if err != nil {
+		util.Logger.Warningf("Failed to read revoked resume tokens: %v", err)
+		return true
+	}
+	return ok && !tokenObj.Created.After(marker.Created)
+}
+
+func tokenMetadata(key string, t Token) wamp.Dict {
+	return wamp.Dict{
+		"id":      key,
+		"authid":  t.AuthID,
+		"created": t.Created.UTC().Format(time.RFC3339),
+		"expires": t.ExpireDate.UTC().Format(time.RFC3339),
+		"peer":    t.LastUsedPeer,
+	}
+}
+
+// listTokens returns the metadata of all stored tokens, optionally filtered
+// by the authid given as first argument.
+// Stateless tokens are not stored, so they can not be listed.
+func (r *ResumeAuthenticator) listTokens(_ context.Context, invk *wamp.Invocation) client.InvokeResult {
+	authid := ""
+	if len(invk.Arguments) > 0 {
+		authid, _ = wamp.AsString(invk.Arguments[0])
+	}
+	var tokens map[string]Token
+	var err error
+	if authid != "" {
+		tokens, err = r.Tokens.ListByAuthID(authid)
+	} else {
+		tokens, err = r.Tokens.List()
+	}
+	if err != nil {
+		util.Logger.Warningf("Failed to list resume tokens: %v", err)
+		return client.InvokeResult{
+			Err: wamp.URI("wamp.error.internal-error"),
+		}
+	}
+	result := wamp.List{}
+	for key, t := range tokens {
+		if strings.Contains(key, ":") {
+			continue
+		}
+		result = append(result, tokenMetadata(key, t))
+	}
+	return client.InvokeResult{
+		Args: wamp.List{
+			result,
+		},
+	}
+}
+
+// shareRevocation reports a revocation of stateless tokens to the upstream
+// revoke function, so the other replicas reject the tokens as well. id is the
+// hash of a single revoked token, all tokens of authid issued until the
+// revocation are revoked if it is empty. The revocation has to be remembered
+// until expires.
+func (r *ResumeAuthenticator) shareRevocation(ctx context.Context, id, authid string, expires time.Time) error {
+	if r.UpstreamRevokeFunc == "" {
+		return nil
+	}
+	var idArg interface{}
+	if id != "" {
+		idArg = id
+	}
+	_, err := callUpstream(ctx, r.UpstreamRevokeFunc, wamp.List{
+		r.Realm,
+		idArg,
+		authid,
+		expires.UTC().Format(time.RFC3339),
+	}, nil)
+	if err != nil {
+		warnUpstreamFailure(r.UpstreamRevokeFunc, err)
+	}
+	return err
+}
+
+// revokeToken invalidates a single token. The first argument is either the
+// hashed id or the token itself, for stored and stateless tokens alike.
+func (r *ResumeAuthenticator) revokeToken(ctx context.Context, invk *wamp.Invocation) client.InvokeResult {
+	if len(invk.Arguments) == 0 {
+		return client.InvokeResult{
+			Err: wamp.ErrInvalidArgument,
+		}
+	}
+	id, ok := wamp.AsString(invk.Arguments[0])
+	if !ok || id == "" {
+		return client.InvokeResult{
+			Err: wamp.ErrInvalidArgument,
+		}
+	}
+
+	if r.Signer != nil {
+		// Revoked tokens are marked as used. Without the token, its expiry is
+		// unknown, so the hash is remembered as long as any token is valid.
+		marker := Token{
+			ExpireDate: time.Now().Add(r.Policy.Lifetime),
+			Created:    time.Now(),
+		}
+		if payload, err := r.Signer.Verify(id); err == nil {
+			id = hashToken(id)
+			marker.AuthID = payload.AuthID
+			marker.ExpireDate = time.Unix(payload.Expires, 0)
+		} else if len(id) != 2*sha256.Size {
+			return client.InvokeResult{
+				Err: wamp.ErrInvalidArgument,
+			}
+		}
+		revoked, err := r.Tokens.PutIfAbsent(usedTokenPrefix+id, marker)
+		if err != nil {
+			util.Logger.Warningf("Failed to revoke resume token: %v", err)
+			return client.InvokeResult{
+				Err: wamp.URI("wamp.error.internal-error"),
+			}
+		}
+		if err := r.shareRevocation(ctx, id, marker.AuthID, marker.ExpireDate); err != nil {
+			return client.InvokeResult{
+				Err: wamp.URI("wamp.error.internal-error"),
+			}
+		}
+		return client.InvokeResult{
+			Args: wamp.List{revoked},
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range []string{id, hashToken(id)} {
+		if strings.Contains(key, ":") {
+			continue
+		}
+		if _, revoked, err := r.Tokens.Take(key); err != nil {
+			util.Logger.Warningf("Failed to revoke resume token: %v", err)
+			return client.InvokeResult{
+				Err: wamp.URI("wamp.error.internal-error"),
+			}
+		} else if revoked {
+			util.Logger.Infof("Revoked resume token %v", key)
+			return client.InvokeResult{
+				Args: wamp.List{true},
+			}
+		}
+	}
+	return client.InvokeResult{
+		Args: wamp.List{false},
+	}
+}
+
+// deleteTokensOf removes all stored tokens of authid and returns their number.
+func (r *ResumeAuthenticator) deleteTokensOf(authid string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tokens, err := r.Tokens.ListByAuthID(authid)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for key := range tokens {
+		if strings.Contains(key, ":") {
+			continue
+		}
+		if _, revoked, err := r.Tokens.Take(key); err != nil {
+			util.Logger.Warningf("Failed to revoke resume token: %v", err)
+		} else if revoked {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// revokeTokensForAuthID invalidates all tokens of the authid given as first
+// argument and returns the number of revoked tokens. If the keyword argument
+// `kill_sessions` is set, all sessions of the authid are killed as well.
+func (r *ResumeAuthenticator) revokeTokensForAuthID(ctx context.Context, invk *wamp.Invocation) client.InvokeResult {
+	if len(invk.Arguments) == 0 {
+		return client.InvokeResult{
+			Err: wamp.ErrInvalidArgument,
+		}
+	}
+	authid, ok := wamp.AsString(invk.Arguments[0])
+	if !ok || authid == "" {
+		return client.InvokeResult{
+			Err: wamp.ErrInvalidArgument,
+		}
+	}
+
+	count := 0
+	if r.Signer != nil {
+		// Stateless tokens can not be enumerated, so remember the time of
+		// revocation until all tokens issued before are expired.
+		now := time.Now()
+		err := r.Tokens.Put(revokedAuthIDPrefix+authid, Token{
+			AuthID:     authid,
+			ExpireDate: now.Add(r.Policy.Lifetime),
+			Created:    now,
+		})
+		if err != nil {
+			util.Logger.Warningf("Failed to revoke resume tokens: %v", err)
+			return client.InvokeResult{
+				Err: wamp.URI("wamp.error.internal-error"),
+			}
+		}
+		if err := r.shareRevocation(ctx, "", authid, now.Add(r.Policy.Lifetime)); err != nil {
+			return client.InvokeResult{
+				Err: wamp.URI("wamp.error.internal-error"),
+			}
+		}
+	} else {
+		var err error
+		count, err = r.deleteTokensOf(authid)
+		if err != nil {
+			util.Logger.Warningf("Failed to list resume tokens: %v", err)
+			return client.InvokeResult{
+				Err: wamp.URI("wamp.error.internal-error"),
+			}
+		}
+	}
+	util.Logger.Infof("Revoked %d resume tokens of %v", count, authid)
+
+	if wamp.OptionFlag(invk.ArgumentsKw, "kill_sessions") {
+		_, err := util.LocalClient.Call(ctx, string(wamp.MetaProcSessionKillByAuthid), nil, wamp.List{
+			authid,
+		}, wamp.Dict{
+			"reason":  "wamp.close.killed",
+			"message": "Resume tokens revoked",
+		}, nil)
+		if err != nil {
+			util.Logger.Warningf("Failed to kill sessions of %v: %v", authid, err)
+			return client.InvokeResult{
+				Err: wamp.URI("wamp.error.internal-error"),
+			}
+		}
+	}
+	return client.InvokeResult{
+		Args: wamp.List{count},
+	}
+}
@@ -0,0 +1,305 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// scheduleTimeLayouts are the accepted layouts of interval bounds, those
+// without a zone are in the timezone of the schedule.
+var scheduleTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// Schedule restricts a grant to validity intervals and recurring windows. It
+// is active at a time within any of the intervals and any of the windows,
+// missing intervals or windows do not restrict it.
+type Schedule struct {
+	location  *time.Location
+	intervals []timeInterval
+	windows   []*cronWindow
+	// source is the schedule as it was given, it is used to hash the matrix.
+	source interface{}
+}
+
+// timeInterval is valid from `from` until `until`, excluding `until`. A zero
+// bound is open.
+type timeInterval struct {
+	from  time.Time
+	until time.Time
+}
+
+// ParseSchedule reads a schedule, a dict with the optional keys `timezone`
+// (an IANA timezone, UTC by default), `valid` (a list of dicts with `from`
+// and `until`) and `windows` (a list of cron expressions).
+func ParseSchedule(raw interface{}) (*Schedule, error) {
+	scheduleRaw, ok := wamp.AsDict(raw)
+	if !ok || scheduleRaw == nil {
+		return nil, errors.New("Schedule is not a dictionary")
+	}
+	schedule := &Schedule{location: time.UTC, source: raw}
+	for key, value := range scheduleRaw {
+		switch key {
+		case "timezone", "valid", "windows":
+		default:
+			return nil, errors.New("Unknown schedule key " + key)
+		}
+		if value == nil {
+			return nil, errors.New("Schedule key " + key + " is null")
+		}
+	}
+
+	if timezoneRaw, ok := scheduleRaw["timezone"]; ok {
+		timezone, ok := wamp.AsString(timezoneRaw)
+		if !ok {
+			return nil, errors.New("Timezone is not a string")
+		}
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("Unknown timezone %s", timezone)
+		}
+		schedule.location = location
+	}
+
+	if validRaw, ok := scheduleRaw["valid"]; ok {
+		intervals, ok := wamp.AsList(validRaw)
+		if !ok {
+			return nil, errors.New("Validity intervals are not a list")
+		}
+		for _, intervalRaw := range intervals {
+			interval, err := schedule.parseInterval(intervalRaw)
+			if err != nil {
+				return nil, err
+			}
+			schedule.intervals = append(schedule.intervals, interval)
+		}
+	}
+
+	if windowsRaw, ok := scheduleRaw["windows"]; ok {
+		windows, ok := wamp.AsList(windowsRaw)
+		if !ok {
+			return nil, errors.New("Windows are not a list")
+		}
+		for _, windowRaw := range windows {
+			spec, ok := wamp.AsString(windowRaw)
+			if !ok {
+				return nil, errors.New("Window is not a string")
+			}
+			window, err := parseCronWindow(spec)
+			if err != nil {
+				return nil, err
+			}
+			schedule.windows = append(schedule.windows, window)
+		}
+	}
+	return schedule, nil
+}
+
+func (s *Schedule) parseInterval(raw interface{}) (timeInterval, error) {
+	intervalRaw, ok := wamp.AsDict(raw)
+	if !ok || intervalRaw == nil {
+		return timeInterval{}, errors.New("Validity interval is not a dictionary")
+	}
+	var interval timeInterval
+	for key, value := range intervalRaw {
+		var bound *time.Time
+		switch key {
+		case "from":
+			bound = &interval.from
+		case "until":
+			bound = &interval.until
+		default:
+			return timeInterval{}, errors.New("Unknown validity interval key " + key)
+		}
+		text, ok := wamp.AsString(value)
+		if !ok {
+			return timeInterval{}, fmt.Errorf("Validity interval %s is not a string", key)
+		}
+		parsed, err := s.parseTime(text)
+		if err != nil {
+			return timeInterval{}, err
+		}
+		*bound = parsed
+	}
+	if interval.from.IsZero() && interval.until.IsZero() {
+		return timeInterval{}, errors.New("Validity interval needs from or until")
+	}
+	if !interval.from.IsZero() && !interval.until.IsZero() && !interval.from.Before(interval.until) {
+		return timeInterval{}, errors.New("Validity interval ends before it starts")
+	}
+	return interval, nil
+}
+
+func (s *Schedule) parseTime(text string) (time.Time, error) {
+	for _, layout := range scheduleTimeLayouts {
+		if parsed, err := time.ParseInLocation(layout, text, s.location); err == nil {
+			return parsed, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid time %s", text)
+}
+
+// Active reports whether the schedule is active at now.
+func (s *Schedule) Active(now time.Time) bool {
+	if len(s.intervals) > 0 {
+		valid := false
+		for _, interval := range s.intervals {
+			if (interval.from.IsZero() || !now.Before(interval.from)) &&
+				(interval.until.IsZero() || now.Before(interval.until)) {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return false
+		}
+	}
+	if len(s.windows) == 0 {
+		return true
+	}
+	local := now.In(s.location)
+	for _, window := range s.windows {
+		if window.contains(local) {
+			return true
+		}
+	}
+	return false
+}
+
+// cronField is a set of values as bits.
+type cronField uint64
+
+func (f cronField) has(value int) bool {
+	return f&(1<<uint(value)) != 0
+}
+
+// cronWindow is a recurring window given as cron expression, it contains all
+// minutes matching the expression, e.g. `* 1-3 * * *` is the time from 01:00
+// to 03:59 every day.
+type cronWindow struct {
+	minute  cronField
+	hour    cronField
+	day     cronField
+	month   cronField
+	weekday cronField
+	// anyDay and anyWeekday are set for `*`, if both day and weekday are
+	// restricted, either of them has to match, like in cron.
+	anyDay     bool
+	anyWeekday bool
+}
+
+var cronMonths = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var cronWeekdays = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// parseCronWindow parses the five fields minute, hour, day of month, month
+// and day of week. Each field is `*` or a comma separated list of values and
+// ranges like `1-5`, optionally with a step like `*/15` or `0-30/10`. Months
+// and days of week can be given by their names, like `jan` and `mon`, Sunday
+// is 0 or 7.
+func parseCronWindow(spec string) (*cronWindow, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Window %s does not have 5 fields", spec)
+	}
+	window := &cronWindow{
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+	}
+	var err error
+	if window.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("Window %s: minute %v", spec, err)
+	}
+	if window.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("Window %s: hour %v", spec, err)
+	}
+	if window.day, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("Window %s: day of month %v", spec, err)
+	}
+	if window.month, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, fmt.Errorf("Window %s: month %v", spec, err)
+	}
+	if window.weekday, err = parseCronField(fields[4], 0, 7, cronWeekdays); err != nil {
+		return nil, fmt.Errorf("Window %s: day of week %v", spec, err)
+	}
+	if window.weekday.has(7) {
+		window.weekday |= 1
+	}
+	return window, nil
+}
+
+func parseCronField(field string, min, max int, names map[string]int) (cronField, error) {
+	var result cronField
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rangePart = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("has an invalid step in %s", part)
+			}
+		}
+		first, last := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if first, err = parseCronValue(bounds[0], names); err != nil {
+				return 0, err
+			}
+			last = first
+			if len(bounds) == 2 {
+				if last, err = parseCronValue(bounds[1], names); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				// Like in cron, `5/15` means every 15 from 5 on.
+				last = max
+			}
+		}
+		if first < min || last > max || first > last {
+			return 0, fmt.Errorf("is out of range %d-%d in %s", min, max, part)
+		}
+		for value := first; value <= last; value += step {
+			result |= 1 << uint(value)
+		}
+	}
+	return result, nil
+}
+
+func parseCronValue(text string, names map[string]int) (int, error) {
+	if value, ok := names[strings.ToLower(text)]; ok {
+		return value, nil
+	}
+	value, err := strconv.Atoi(text)
+	if err != nil {
+		return 0, fmt.Errorf("has an invalid value %s", text)
+	}
+	return value, nil
+}
+
+// contains reports whether the minute of t, which is in the timezone of the
+// schedule, matches the window.
+func (w *cronWindow) contains(t time.Time) bool {
+	if !w.minute.has(t.Minute()) || !w.hour.has(t.Hour()) || !w.month.has(int(t.Month())) {
+		return false
+	}
+	day, weekday := w.day.has(t.Day()), w.weekday.has(int(t.Weekday()))
+	if w.anyDay || w.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
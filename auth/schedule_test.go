@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+func TestScheduleActive(t *testing.T) {
+	schedule, err := ParseSchedule(wamp.Dict{
+		"timezone": "Europe/Berlin",
+		"valid": wamp.List{
+			wamp.Dict{"from": "2026-01-01", "until": "2026-07-01T00:00:00Z"},
+		},
+		"windows": wamp.List{"* 1-2 * * mon-fri", "0-29 12 1,15 * *"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]bool{
+		// Monday, 01:30 in Berlin.
+		"2026-03-02T00:30:00Z": true,
+		"2026-03-02T01:59:00Z": true,
+		"2026-03-02T02:00:00Z": false,
+		// Sunday.
+		"2026-03-01T00:30:00Z": false,
+		// The 15th, 12:10 in Berlin, summer time.
+		"2026-06-15T10:10:00Z": true,
+		"2026-06-15T10:30:00Z": false,
+		// Before and after the validity interval.
+		"2025-12-31T22:30:00Z": false,
+		"2026-12-01T00:30:00Z": false,
+	}
+	for text, expected := range cases {
+		now, _ := time.Parse(time.RFC3339, text)
+		if active := schedule.Active(now); active != expected {
+			t.Errorf("%s: expected %v, got %v", text, expected, active)
+		}
+	}
+}
+
+func TestScheduleInvalid(t *testing.T) {
+	cases := []wamp.Dict{
+		{"timezone": "Mars/Olympus"},
+		{"windows": wamp.List{"* * * *"}},
+		{"windows": wamp.List{"60 * * * *"}},
+		{"windows": wamp.List{"* 5-1 * * *"}},
+		{"windows": wamp.List{"*/0 * * * *"}},
+		{"windows": wamp.List{"* * * foo *"}},
+		{"valid": wamp.List{wamp.Dict{}}},
+		{"valid": wamp.List{wamp.Dict{"from": "2026-02-01", "until": "2026-01-01"}}},
+		{"valid": wamp.List{wamp.Dict{"from": "tomorrow"}}},
+		{"window": wamp.List{"* * * * *"}},
+	}
+	for _, raw := range cases {
+		if _, err := ParseSchedule(raw); err == nil {
+			t.Errorf("%v: expected an error", raw)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
+)
+
+// signedTokenPayload is the content of a stateless resume token.
+type signedTokenPayload struct {
+	AuthID  string `json:"aid"`
+	Expires int64  `json:"exp"`
+	Issued  int64  `json:"iat"`
+	Nonce   string `json:"nce"`
+	KeyID   string `json:"kid"`
+}
+
+// signingKey is a single key of a key set, either a shared HMAC secret or an
+// Ed25519 key pair. Retired Ed25519 keys may contain only the public key.
+type signingKey struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Secret  string `json:"secret"`
+	Private string `json:"private"`
+	Public  string `json:"public"`
+
+	hmacSecret []byte
+	privateKey ed25519.PrivateKey
+	publicKey  ed25519.PublicKey
+}
+
+// keySetFile is the on-disk format of the key set shared across replicas.
+type keySetFile struct {
+	Active string       `json:"active"`
+	Keys   []signingKey `json:"keys"`
+}
+
+// TokenSigner issues and verifies stateless resume tokens using a key set
+// which is shared across all router replicas. The key set is reloaded when
+// the file changes, so keys can be rotated without restarting the router.
+type TokenSigner struct {
+	path    string
+	mu      sync.RWMutex
+	active  string
+	keys    map[string]*signingKey
+	modTime time.Time
+}
+
+// NewTokenSigner loads the key set at path.
+func NewTokenSigner(path string) (*TokenSigner, error) {
+	s := &TokenSigner{
+		path: path,
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func decodeKeyMaterial(value string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(value)
+}
+
+func (k *signingKey) parse() error {
+	switch k.Type {
+	case "hmac":
+		secret, err := decodeKeyMaterial(k.Secret)
+		if err != nil || len(secret) < 32 {
+			return fmt.Errorf("Key %s: secret has to be at least 32 base64 encoded bytes", k.ID)
+		}
+		k.hmacSecret = secret
+	case "ed25519":
+		if k.Private != "" {
+			seed, err := decodeKeyMaterial(k.Private)
+			if err != nil || len(seed) != ed25519.SeedSize {
+				return fmt.Errorf("Key %s: private key has to be a base64 encoded 32 byte seed", k.ID)
+			}
+			k.privateKey = ed25519.NewKeyFromSeed(seed)
+			k.publicKey = k.privateKey.Public().(ed25519.PublicKey)
+		} else {
+			public, err := decodeKeyMaterial(k.Public)
+			if err != nil || len(public) != ed25519.PublicKeySize {
+				return fmt.Errorf("Key %s: public key has to be 32 base64 encoded bytes", k.ID)
+			}
+			k.publicKey = public
+		}
+	default:
+		return fmt.Errorf("Key %s: unknown key type %s", k.ID, k.Type)
+	}
+	return nil
+}
+
+// Reload reads the key set file again, the old key set is kept if the new one
+// is invalid.
+func (s *TokenSigner) Reload() error {
+	stat, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var set keySetFile
+	if err := json.Unmarshal(content, &set); err != nil {
+		return fmt.Errorf("Failed to parse key set %s: %v", s.path, err)
+	}
+	keys := make(map[string]*signingKey)
+	for i := range set.Keys {
+		key := &set.Keys[i]
+		if key.ID == "" || strings.Contains(key.ID, ".") {
+			return errors.New("Key ids must not be empty or contain dots")
+		}
+		if err := key.parse(); err != nil {
+			return err
+		}
+		keys[key.ID] = key
+	}
+	activeKey, ok := keys[set.Active]
+	if !ok {
+		return fmt.Errorf("Active key %s is not part of the key set", set.Active)
+	}
+	if activeKey.hmacSecret == nil && activeKey.privateKey == nil {
+		return fmt.Errorf("Active key %s can not be used for signing", set.Active)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active = set.Active
+	s.keys = keys
+	s.modTime = stat.ModTime()
+	return nil
+}
+
+// Watch reloads the key set whenever its modification time changes.
+func (s *TokenSigner) Watch(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		stat, err := os.Stat(s.path)
+		if err != nil {
+			util.Logger.Warningf("Failed to stat resume token key set: %v", err)
+			continue
+		}
+		s.mu.RLock()
+		changed := !stat.ModTime().Equal(s.modTime)
+		s.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := s.Reload(); err != nil {
+			util.Logger.Warningf("Failed to reload resume token key set, keeping old keys: %v", err)
+			continue
+		}
+		util.Logger.Infof("Reloaded resume token key set")
+	}
+}
+
+func (k *signingKey) sign(input []byte) []byte {
+	if k.hmacSecret != nil {
+		mac := hmac.New(sha256.New, k.hmacSecret)
+		mac.Write(input)
+		return mac.Sum(nil)
+	}
+	return ed25519.Sign(k.privateKey, input)
+}
+
+func (k *signingKey) verify(input, signature []byte) bool {
+	if k.hmacSecret != nil {
+		mac := hmac.New(sha256.New, k.hmacSecret)
+		mac.Write(input)
+		return hmac.Equal(mac.Sum(nil), signature)
+	}
+	return ed25519.Verify(k.publicKey, input, signature)
+}
+
+// Sign creates a token for authid which is valid in the given interval, the
+// nonce makes the token unique and is used to enforce single use.
+func (s *TokenSigner) Sign(authid string, issued time.Time, expires time.Time, nonce string) (string, error) {
+	s.mu.RLock()
+	key := s.keys[s.active]
+	s.mu.RUnlock()
+
+	payload, err := json.Marshal(signedTokenPayload{
+		AuthID:  authid,
+		Expires: expires.Unix(),
+		Issued:  issued.Unix(),
+		Nonce:   nonce,
+		KeyID:   key.ID,
+	})
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	signature := key.sign([]byte(encoded))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify checks the signature of the given token and returns its payload.
+// The expiry date is not checked.
+func (s *TokenSigner) Verify(token string) (*signedTokenPayload, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errors.New("Malformed token")
+	}
+	payloadRaw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("Malformed token")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("Malformed token")
+	}
+	payload := &signedTokenPayload{}
+	if err := json.Unmarshal(payloadRaw, payload); err != nil {
+		return nil, errors.New("Malformed token")
+	}
+
+	s.mu.RLock()
+	key, ok := s.keys[payload.KeyID]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown key id %s", payload.KeyID)
+	}
+	if !key.verify([]byte(parts[0]), signature) {
+		return nil, errors.New("Invalid signature")
+	}
+	return payload, nil
+}
@@ -71,18 +71,18 @@ func (a *DynamicTicketAuth) Authenticate(sid wamp.ID, details wamp.Dict, client
 	ticketObj := wamp.Dict{
 		"ticket": authRsp.Signature,
 	}
-	_, err = util.LocalClient.Call(ctx, a.UpstreamAuthFunc, nil, wamp.List{
+	_, err = callUpstream(ctx, a.UpstreamAuthFunc, wamp.List{
 		a.Realm,
 		authid,
 		ticketObj,
-	}, nil, nil)
+	}, nil)
 	if err != nil {
-		util.Logger.Warningf("Failed to call `%s`: %v", a.UpstreamAuthFunc, err)
+		warnUpstreamFailure(a.UpstreamAuthFunc, err)
 
 		castErr, ok := err.(superClient.RPCError)
 
 		if !ok {
-			return nil, errors.New("wamp.error.internal-error")
+			return nil, upstreamFailure(err, "wamp.error.internal-error")
 		}
 
 		return nil, errors.New(string(castErr.Err.Error))
@@ -93,9 +93,11 @@ func (a *DynamicTicketAuth) Authenticate(sid wamp.ID, details wamp.Dict, client
 		return nil, err
 	}
 	if a.AllowResumeToken && wamp.OptionFlag(authRsp.Extra, "generate-token") {
-		resp, err := util.LocalClient.Call(context.Background(), "ee.auth.create-token", nil, wamp.List{
+		resp, err := util.CallUpstream(ctx, "ee.auth.create-token", wamp.List{
 			authid,
-		}, nil, nil)
+		}, wamp.Dict{
+			"peer": peerAddress(details),
+		})
 		if err == nil {
 			x, _ := wamp.AsDict(welcome.Details["authextra"])
 			x["resume-token"] = resp.Arguments[0]
@@ -0,0 +1,612 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Token is a resume token issued for an authid.
+type Token struct {
+	AuthID     string    `json:"authid"`
+	ExpireDate time.Time `json:"expires"`
+	Created    time.Time `json:"created"`
+	// LastUsed is the time the token was used the last time, it is only
+	// updated for tokens which are not rotated on use.
+	LastUsed time.Time `json:"last_used,omitempty"`
+	// LastUsedPeer is the address of the client which requested or used the
+	// token the last time.
+	LastUsedPeer string `json:"peer,omitempty"`
+}
+
+// expired checks whether the token is expired, either because its absolute
+// lifetime is over or because it was not used for idle time.
+func (t Token) expired(idle time.Duration, now time.Time) bool {
+	if now.After(t.ExpireDate) {
+		return true
+	}
+	if idle <= 0 {
+		return false
+	}
+	lastUsed := t.LastUsed
+	if lastUsed.IsZero() {
+		lastUsed = t.Created
+	}
+	return now.After(lastUsed.Add(idle))
+}
+
+// TokenStore persists resume tokens. Implementations have to be safe for
+// concurrent use.
+type TokenStore interface {
+	// Put stores the token under the given key, replacing existing entries.
+	Put(key string, t Token) error
+	// PutIfAbsent stores the token only if the key is not used yet and reports
+	// whether the token was stored.
+	PutIfAbsent(key string, t Token) (bool, error)
+	// Get returns the token without removing it.
+	Get(key string) (Token, bool, error)
+	// Take removes the token from the store and returns it.
+	// This guarantees a token can only be used once.
+	Take(key string) (Token, bool, error)
+	// Delete removes the token from the store.
+	Delete(key string) error
+	// List returns a copy of all tokens currently stored.
+	List() (map[string]Token, error)
+	// ListByAuthID returns a copy of the tokens of authid without reading
+	// the other tokens.
+	ListByAuthID(authid string) (map[string]Token, error)
+	// DeleteExpired removes all tokens which expired before now and returns
+	// the number of removed tokens.
+	DeleteExpired(now time.Time) (int, error)
+	// Close releases all resources held by the store.
+	Close() error
+}
+
+const (
+	TokenStoreMemory = "memory"
+	TokenStoreFile   = "file"
+	TokenStoreBolt   = "bolt"
+)
+
+// NewTokenStore creates a TokenStore of the given kind. The path is ignored
+// for the in-memory store.
+func NewTokenStore(kind string, path string) (TokenStore, error) {
+	switch kind {
+	case "", TokenStoreMemory:
+		return NewMemoryTokenStore(), nil
+	case TokenStoreFile:
+		return NewFileTokenStore(path)
+	case TokenStoreBolt:
+		return NewBoltTokenStore(path)
+	}
+	return nil, fmt.Errorf("Unknown token store: %s", kind)
+}
+
+// MemoryTokenStore keeps all tokens in memory, they are lost when the router
+// restarts.
+type MemoryTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]Token
+	// byAuthID contains the keys of the tokens of each authid.
+	byAuthID map[string]map[string]struct{}
+}
+
+// NewMemoryTokenStore creates an empty MemoryTokenStore
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{
+		tokens:   make(map[string]Token),
+		byAuthID: make(map[string]map[string]struct{}),
+	}
+}
+
+// set stores the token and updates the index, m.mu has to be held.
+func (m *MemoryTokenStore) set(key string, t Token) {
+	m.remove(key)
+	m.tokens[key] = t
+	keys, ok := m.byAuthID[t.AuthID]
+	if !ok {
+		keys = make(map[string]struct{})
+		m.byAuthID[t.AuthID] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+// remove deletes the token and updates the index, m.mu has to be held.
+func (m *MemoryTokenStore) remove(key string) {
+	t, ok := m.tokens[key]
+	if !ok {
+		return
+	}
+	delete(m.tokens, key)
+	keys := m.byAuthID[t.AuthID]
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(m.byAuthID, t.AuthID)
+	}
+}
+
+func (m *MemoryTokenStore) Put(key string, t Token) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(key, t)
+	return nil
+}
+
+func (m *MemoryTokenStore) PutIfAbsent(key string, t Token) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.tokens[key]; ok {
+		return false, nil
+	}
+	m.set(key, t)
+	return true, nil
+}
+
+func (m *MemoryTokenStore) Get(key string) (Token, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[key]
+	return t, ok, nil
+}
+
+func (m *MemoryTokenStore) Take(key string) (Token, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[key]
+	m.remove(key)
+	return t, ok, nil
+}
+
+func (m *MemoryTokenStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(key)
+	return nil
+}
+
+func (m *MemoryTokenStore) List() (map[string]Token, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make(map[string]Token, len(m.tokens))
+	for k, v := range m.tokens {
+		res[k] = v
+	}
+	return res, nil
+}
+
+func (m *MemoryTokenStore) ListByAuthID(authid string) (map[string]Token, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := m.byAuthID[authid]
+	res := make(map[string]Token, len(keys))
+	for k := range keys {
+		res[k] = m.tokens[k]
+	}
+	return res, nil
+}
+
+func (m *MemoryTokenStore) DeleteExpired(now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	count := 0
+	for k, v := range m.tokens {
+		if now.After(v.ExpireDate) {
+			m.remove(k)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MemoryTokenStore) Close() error {
+	return nil
+}
+
+// FileTokenStore keeps all tokens in memory and writes a JSON snapshot to disk
+// after every modification. The snapshot is replaced atomically, so a crash
+// never leaves a partially written file behind. Concurrent modifications are
+// written by a single snapshot, and a modification is undone if its snapshot
+// can not be written.
+type FileTokenStore struct {
+	MemoryTokenStore
+	path string
+	// version counts the modifications, it is protected by the mutex of the
+	// MemoryTokenStore.
+	version uint64
+	// writeMu serializes snapshot writes, so an older snapshot never replaces
+	// a newer one.
+	writeMu sync.Mutex
+	// written is the version of the last snapshot, it is protected by writeMu.
+	written uint64
+}
+
+// NewFileTokenStore creates a FileTokenStore and loads the existing snapshot
+// at path, if any.
+func NewFileTokenStore(path string) (*FileTokenStore, error) {
+	if path == "" {
+		return nil, errors.New("The file token store requires a path")
+	}
+	f := &FileTokenStore{
+		MemoryTokenStore: MemoryTokenStore{
+			tokens:   make(map[string]Token),
+			byAuthID: make(map[string]map[string]struct{}),
+		},
+		path: path,
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	tokens := make(map[string]Token)
+	if err := json.Unmarshal(content, &tokens); err != nil {
+		return nil, fmt.Errorf("Failed to parse token store %s: %v", path, err)
+	}
+	for k, v := range tokens {
+		f.set(k, v)
+	}
+	return f, nil
+}
+
+// writeFileAtomic replaces the file at path by content.
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// modify applies change to the tokens and writes a snapshot containing it.
+// change is called with f.mu held and returns nil if it did not modify the
+// tokens, otherwise a function undoing the modification, which is called if
+// the snapshot fails.
+func (f *FileTokenStore) modify(change func() func()) error {
+	f.mu.Lock()
+	undo := change()
+	if undo == nil {
+		f.mu.Unlock()
+		return nil
+	}
+	f.version++
+	version := f.version
+	f.mu.Unlock()
+	return f.flush(version, undo)
+}
+
+// flush writes a snapshot, unless a snapshot containing version was written
+// in the meantime. If writing fails, undo is applied before other snapshots
+// are written.
+func (f *FileTokenStore) flush(version uint64, undo func()) error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+	if f.written >= version {
+		return nil
+	}
+	f.mu.Lock()
+	content, err := json.Marshal(f.tokens)
+	current := f.version
+	f.mu.Unlock()
+	if err == nil {
+		err = writeFileAtomic(f.path, content)
+	}
+	if err != nil {
+		if undo != nil {
+			f.mu.Lock()
+			undo()
+			f.mu.Unlock()
+		}
+		return err
+	}
+	f.written = current
+	return nil
+}
+
+// restore returns a function undoing the modification of key.
+func (f *FileTokenStore) restore(key string) func() {
+	previous, existed := f.tokens[key]
+	return func() {
+		if existed {
+			f.set(key, previous)
+		} else {
+			f.remove(key)
+		}
+	}
+}
+
+func (f *FileTokenStore) Put(key string, t Token) error {
+	return f.modify(func() func() {
+		undo := f.restore(key)
+		f.set(key, t)
+		return undo
+	})
+}
+
+func (f *FileTokenStore) PutIfAbsent(key string, t Token) (bool, error) {
+	stored := false
+	err := f.modify(func() func() {
+		if _, ok := f.tokens[key]; ok {
+			return nil
+		}
+		undo := f.restore(key)
+		f.set(key, t)
+		stored = true
+		return undo
+	})
+	if err != nil {
+		return false, err
+	}
+	return stored, nil
+}
+
+func (f *FileTokenStore) Take(key string) (Token, bool, error) {
+	var t Token
+	found := false
+	err := f.modify(func() func() {
+		t, found = f.tokens[key]
+		if !found {
+			return nil
+		}
+		undo := f.restore(key)
+		f.remove(key)
+		return undo
+	})
+	if err != nil {
+		return Token{}, false, err
+	}
+	return t, found, nil
+}
+
+func (f *FileTokenStore) Delete(key string) error {
+	_, _, err := f.Take(key)
+	return err
+}
+
+func (f *FileTokenStore) DeleteExpired(now time.Time) (int, error) {
+	expired := make(map[string]Token)
+	err := f.modify(func() func() {
+		for k, v := range f.tokens {
+			if now.After(v.ExpireDate) {
+				expired[k] = v
+				f.remove(k)
+			}
+		}
+		if len(expired) == 0 {
+			return nil
+		}
+		return func() {
+			for k, v := range expired {
+				f.set(k, v)
+			}
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(expired), nil
+}
+
+func (f *FileTokenStore) Close() error {
+	f.mu.Lock()
+	version := f.version
+	f.mu.Unlock()
+	return f.flush(version, nil)
+}
+
+var (
+	boltTokenBucket = []byte("resume-tokens")
+	// boltAuthIDBucket indexes the tokens by authid, its keys are the authid
+	// and the token key separated by a zero byte.
+	boltAuthIDBucket = []byte("resume-tokens-by-authid")
+)
+
+// BoltTokenStore stores all tokens in an embedded bbolt key-value database.
+type BoltTokenStore struct {
+	db *bolt.DB
+}
+
+// NewBoltTokenStore opens (or creates) the database at path.
+func NewBoltTokenStore(path string) (*BoltTokenStore, error) {
+	if path == "" {
+		return nil, errors.New("The bolt token store requires a path")
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltTokenBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltAuthIDBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltTokenStore{db: db}, nil
+}
+
+func boltIndexKey(authid, key string) []byte {
+	return []byte(authid + "\x00" + key)
+}
+
+// boltPut stores the token and updates the index.
+func boltPut(tx *bolt.Tx, key string, t Token) error {
+	content, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	if err := boltDelete(tx, key); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltAuthIDBucket).Put(boltIndexKey(t.AuthID, key), nil); err != nil {
+		return err
+	}
+	return tx.Bucket(boltTokenBucket).Put([]byte(key), content)
+}
+
+// boltDelete removes the token and its index entry.
+func boltDelete(tx *bolt.Tx, key string) error {
+	bucket := tx.Bucket(boltTokenBucket)
+	content := bucket.Get([]byte(key))
+	if content == nil {
+		return nil
+	}
+	var t Token
+	if err := json.Unmarshal(content, &t); err == nil {
+		if err := tx.Bucket(boltAuthIDBucket).Delete(boltIndexKey(t.AuthID, key)); err != nil {
+			return err
+		}
+	}
+	return bucket.Delete([]byte(key))
+}
+
+func (b *BoltTokenStore) Put(key string, t Token) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx, key, t)
+	})
+}
+
+func (b *BoltTokenStore) PutIfAbsent(key string, t Token) (bool, error) {
+	stored := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltTokenBucket).Get([]byte(key)) != nil {
+			return nil
+		}
+		stored = true
+		return boltPut(tx, key, t)
+	})
+	return stored, err
+}
+
+func (b *BoltTokenStore) Get(key string) (Token, bool, error) {
+	var t Token
+	found := false
+	err := b.db.View(func(tx *bolt.Tx) error {
+		content := tx.Bucket(boltTokenBucket).Get([]byte(key))
+		if content == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(content, &t)
+	})
+	return t, found, err
+}
+
+func (b *BoltTokenStore) Take(key string) (Token, bool, error) {
+	var t Token
+	found := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltTokenBucket)
+		content := bucket.Get([]byte(key))
+		if content == nil {
+			return nil
+		}
+		if err := json.Unmarshal(content, &t); err != nil {
+			return err
+		}
+		found = true
+		return boltDelete(tx, key)
+	})
+	return t, found, err
+}
+
+func (b *BoltTokenStore) Delete(key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltDelete(tx, key)
+	})
+}
+
+func (b *BoltTokenStore) List() (map[string]Token, error) {
+	res := make(map[string]Token)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTokenBucket).ForEach(func(k, v []byte) error {
+			var t Token
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			res[string(k)] = t
+			return nil
+		})
+	})
+	return res, err
+}
+
+func (b *BoltTokenStore) ListByAuthID(authid string) (map[string]Token, error) {
+	res := make(map[string]Token)
+	prefix := boltIndexKey(authid, "")
+	err := b.db.View(func(tx *bolt.Tx) error {
+		tokens := tx.Bucket(boltTokenBucket)
+		cursor := tx.Bucket(boltAuthIDBucket).Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			key := k[len(prefix):]
+			content := tokens.Get(key)
+			if content == nil {
+				continue
+			}
+			var t Token
+			if err := json.Unmarshal(content, &t); err != nil {
+				return err
+			}
+			res[string(key)] = t
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (b *BoltTokenStore) DeleteExpired(now time.Time) (int, error) {
+	count := 0
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltTokenBucket)
+		var expired [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			var t Token
+			if err := json.Unmarshal(v, &t); err != nil || now.After(t.ExpireDate) {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := boltDelete(tx, string(k)); err != nil {
+				return err
+			}
+		}
+		count = len(expired)
+		return nil
+	})
+	return count, err
+}
+
+func (b *BoltTokenStore) Close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"strings"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// uriMatcher resolves endpoint URIs to features using the WAMP match
+// policies. Like the dealer of the router, exact patterns win over prefix
+// patterns, which win over wildcard patterns. Among prefix patterns the
+// longest one wins, among wildcard patterns the one with the leftmost
+// concrete component wins. Exact and prefix lookups take O(length of the URI)
+// steps. Wildcard lookups backtrack to the empty component when a concrete
+// one fails deeper down, so a URI with k components visits up to 2^k nodes,
+// but never more than the wildcard trie has, as every node is reached by one
+// path only.
+type uriMatcher struct {
+	exact    map[wamp.URI]wamp.URI
+	prefix   *prefixNode
+	wildcard *wildcardNode
+}
+
+// prefixNode is a node of a radix tree over the characters of prefix
+// patterns, as WAMP prefixes do not have to end at a component boundary.
+// label is the part of the pattern leading from the parent to this node.
+type prefixNode struct {
+	label    string
+	children map[byte]*prefixNode
+	pattern  wamp.URI
+	feature  wamp.URI
+	terminal bool
+}
+
+// wildcardNode is a node of a trie over the components of wildcard patterns,
+// empty components are stored in any.
+type wildcardNode struct {
+	children map[string]*wildcardNode
+	any      *wildcardNode
+	pattern  wamp.URI
+	feature  wamp.URI
+	terminal bool
+}
+
+func newURIMatcher(mapping FeatureMapping) *uriMatcher {
+	m := &uriMatcher{
+		exact:    mapping[wamp.MatchExact],
+		prefix:   &prefixNode{},
+		wildcard: &wildcardNode{},
+	}
+	if m.exact == nil {
+		m.exact = map[wamp.URI]wamp.URI{}
+	}
+	for pattern, feature := range mapping[wamp.MatchPrefix] {
+		m.prefix.insert(pattern, feature)
+	}
+	for pattern, feature := range mapping[wamp.MatchWildcard] {
+		m.wildcard.insert(pattern, feature)
+	}
+	return m
+}
+
+func commonPrefixLength(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+func (n *prefixNode) insert(uri wamp.URI, feature wamp.URI) {
+	pattern := string(uri)
+	for len(pattern) > 0 {
+		if n.children == nil {
+			n.children = make(map[byte]*prefixNode)
+		}
+		child, ok := n.children[pattern[0]]
+		if !ok {
+			child = &prefixNode{label: pattern}
+			n.children[pattern[0]] = child
+			n = child
+			break
+		}
+		common := commonPrefixLength(pattern, child.label)
+		if common < len(child.label) {
+			// Split the edge, the new node holds the common part.
+			split := &prefixNode{
+				label: child.label[:common],
+				children: map[byte]*prefixNode{
+					child.label[common]: child,
+				},
+			}
+			child.label = child.label[common:]
+			n.children[pattern[0]] = split
+			child = split
+		}
+		pattern = pattern[common:]
+		n = child
+	}
+	n.pattern = uri
+	n.feature = feature
+	n.terminal = true
+}
+
+// match returns the node of the longest prefix of uri, or nil.
+func (n *prefixNode) match(uri string) *prefixNode {
+	var found *prefixNode
+	if n.terminal {
+		found = n
+	}
+	for len(uri) > 0 {
+		child, ok := n.children[uri[0]]
+		if !ok || !strings.HasPrefix(uri, child.label) {
+			break
+		}
+		uri = uri[len(child.label):]
+		n = child
+		if n.terminal {
+			found = n
+		}
+	}
+	return found
+}
+
+func (n *wildcardNode) insert(pattern wamp.URI, feature wamp.URI) {
+	for _, part := range strings.Split(string(pattern), ".") {
+		if part == "" {
+			if n.any == nil {
+				n.any = &wildcardNode{}
+			}
+			n = n.any
+			continue
+		}
+		if n.children == nil {
+			n.children = make(map[string]*wildcardNode)
+		}
+		child, ok := n.children[part]
+		if !ok {
+			child = &wildcardNode{}
+			n.children[part] = child
+		}
+		n = child
+	}
+	n.pattern = pattern
+	n.feature = feature
+	n.terminal = true
+}
+
+// match returns the node of the most specific wildcard pattern matching
+// uri. Concrete components are tried before empty ones, so the first match is
+// the most specific one.
+func (n *wildcardNode) match(uri string) *wildcardNode {
+	part, rest, last := uri, "", true
+	if i := strings.IndexByte(uri, '.'); i >= 0 {
+		part, rest, last = uri[:i], uri[i+1:], false
+	}
+	if child, ok := n.children[part]; ok {
+		if found := child.next(rest, last); found != nil {
+			return found
+		}
+	}
+	if n.any != nil {
+		return n.any.next(rest, last)
+	}
+	return nil
+}
+
+func (n *wildcardNode) next(rest string, last bool) *wildcardNode {
+	if last {
+		if n.terminal {
+			return n
+		}
+		return nil
+	}
+	return n.match(rest)
+}
+
+// Match returns the feature of uri.
+func (m *uriMatcher) Match(uri wamp.URI) (wamp.URI, bool) {
+	feature, _, _, ok := m.Lookup(uri)
+	return feature, ok
+}
+
+// Lookup returns the feature of uri, as well as the pattern and the match
+// policy of the mapping entry.
+func (m *uriMatcher) Lookup(uri wamp.URI) (wamp.URI, wamp.URI, string, bool) {
+	if feature, ok := m.exact[uri]; ok {
+		return feature, uri, wamp.MatchExact, true
+	}
+	if node := m.prefix.match(string(uri)); node != nil {
+		return node.feature, node.pattern, wamp.MatchPrefix, true
+	}
+	if node := m.wildcard.match(string(uri)); node != nil {
+		return node.feature, node.pattern, wamp.MatchWildcard, true
+	}
+	return "", "", "", false
+}
@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+func TestURIMatcherPrecedence(t *testing.T) {
+	util.Init()
+	mapping := FeatureMapping{}
+	mapping.add(wamp.MatchExact, "com.app.user.create", "exact")
+	mapping.add(wamp.MatchPrefix, "com.app", "short-prefix")
+	mapping.add(wamp.MatchPrefix, "com.app.user", "long-prefix")
+	mapping.add(wamp.MatchWildcard, "org..user.create", "late-wildcard")
+	mapping.add(wamp.MatchWildcard, "org.app..create", "early-wildcard")
+	mapping.add(wamp.MatchWildcard, "org...", "any")
+	// Duplicates resolve to the lexically smallest feature.
+	mapping.add(wamp.MatchExact, "net.dup", "b")
+	mapping.add(wamp.MatchExact, "net.dup", "a")
+	mapping.add(wamp.MatchExact, "net.dup", "c")
+	matcher := newURIMatcher(mapping)
+
+	cases := map[wamp.URI]wamp.URI{
+		"com.app.user.create":   "exact",
+		"com.app.user.delete":   "long-prefix",
+		"com.app.users":         "long-prefix",
+		"com.app.ticket":        "short-prefix",
+		"com.apple":             "short-prefix",
+		"org.app.user.create":   "early-wildcard",
+		"org.other.user.create": "late-wildcard",
+		"org.a.b.c":             "any",
+		"net.dup":               "a",
+		"org.a.b":               "",
+		"com":                   "",
+	}
+	for uri, expected := range cases {
+		feature, ok := matcher.Match(uri)
+		if ok != (expected != "") || feature != expected {
+			t.Errorf("%s: expected %q, got %q (found: %v)", uri, expected, feature, ok)
+		}
+	}
+}
+
+// benchmarkMapping creates a mapping with count patterns of the given match
+// policy, spread across several services.
+func benchmarkMapping(count int, match string) FeatureMapping {
+	mapping := FeatureMapping{}
+	for i := 0; i < count; i++ {
+		feature := wamp.URI(fmt.Sprintf("feature.%d", i%100))
+		switch match {
+		case wamp.MatchExact:
+			mapping.add(match, wamp.URI(fmt.Sprintf("com.service%d.endpoint%d.action", i%50, i)), feature)
+		case wamp.MatchPrefix:
+			mapping.add(match, wamp.URI(fmt.Sprintf("com.service%d.endpoint%d.", i%50, i)), feature)
+		case wamp.MatchWildcard:
+			mapping.add(match, wamp.URI(fmt.Sprintf("com.service%d..endpoint%d", i%50, i)), feature)
+		}
+	}
+	return mapping
+}
+
+func benchmarkMatcher(b *testing.B, match string, uri wamp.URI) {
+	util.Init()
+	matcher := newURIMatcher(benchmarkMapping(50000, match))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := matcher.Match(uri); !ok {
+			b.Fatalf("%s did not match", uri)
+		}
+	}
+}
+
+func BenchmarkURIMatcherExact(b *testing.B) {
+	benchmarkMatcher(b, wamp.MatchExact, "com.service7.endpoint25007.action")
+}
+
+func BenchmarkURIMatcherPrefix(b *testing.B) {
+	benchmarkMatcher(b, wamp.MatchPrefix, "com.service7.endpoint25007.action.sub")
+}
+
+func BenchmarkURIMatcherWildcard(b *testing.B) {
+	benchmarkMatcher(b, wamp.MatchWildcard, "com.service7.v2.endpoint25007")
+}
+
+func BenchmarkURIMatcherMiss(b *testing.B) {
+	util.Init()
+	mapping := benchmarkMapping(50000, wamp.MatchWildcard)
+	for pattern, feature := range benchmarkMapping(50000, wamp.MatchPrefix)[wamp.MatchPrefix] {
+		mapping.add(wamp.MatchPrefix, pattern, feature)
+	}
+	matcher := newURIMatcher(mapping)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		matcher.Match("com.service7.unknown.endpoint")
+	}
+}
+
+func BenchmarkURIMatcherCompile(b *testing.B) {
+	util.Init()
+	mapping := benchmarkMapping(50000, wamp.MatchWildcard)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		newURIMatcher(mapping)
+	}
+}
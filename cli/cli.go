@@ -2,14 +2,18 @@ package cli
 
 import (
 	"context"
+	"crypto/ed25519"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
 	"github.com/heetch/confita"
 	"github.com/heetch/confita/backend/flags"
 	"io/ioutil"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/EmbeddedEnterprises/autobahnkreuz/util"
 )
@@ -19,6 +23,12 @@ type TLSClientCAInfo struct {
 	CACert   *x509.Certificate
 }
 
+type CryptosignKeyInfo struct {
+	AuthID    string            `json:"authid"`
+	AuthRoles []string          `json:"authroles"`
+	PublicKey ed25519.PublicKey `json:"-"`
+}
+
 type CertificatePolicy int
 
 const (
@@ -34,6 +44,17 @@ const (
 	PermitAction
 )
 
+// Names of the authorizers in the authorizer chain.
+const (
+	DynamicAuthorizer = "dynamic"
+	FeatureAuthorizer = "feature"
+	PolicyAuthorizer  = "policy"
+	// AttributeAuthorizer evaluates conditions on session attributes.
+	AttributeAuthorizer = "attribute"
+	// RateLimiter denies actions exceeding a rate limit.
+	RateLimiter = "ratelimit"
+)
+
 type TLSEndpoint struct {
 	WS               WSEndpoint
 	Certificate      tls.Certificate
@@ -56,10 +77,45 @@ type InterconnectConfiguration struct {
 	UpstreamGetAuthRolesFunc string
 	ReservedAuthRole         []string
 	EnableResumeToken        bool
+	ResumeTokenStore         string
+	ResumeTokenStorePath     string
+	ResumeTokenSweepInterval time.Duration
+	ResumeTokenKeySet        string
+	ResumeTokenConsumeFunc   string
+	ResumeTokenRevokeFunc    string
+	ResumeTokenLifetime      time.Duration
+	ResumeTokenIdleLifetime  time.Duration
+	ResumeTokenRotate        bool
+	ResumeTokenMaxPerAuthID  int
+
+	EnableWampCRAAuth         bool
+	UpstreamWampCRASecretFunc string
+
+	EnableCryptosignAuth            bool
+	UpstreamCryptosignPubKeyFunc    string
+	CryptosignKeys                  map[string]CryptosignKeyInfo
+	CryptosignRequireChannelBinding bool
+
+	EnableJWTAuth      bool
+	JWTJWKSFile        string
+	JWTPEMKeyFiles     []string
+	JWTIssuer          string
+	JWTAudience        string
+	JWTAuthIDClaim     string
+	JWTAuthRolesClaim  string
+	JWTAuthExtraClaims []string
+	JWTLeeway          time.Duration
 
 	EnableAnonymousAuth bool
 	AnonymousAuthRole   string
 
+	UpstreamTimeout          time.Duration
+	UpstreamTimeoutOverrides map[string]time.Duration
+
+	UpstreamBreakerThreshold      int
+	UpstreamBreakerOpenDuration   time.Duration
+	UpstreamBreakerHalfOpenProbes int
+
 	// Global Authorization Variables
 	// Works in both authenticators
 	TrustedAuthRoles []string
@@ -70,13 +126,50 @@ type InterconnectConfiguration struct {
 	EnableAuthorizer   bool
 	UpstreamAuthorizer string
 
+	AuthorizerCacheSize int
+	AuthorizerCacheTTL  time.Duration
+
+	AuthorizerPayload        bool
+	AuthorizerPayloadURIs    []string
+	AuthorizerPayloadMaxSize int
+	AuthorizerPayloadRedact  []string
+
 	// Feature Authorizer
 	// According to my brain and my whiteboard
 	EnableFeatureAuthorizer          bool
 	UpstreamFeatureAuthorizerMatrix  string
 	UpstreamFeatureAuthorizerMapping string
-
-	ConsentMode string
+	UpstreamFeatureAuthorizerRoles   string
+	FeatureAuthorizerRefresh         time.Duration
+	FeatureAuthorizerUpdateTopic     string
+	FeatureAuthorizerRejectInvalid   bool
+
+	EnablePolicyAuthorizer bool
+	PolicyFile             string
+	PolicyFilePollInterval time.Duration
+
+	EnableAttributeAuthorizer bool
+	AttributeRulesFile        string
+	AttributeRulesFunc        string
+	AttributeRulesRefresh     time.Duration
+
+	EnableRateLimiter bool
+	RateLimitFile     string
+
+	// AuthorizerChain contains the enabled authorizers in the order they are
+	// asked.
+	AuthorizerChain []string
+	// AuthorizerShadow contains the enabled authorizers which are evaluated,
+	// but not enforced.
+	AuthorizerShadow []string
+	ConsentMode      string
+
+	// MetaAPIPolicy decides about the meta API, see auth.MessageGuard.
+	MetaAPIPolicy        string
+	AuthorizeWithdrawals bool
+	AllowDisclose        bool
+	EnableMetaKill       bool
+	EnableMetaModify     bool
 }
 
 type Configuration struct {
@@ -88,6 +181,41 @@ type Configuration struct {
 	TicketGetRoleFunc string   `config:"ticket-get-role-func"`
 	ExcludeAuthRole   []string `config:"exclude-auth-role"`
 	EnableResumeToken bool     `config:"enable-resume-token"`
+	EnableWampCRA     bool     `config:"enable-wampcra"`
+	WampCRASecretFunc string   `config:"wampcra-secret-func"`
+
+	ResumeTokenStore         string        `config:"resume-token-store"`
+	ResumeTokenStorePath     string        `config:"resume-token-store-path"`
+	ResumeTokenSweepInterval time.Duration `config:"resume-token-sweep-interval"`
+	ResumeTokenKeySet        string        `config:"resume-token-key-set"`
+	ResumeTokenConsumeFunc   string        `config:"resume-token-consume-func"`
+	ResumeTokenRevokeFunc    string        `config:"resume-token-revoke-func"`
+	ResumeTokenLifetime      time.Duration `config:"resume-token-lifetime"`
+	ResumeTokenIdleLifetime  time.Duration `config:"resume-token-idle-lifetime"`
+	ResumeTokenRotate        bool          `config:"resume-token-rotate"`
+	ResumeTokenMaxPerAuthID  int           `config:"resume-token-max-per-authid"`
+
+	EnableCryptosign                bool   `config:"enable-cryptosign"`
+	CryptosignPubKeyFunc            string `config:"cryptosign-pubkey-func"`
+	CryptosignKeyFile               string `config:"cryptosign-key-file"`
+	CryptosignRequireChannelBinding bool   `config:"cryptosign-require-channel-binding"`
+
+	EnableJWT          bool          `config:"enable-jwt"`
+	JWTJWKSFile        string        `config:"jwt-jwks-file"`
+	JWTPEMKey          []string      `config:"jwt-pem-key"`
+	JWTIssuer          string        `config:"jwt-issuer"`
+	JWTAudience        string        `config:"jwt-audience"`
+	JWTAuthIDClaim     string        `config:"jwt-authid-claim"`
+	JWTAuthRolesClaim  string        `config:"jwt-authroles-claim"`
+	JWTAuthExtraClaims []string      `config:"jwt-authextra-claims"`
+	JWTLeeway          time.Duration `config:"jwt-leeway"`
+
+	UpstreamTimeout         time.Duration `config:"upstream-timeout"`
+	UpstreamTimeoutOverride []string      `config:"upstream-timeout-override"`
+
+	UpstreamBreakerThreshold      int           `config:"upstream-breaker-threshold"`
+	UpstreamBreakerOpenDuration   time.Duration `config:"upstream-breaker-open-duration"`
+	UpstreamBreakerHalfOpenProbes int           `config:"upstream-breaker-half-open-probes"`
 
 	EnableWs bool   `config:"enable-ws"`
 	WsHost   string `config:"ws-host"`
@@ -109,6 +237,40 @@ type Configuration struct {
 	TrustedAuthRoles                []string `config:"trusted-authroles"`
 	AuthorizerFallback              string   `config:"authorizer-fallback"`
 	ConsentMode                     string   `config:"consent-mode"`
+
+	AuthorizerCacheSize int           `config:"authorizer-cache-size"`
+	AuthorizerCacheTTL  time.Duration `config:"authorizer-cache-ttl"`
+
+	AuthorizerPayload        bool     `config:"authorizer-payload"`
+	AuthorizerPayloadURIs    []string `config:"authorizer-payload-uri"`
+	AuthorizerPayloadMaxSize int      `config:"authorizer-payload-max-size"`
+	AuthorizerPayloadRedact  []string `config:"authorizer-payload-redact"`
+
+	FeatureAuthorizationRefresh       time.Duration `config:"feature-authorizer-refresh-interval"`
+	FeatureAuthorizationUpdateTopic   string        `config:"feature-authorizer-update-topic"`
+	FeatureAuthorizationRejectInvalid bool          `config:"feature-authorizer-reject-invalid"`
+	FeatureAuthorizationRolesFunc     string        `config:"feature-authorizer-roles-func"`
+
+	EnablePolicyAuthorization bool          `config:"enable-policy-authorization"`
+	PolicyFile                string        `config:"policy-file"`
+	PolicyFilePollInterval    time.Duration `config:"policy-file-poll-interval"`
+
+	EnableAttributeAuthorization bool          `config:"enable-attribute-authorization"`
+	AttributeRulesFile           string        `config:"attribute-rules-file"`
+	AttributeRulesFunc           string        `config:"attribute-rules-func"`
+	AttributeRulesRefresh        time.Duration `config:"attribute-rules-refresh-interval"`
+
+	EnableRateLimiting bool   `config:"enable-rate-limiting"`
+	RateLimitFile      string `config:"rate-limit-file"`
+
+	AuthorizerChain  []string `config:"authorizer-chain"`
+	AuthorizerShadow []string `config:"authorizer-shadow"`
+
+	MetaAPIPolicy        string `config:"meta-api-policy"`
+	AuthorizeWithdrawals bool   `config:"authorize-withdrawals"`
+	AllowDisclose        bool   `config:"allow-disclose"`
+	EnableMetaKill       bool   `config:"enable-meta-kill"`
+	EnableMetaModify     bool   `config:"enable-meta-modify"`
 }
 
 func assertNotEmpty(name, value string) {
@@ -118,6 +280,83 @@ func assertNotEmpty(name, value string) {
 	}
 }
 
+// checkAuthorizerNames exits if names contains unknown or duplicate
+// authorizers.
+func checkAuthorizerNames(kind string, names []string) {
+	seen := map[string]bool{}
+	for _, name := range names {
+		switch name {
+		case DynamicAuthorizer, FeatureAuthorizer, PolicyAuthorizer, AttributeAuthorizer, RateLimiter:
+		default:
+			util.Logger.Criticalf("Unknown authorizer in %s: %s", kind, name)
+			util.Logger.Critical("Possible Values: dynamic, feature, policy, attribute, ratelimit")
+			os.Exit(util.ExitArgument)
+		}
+		if seen[name] {
+			util.Logger.Criticalf("Authorizer %s is contained multiple times in the %s", name, kind)
+			os.Exit(util.ExitArgument)
+		}
+		seen[name] = true
+	}
+}
+
+// parseAuthorizerChain returns the authorizers in the order they are asked. If
+// a chain is given, it enables exactly the authorizers contained in it,
+// otherwise the enabled authorizers are asked in the default order. Shadow
+// authorizers are enabled as well, but are never part of the chain.
+func parseAuthorizerChain(chain []string, shadow []string, config *InterconnectConfiguration) []string {
+	checkAuthorizerNames("shadow authorizers", shadow)
+	isShadow := map[string]bool{}
+	for _, name := range shadow {
+		isShadow[name] = true
+	}
+
+	if len(chain) == 0 {
+		chain = []string{}
+		// The rate limiter comes first, so it is asked before any authorizer
+		// permits an action in the consent mode one.
+		if config.EnableRateLimiter && !isShadow[RateLimiter] {
+			chain = append(chain, RateLimiter)
+		}
+		if config.EnableAuthorizer && !isShadow[DynamicAuthorizer] {
+			chain = append(chain, DynamicAuthorizer)
+		}
+		if config.EnableFeatureAuthorizer && !isShadow[FeatureAuthorizer] {
+			chain = append(chain, FeatureAuthorizer)
+		}
+		if config.EnablePolicyAuthorizer && !isShadow[PolicyAuthorizer] {
+			chain = append(chain, PolicyAuthorizer)
+		}
+		if config.EnableAttributeAuthorizer && !isShadow[AttributeAuthorizer] {
+			chain = append(chain, AttributeAuthorizer)
+		}
+	} else {
+		checkAuthorizerNames("chain", chain)
+	}
+
+	enabled := map[string]bool{}
+	for _, name := range chain {
+		if isShadow[name] {
+			util.Logger.Criticalf("Authorizer %s can not be enforced and shadowed at the same time", name)
+			os.Exit(util.ExitArgument)
+		}
+		enabled[name] = true
+	}
+	if len(shadow) > 0 && len(chain) == 0 {
+		util.Logger.Critical("Shadow authorizers require at least one enforced authorizer.")
+		os.Exit(util.ExitArgument)
+	}
+	for _, name := range shadow {
+		enabled[name] = true
+	}
+	config.EnableAuthorizer = enabled[DynamicAuthorizer]
+	config.EnableFeatureAuthorizer = enabled[FeatureAuthorizer]
+	config.EnablePolicyAuthorizer = enabled[PolicyAuthorizer]
+	config.EnableAttributeAuthorizer = enabled[AttributeAuthorizer]
+	config.EnableRateLimiter = enabled[RateLimiter]
+	return chain
+}
+
 func parseClientCA(cca string) TLSClientCAInfo {
 	x := strings.Split(cca, ";")
 	if len(x) != 2 {
@@ -146,6 +385,53 @@ func parseClientCA(cca string) TLSClientCAInfo {
 	}
 }
 
+func parseCryptosignKeyFile(path string) map[string]CryptosignKeyInfo {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		util.Logger.Criticalf("Failed to load cryptosign key file %s: %v", path, err)
+		os.Exit(util.ExitArgument)
+	}
+	// The key file maps hex encoded public keys to authid and authroles.
+	keys := map[string]CryptosignKeyInfo{}
+	if err := json.Unmarshal(content, &keys); err != nil {
+		util.Logger.Criticalf("Failed to parse cryptosign key file %s: %v", path, err)
+		os.Exit(util.ExitArgument)
+	}
+	result := map[string]CryptosignKeyInfo{}
+	for pubkey, info := range keys {
+		key, err := hex.DecodeString(pubkey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			util.Logger.Criticalf("Invalid public key in cryptosign key file %s: %s", path, pubkey)
+			os.Exit(util.ExitArgument)
+		}
+		if info.AuthID == "" {
+			util.Logger.Criticalf("Missing authid for public key %s in cryptosign key file %s", pubkey, path)
+			os.Exit(util.ExitArgument)
+		}
+		info.PublicKey = key
+		result[strings.ToLower(pubkey)] = info
+	}
+	return result
+}
+
+func parseUpstreamTimeoutOverrides(overrides []string) map[string]time.Duration {
+	result := map[string]time.Duration{}
+	for _, override := range overrides {
+		x := strings.Split(override, "=")
+		if len(x) != 2 || x[0] == "" {
+			util.Logger.Criticalf("Upstream timeout override is in invalid format, expected procedure=duration, got: %s", override)
+			os.Exit(util.ExitArgument)
+		}
+		timeout, err := time.ParseDuration(x[1])
+		if err != nil || timeout < 0 {
+			util.Logger.Criticalf("Invalid upstream timeout for %s: %s", x[0], x[1])
+			os.Exit(util.ExitArgument)
+		}
+		result[x[0]] = timeout
+	}
+	return result
+}
+
 func ParseCLI() InterconnectConfiguration {
 
 	cliInput := Configuration{
@@ -153,6 +439,18 @@ func ParseCLI() InterconnectConfiguration {
 		AnonymousAuthRole: "anonymous",
 		EnableTicket:      true,
 		EnableResumeToken: true,
+		JWTAuthIDClaim:    "sub",
+		JWTLeeway:         30 * time.Second,
+		UpstreamTimeout:   5 * time.Second,
+
+		UpstreamBreakerThreshold:      5,
+		UpstreamBreakerOpenDuration:   10 * time.Second,
+		UpstreamBreakerHalfOpenProbes: 1,
+
+		ResumeTokenStore:         "memory",
+		ResumeTokenSweepInterval: 10 * time.Minute,
+		ResumeTokenLifetime:      7 * 24 * time.Hour,
+		ResumeTokenRotate:        true,
 
 		EnableWs: true,
 		WsPort:   8001,
@@ -165,6 +463,20 @@ func ParseCLI() InterconnectConfiguration {
 		EnableFeatureAuthorization: true,
 		AuthorizerFallback:         "reject",
 		ConsentMode:                "all",
+		AuthorizerCacheTTL:         30 * time.Second,
+
+		AuthorizerPayloadMaxSize: 64 * 1024,
+
+		FeatureAuthorizationRefresh: 5 * time.Minute,
+
+		PolicyFilePollInterval: 5 * time.Second,
+
+		AttributeRulesRefresh: 5 * time.Minute,
+
+		MetaAPIPolicy:    "trusted",
+		AllowDisclose:    true,
+		EnableMetaKill:   true,
+		EnableMetaModify: true,
 	}
 
 	loader := confita.NewLoader(
@@ -191,15 +503,87 @@ func ParseCLI() InterconnectConfiguration {
 		EnableAuthorizer:         cliInput.EnableAuthorizer,
 		TrustedAuthRoles:         cliInput.TrustedAuthRoles,
 		UpstreamAuthorizer:       cliInput.AuthorizerFunc,
+		AuthorizerCacheSize:      cliInput.AuthorizerCacheSize,
+		AuthorizerCacheTTL:       cliInput.AuthorizerCacheTTL,
+
+		AuthorizerPayload:        cliInput.AuthorizerPayload,
+		AuthorizerPayloadURIs:    cliInput.AuthorizerPayloadURIs,
+		AuthorizerPayloadMaxSize: cliInput.AuthorizerPayloadMaxSize,
+		AuthorizerPayloadRedact:  cliInput.AuthorizerPayloadRedact,
+
+		ResumeTokenStore:         cliInput.ResumeTokenStore,
+		ResumeTokenStorePath:     cliInput.ResumeTokenStorePath,
+		ResumeTokenSweepInterval: cliInput.ResumeTokenSweepInterval,
+		ResumeTokenKeySet:        cliInput.ResumeTokenKeySet,
+		ResumeTokenConsumeFunc:   cliInput.ResumeTokenConsumeFunc,
+		ResumeTokenRevokeFunc:    cliInput.ResumeTokenRevokeFunc,
+		ResumeTokenLifetime:      cliInput.ResumeTokenLifetime,
+		ResumeTokenIdleLifetime:  cliInput.ResumeTokenIdleLifetime,
+		ResumeTokenRotate:        cliInput.ResumeTokenRotate,
+		ResumeTokenMaxPerAuthID:  cliInput.ResumeTokenMaxPerAuthID,
+
+		EnableWampCRAAuth:         cliInput.EnableWampCRA,
+		UpstreamWampCRASecretFunc: cliInput.WampCRASecretFunc,
+
+		EnableCryptosignAuth:            cliInput.EnableCryptosign,
+		UpstreamCryptosignPubKeyFunc:    cliInput.CryptosignPubKeyFunc,
+		CryptosignRequireChannelBinding: cliInput.CryptosignRequireChannelBinding,
+
+		EnableJWTAuth:      cliInput.EnableJWT,
+		JWTJWKSFile:        cliInput.JWTJWKSFile,
+		JWTPEMKeyFiles:     cliInput.JWTPEMKey,
+		JWTIssuer:          cliInput.JWTIssuer,
+		JWTAudience:        cliInput.JWTAudience,
+		JWTAuthIDClaim:     cliInput.JWTAuthIDClaim,
+		JWTAuthRolesClaim:  cliInput.JWTAuthRolesClaim,
+		JWTAuthExtraClaims: cliInput.JWTAuthExtraClaims,
+		JWTLeeway:          cliInput.JWTLeeway,
+
+		UpstreamTimeout:          cliInput.UpstreamTimeout,
+		UpstreamTimeoutOverrides: parseUpstreamTimeoutOverrides(cliInput.UpstreamTimeoutOverride),
+
+		UpstreamBreakerThreshold:      cliInput.UpstreamBreakerThreshold,
+		UpstreamBreakerOpenDuration:   cliInput.UpstreamBreakerOpenDuration,
+		UpstreamBreakerHalfOpenProbes: cliInput.UpstreamBreakerHalfOpenProbes,
 
 		EnableFeatureAuthorizer:          cliInput.EnableFeatureAuthorization,
 		UpstreamFeatureAuthorizerMatrix:  cliInput.FeatureAuthorizationMatrixFunc,
 		UpstreamFeatureAuthorizerMapping: cliInput.FeatureAuthorizationMappingFunc,
+		UpstreamFeatureAuthorizerRoles:   cliInput.FeatureAuthorizationRolesFunc,
+		FeatureAuthorizerRefresh:         cliInput.FeatureAuthorizationRefresh,
+		FeatureAuthorizerUpdateTopic:     cliInput.FeatureAuthorizationUpdateTopic,
+		FeatureAuthorizerRejectInvalid:   cliInput.FeatureAuthorizationRejectInvalid,
+
+		EnablePolicyAuthorizer: cliInput.EnablePolicyAuthorization,
+		PolicyFile:             cliInput.PolicyFile,
+		PolicyFilePollInterval: cliInput.PolicyFilePollInterval,
+
+		EnableAttributeAuthorizer: cliInput.EnableAttributeAuthorization,
+		AttributeRulesFile:        cliInput.AttributeRulesFile,
+		AttributeRulesFunc:        cliInput.AttributeRulesFunc,
+		AttributeRulesRefresh:     cliInput.AttributeRulesRefresh,
+
+		EnableRateLimiter: cliInput.EnableRateLimiting,
+		RateLimitFile:     cliInput.RateLimitFile,
 
 		ConsentMode: cliInput.ConsentMode,
+
+		MetaAPIPolicy:        cliInput.MetaAPIPolicy,
+		AuthorizeWithdrawals: cliInput.AuthorizeWithdrawals,
+		AllowDisclose:        cliInput.AllowDisclose,
+		EnableMetaKill:       cliInput.EnableMetaKill,
+		EnableMetaModify:     cliInput.EnableMetaModify,
 	}
 
 	assertNotEmpty("Realm", config.Realm)
+	if config.UpstreamTimeout < 0 {
+		util.Logger.Critical("The upstream timeout must not be negative.")
+		os.Exit(util.ExitArgument)
+	}
+	if config.UpstreamBreakerThreshold > 0 && (config.UpstreamBreakerOpenDuration <= 0 || config.UpstreamBreakerHalfOpenProbes <= 0) {
+		util.Logger.Critical("The circuit breaker requires a positive open duration and number of half-open probes.")
+		os.Exit(util.ExitArgument)
+	}
 	if config.EnableAnonymousAuth {
 		assertNotEmpty("Anonymous authentication role", config.AnonymousAuthRole)
 	}
@@ -208,28 +592,115 @@ func ParseCLI() InterconnectConfiguration {
 		assertNotEmpty("Ticket check function", config.UpstreamAuthFunc)
 	}
 
-	if config.EnableResumeToken || config.EnableTicketAuth {
-		assertNotEmpty("Auth role getter function", config.UpstreamGetAuthRolesFunc)
+	if config.EnableWampCRAAuth {
+		assertNotEmpty("WAMP-CRA secret function", config.UpstreamWampCRASecretFunc)
 	}
 
-	if config.EnableAuthorizer && config.EnableFeatureAuthorizer {
-		util.Logger.Criticalf("Can't enable both authorizers. Choose one!")
-		os.Exit(util.ExitArgument)
+	if config.EnableCryptosignAuth {
+		if cliInput.CryptosignKeyFile != "" {
+			config.CryptosignKeys = parseCryptosignKeyFile(cliInput.CryptosignKeyFile)
+		}
+		if config.UpstreamCryptosignPubKeyFunc == "" && config.CryptosignKeys == nil {
+			util.Logger.Critical("You have to specify a public key function or a key file for cryptosign authentication.")
+			os.Exit(util.ExitArgument)
+		}
+	}
+
+	if config.EnableResumeToken {
+		switch config.ResumeTokenStore {
+		case "memory":
+		case "file", "bolt":
+			assertNotEmpty("Resume token store path", config.ResumeTokenStorePath)
+		default:
+			util.Logger.Critical("You have to set a predefined resume token store.")
+			util.Logger.Critical("Possible Values: memory, file, bolt")
+			os.Exit(util.ExitArgument)
+		}
+		if config.ResumeTokenConsumeFunc != "" && config.ResumeTokenKeySet == "" {
+			util.Logger.Critical("The resume token consume function requires a resume token key set.")
+			os.Exit(util.ExitArgument)
+		}
+		if (config.ResumeTokenConsumeFunc == "") != (config.ResumeTokenRevokeFunc == "") {
+			util.Logger.Critical("The resume token consume and revoke functions have to be used together, otherwise revoked tokens stay valid on other replicas.")
+			os.Exit(util.ExitArgument)
+		}
+		if config.ResumeTokenLifetime <= 0 || config.ResumeTokenIdleLifetime < 0 || config.ResumeTokenMaxPerAuthID < 0 {
+			util.Logger.Critical("Resume token lifetimes and limits must not be negative.")
+			os.Exit(util.ExitArgument)
+		}
+		if config.ResumeTokenKeySet != "" && (!config.ResumeTokenRotate || config.ResumeTokenMaxPerAuthID > 0) {
+			util.Logger.Critical("Stateless resume tokens are always rotated and can not be limited per authid.")
+			os.Exit(util.ExitArgument)
+		}
 	}
 
+	if config.EnableJWTAuth {
+		if config.JWTJWKSFile == "" && len(config.JWTPEMKeyFiles) == 0 {
+			util.Logger.Critical("You have to specify a JWKS file or PEM keys for JWT authentication.")
+			os.Exit(util.ExitArgument)
+		}
+		if config.JWTAuthRolesClaim == "" {
+			assertNotEmpty("Auth role getter function", config.UpstreamGetAuthRolesFunc)
+		}
+	}
+
+	if config.EnableResumeToken || config.EnableTicketAuth || config.EnableWampCRAAuth {
+		assertNotEmpty("Auth role getter function", config.UpstreamGetAuthRolesFunc)
+	}
+
+	config.AuthorizerShadow = cliInput.AuthorizerShadow
+	config.AuthorizerChain = parseAuthorizerChain(cliInput.AuthorizerChain, cliInput.AuthorizerShadow, &config)
+
 	if config.EnableFeatureAuthorizer {
 		assertNotEmpty("Feature Authorizer Matrix", config.UpstreamFeatureAuthorizerMatrix)
 		assertNotEmpty("Feature Authorizer Mapping", config.UpstreamFeatureAuthorizerMapping)
+		if config.FeatureAuthorizerRefresh < 0 {
+			util.Logger.Critical("The feature authorizer refresh interval must not be negative.")
+			os.Exit(util.ExitArgument)
+		}
+	}
+
+	if config.EnablePolicyAuthorizer {
+		assertNotEmpty("Policy file", config.PolicyFile)
+		if config.PolicyFilePollInterval < 0 {
+			util.Logger.Critical("The policy file poll interval must not be negative.")
+			os.Exit(util.ExitArgument)
+		}
+	}
+
+	if config.EnableAttributeAuthorizer {
+		if (config.AttributeRulesFile == "") == (config.AttributeRulesFunc == "") {
+			util.Logger.Critical("The attribute authorizer requires either a rule file or a rule function.")
+			os.Exit(util.ExitArgument)
+		}
+		if config.AttributeRulesRefresh < 0 {
+			util.Logger.Critical("The attribute rules refresh interval must not be negative.")
+			os.Exit(util.ExitArgument)
+		}
+	}
+
+	if config.EnableRateLimiter {
+		assertNotEmpty("Rate limit file", config.RateLimitFile)
 	}
 
 	if config.EnableAuthorizer {
 		assertNotEmpty("Authorization function", config.UpstreamAuthorizer)
-		switch cliInput.AuthorizerFallback {
-		case "permit", "accept":
-			config.AuthorizeFailed = PermitAction
-		default:
-			config.AuthorizeFailed = RejectAction
+		if config.AuthorizerCacheSize < 0 || config.AuthorizerCacheTTL < 0 {
+			util.Logger.Critical("The authorizer cache size and ttl must not be negative.")
+			os.Exit(util.ExitArgument)
 		}
+		if config.AuthorizerPayloadMaxSize < 0 {
+			util.Logger.Critical("The authorizer payload max size must not be negative.")
+			os.Exit(util.ExitArgument)
+		}
+	}
+
+	// The fallback is used by all authorizers, not only the dynamic one.
+	switch cliInput.AuthorizerFallback {
+	case "permit", "accept":
+		config.AuthorizeFailed = PermitAction
+	default:
+		config.AuthorizeFailed = RejectAction
 	}
 
 	enabled := false
@@ -284,18 +755,28 @@ func ParseCLI() InterconnectConfiguration {
 		util.Logger.Critical("At least one transport must be enabled!")
 		os.Exit(util.ExitArgument)
 	}
-	if !config.EnableTicketAuth && !config.EnableAnonymousAuth && (config.ListenTLS == nil || config.ListenTLS.ClientCertPolicy == DisableClientAuthentication) {
+	if !config.EnableTicketAuth && !config.EnableWampCRAAuth && !config.EnableCryptosignAuth && !config.EnableJWTAuth && !config.EnableAnonymousAuth && (config.ListenTLS == nil || config.ListenTLS.ClientCertPolicy == DisableClientAuthentication) {
 		util.Logger.Critical("You have to enable at least one authentication method!")
 		util.Logger.Critical("Otherwise no client will be able to connect!")
 		os.Exit(util.ExitArgument)
 	}
 
-	if config.ConsentMode != "all" && config.ConsentMode != "one" {
+	switch config.ConsentMode {
+	case "all", "one", "first-applicable", "deny-overrides", "permit-overrides", "majority":
+	default:
 		util.Logger.Critical("You have to set a predefined consent mode.")
-		util.Logger.Critical("Possible Values: all, one")
+		util.Logger.Critical("Possible Values: all, one, first-applicable, deny-overrides, permit-overrides, majority")
 		os.Exit(util.ExitArgument)
 
 	}
 
+	switch config.MetaAPIPolicy {
+	case "trusted", "authorize", "permit":
+	default:
+		util.Logger.Critical("You have to set a predefined meta API policy.")
+		util.Logger.Critical("Possible Values: trusted, authorize, permit")
+		os.Exit(util.ExitArgument)
+	}
+
 	return config
 }
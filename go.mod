@@ -5,6 +5,8 @@ require (
 	github.com/gammazero/nexus/v3 v3.0.4
 	github.com/heetch/confita v0.10.0
 	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
+	go.etcd.io/bbolt v1.3.6
+	gopkg.in/yaml.v2 v2.2.2
 )
 
 require (
@@ -12,6 +14,7 @@ require (
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/ugorji/go/codec v1.2.6 // indirect
 	golang.org/x/crypto v0.0.0-20220112180741-5e0467b6c7ce // indirect
+	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
 )
 
 go 1.17
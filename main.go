@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -11,6 +12,9 @@ import (
 	"os/signal"
 	"reflect"
 	"time"
+	// The container image has no timezone database, but the schedules of the
+	// feature matrix need one.
+	_ "time/tzdata"
 
 	"github.com/EmbeddedEnterprises/autobahnkreuz/auth/multiauthorizer"
 
@@ -28,6 +32,15 @@ import (
 
 type Initializer func()
 
+// closeAll closes the resources of the authenticators and authorizers.
+func closeAll(closers []io.Closer) {
+	for _, closer := range closers {
+		if err := closer.Close(); err != nil {
+			util.Logger.Warningf("Failed to close: %v", err)
+		}
+	}
+}
+
 func verifyPeer(requireCert bool, validCAs *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
 
 	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
@@ -71,7 +84,7 @@ func verifyPeer(requireCert bool, validCAs *x509.CertPool) func([][]byte, [][]*x
 	}
 }
 
-func createRouterConfig(config cli.InterconnectConfiguration) (*router.Config, []Initializer) {
+func createRouterConfig(config cli.InterconnectConfiguration) (*router.Config, []Initializer, []io.Closer) {
 	encode := func(value reflect.Value) ([]byte, error) {
 		return value.Bytes(), nil
 	}
@@ -87,12 +100,16 @@ func createRouterConfig(config cli.InterconnectConfiguration) (*router.Config, [
 		AnonymousAuth: false,
 		// This is required for localPeers to work.
 		RequireLocalAuth:     false,
-		AllowDisclose:        true,
-		EnableMetaKill:       true,
-		EnableMetaModify:     true,
+		AllowDisclose:        config.AllowDisclose,
+		EnableMetaKill:       config.EnableMetaKill,
+		EnableMetaModify:     config.EnableMetaModify,
 		PublishFilterFactory: filter.NewComplexFilter,
 	}
 	var initers []Initializer
+	var closers []io.Closer
+	if config.UpstreamBreakerThreshold > 0 {
+		initers = append(initers, auth.UpstreamBreakers.Initialize)
+	}
 
 	routerConfig.RealmConfigs = []*router.RealmConfig{
 		realm,
@@ -110,6 +127,14 @@ func createRouterConfig(config cli.InterconnectConfiguration) (*router.Config, [
 		exclude.Add(x)
 	}
 
+	trustedAuthRoles := mapset.NewSet()
+	for _, tAuthRole := range config.TrustedAuthRoles {
+		trustedAuthRoles.Add(tAuthRole)
+	}
+	// This is required to make the authorizer and authenticator working.
+	// If you use client.ConnectLocal, the client automagically gets the trusted auth role.
+	trustedAuthRoles.Add("trusted")
+
 	if config.EnableTicketAuth {
 		util.Logger.Infof("Enabling ticket auth, func: %v, roles: %v", config.UpstreamAuthFunc, config.UpstreamGetAuthRolesFunc)
 		authenticator, err := auth.NewDynamicTicket(config.UpstreamAuthFunc, config.UpstreamGetAuthRolesFunc, config.Realm, exclude, config.EnableResumeToken)
@@ -120,35 +145,117 @@ func createRouterConfig(config cli.InterconnectConfiguration) (*router.Config, [
 		realm.Authenticators = append(realm.Authenticators, authenticator)
 	}
 
+	if config.EnableWampCRAAuth {
+		util.Logger.Infof("Enabling WAMP-CRA auth, func: %v, roles: %v", config.UpstreamWampCRASecretFunc, config.UpstreamGetAuthRolesFunc)
+		authenticator, err := auth.NewWampCRA(config.UpstreamWampCRASecretFunc, config.UpstreamGetAuthRolesFunc, config.Realm, exclude)
+		if err != nil {
+			util.Logger.Criticalf("Failed to create WAMP-CRA authenticator: %v", err)
+			os.Exit(1)
+		}
+		realm.Authenticators = append(realm.Authenticators, authenticator)
+	}
+
+	if config.EnableCryptosignAuth {
+		util.Logger.Infof("Enabling cryptosign auth, func: %v, static keys: %d", config.UpstreamCryptosignPubKeyFunc, len(config.CryptosignKeys))
+		authenticator, err := auth.NewCryptosign(config.UpstreamCryptosignPubKeyFunc, config.CryptosignKeys, config.Realm, exclude, config.CryptosignRequireChannelBinding)
+		if err != nil {
+			util.Logger.Criticalf("Failed to create cryptosign authenticator: %v", err)
+			os.Exit(1)
+		}
+		realm.Authenticators = append(realm.Authenticators, authenticator)
+	}
+
+	if config.EnableJWTAuth {
+		util.Logger.Infof("Enabling JWT auth, issuer: %v, audience: %v", config.JWTIssuer, config.JWTAudience)
+		authenticator, err := auth.NewJWTAuth(auth.JWTConfig{
+			JWKSFile:         config.JWTJWKSFile,
+			PEMKeyFiles:      config.JWTPEMKeyFiles,
+			Issuer:           config.JWTIssuer,
+			Audience:         config.JWTAudience,
+			AuthIDClaim:      config.JWTAuthIDClaim,
+			AuthRolesClaim:   config.JWTAuthRolesClaim,
+			AuthExtraClaims:  config.JWTAuthExtraClaims,
+			Leeway:           config.JWTLeeway,
+			UpstreamRoleFunc: config.UpstreamGetAuthRolesFunc,
+		}, config.Realm, exclude)
+		if err != nil {
+			util.Logger.Criticalf("Failed to create JWT authenticator: %v", err)
+			os.Exit(1)
+		}
+		realm.Authenticators = append(realm.Authenticators, authenticator)
+	}
+
 	if config.EnableResumeToken {
-		util.Logger.Infof("Enabling resume token auth, roles: %v", config.UpstreamGetAuthRolesFunc)
-		authenticator, err := auth.NewResumeAuthenticator(config.UpstreamGetAuthRolesFunc, config.Realm, exclude)
+		util.Logger.Infof("Enabling resume token auth, roles: %v, store: %v", config.UpstreamGetAuthRolesFunc, config.ResumeTokenStore)
+		store, err := auth.NewTokenStore(config.ResumeTokenStore, config.ResumeTokenStorePath)
+		if err != nil {
+			util.Logger.Criticalf("Failed to open resume token store: %v", err)
+			os.Exit(1)
+		}
+		authenticator, err := auth.NewResumeAuthenticator(config.UpstreamGetAuthRolesFunc, config.Realm, exclude, store, config.ResumeTokenSweepInterval, auth.ResumeTokenPolicy{
+			Lifetime:     config.ResumeTokenLifetime,
+			IdleLifetime: config.ResumeTokenIdleLifetime,
+			Rotate:       config.ResumeTokenRotate,
+			MaxPerAuthID: config.ResumeTokenMaxPerAuthID,
+		})
 		if err != nil {
 			util.Logger.Criticalf("Failed to create resume authenticator: %v", err)
+			os.Exit(1)
+		}
+		if config.ResumeTokenKeySet != "" {
+			util.Logger.Infof("Enabling stateless resume tokens, key set: %v", config.ResumeTokenKeySet)
+			authenticator.Signer, err = auth.NewTokenSigner(config.ResumeTokenKeySet)
+			if err != nil {
+				util.Logger.Criticalf("Failed to load resume token key set: %v", err)
+				os.Exit(1)
+			}
+			authenticator.UpstreamConsumeFunc = config.ResumeTokenConsumeFunc
+			authenticator.UpstreamRevokeFunc = config.ResumeTokenRevokeFunc
 		}
+		authenticator.TrustedAuthRoles = trustedAuthRoles
 		realm.Authenticators = append(realm.Authenticators, authenticator)
 		initers = append(initers, authenticator.Initialize)
+		closers = append(closers, authenticator)
 	}
 
-	if config.EnableAuthorizer || config.EnableFeatureAuthorizer {
+	// The guard is always installed, so the meta API is protected even without
+	// any authorizer.
+	guard := &auth.MessageGuard{
+		TrustedAuthRoles:     trustedAuthRoles,
+		MetaAPIPolicy:        config.MetaAPIPolicy,
+		AuthorizeWithdrawals: config.AuthorizeWithdrawals,
+	}
+	realm.Authorizer = guard
+	if config.AuthorizeWithdrawals {
+		// The authorizers need the URIs of the subscriptions and
+		// registrations to authorize UNSUBSCRIBE and UNREGISTER.
+		initers = append(initers, auth.TrackEndpoints)
+	}
 
-		trustedAuthRoles := mapset.NewSet()
-		for _, tAuthRole := range config.TrustedAuthRoles {
-			trustedAuthRoles.Add(tAuthRole)
-		}
-		// This is required to make the authorizer and authenticator working.
-		// If you use client.ConnectLocal, the client automagically gets the trusted auth role.
-		trustedAuthRoles.Add("trusted")
+	if len(config.AuthorizerChain) > 0 {
 
 		var consentMode multiauthorizer.ConsentMode
 
-		if config.ConsentMode == "all" {
+		switch config.ConsentMode {
+		case "all":
 			consentMode = multiauthorizer.ConsentModeAll
-		} else if config.ConsentMode == "one" {
+		case "one":
 			consentMode = multiauthorizer.ConsentModeOne
+		case "first-applicable":
+			consentMode = multiauthorizer.ConsentModeFirstApplicable
+		case "deny-overrides":
+			consentMode = multiauthorizer.ConsentModeDenyOverrides
+		case "permit-overrides":
+			consentMode = multiauthorizer.ConsentModePermitOverrides
+		case "majority":
+			consentMode = multiauthorizer.ConsentModeMajority
 		}
 
 		mAuth := multiauthorizer.New(consentMode)
+		mAuth.PermitDefault = config.AuthorizeFailed == cli.PermitAction
+		authorizers := map[string]router.Authorizer{}
+		// deciders can not authorize on their own, see multiauthorizer.Decider.
+		deciders := map[string]multiauthorizer.Decider{}
 
 		if config.EnableAuthorizer {
 			util.Logger.Infof("Enabling dynamic Authorization, func: %v", config.UpstreamAuthorizer)
@@ -158,9 +265,27 @@ func createRouterConfig(config cli.InterconnectConfiguration) (*router.Config, [
 				TrustedAuthRoles:   trustedAuthRoles,
 				PermitDefault:      config.AuthorizeFailed == cli.PermitAction,
 			}
+			if config.AuthorizerCacheSize > 0 {
+				util.Logger.Infof("Caching %d authorization decisions for %v", config.AuthorizerCacheSize, config.AuthorizerCacheTTL)
+				dynamicAuth.Cache = auth.NewDecisionCache(config.AuthorizerCacheSize, config.AuthorizerCacheTTL)
+				initers = append(initers, dynamicAuth.Cache.Initialize)
+			}
+			if config.AuthorizerPayload || len(config.AuthorizerPayloadURIs) > 0 {
+				payload, err := auth.NewPayloadConfig(
+					config.AuthorizerPayload,
+					config.AuthorizerPayloadURIs,
+					config.AuthorizerPayloadMaxSize,
+					config.AuthorizerPayloadRedact,
+				)
+				if err != nil {
+					util.Logger.Criticalf("Invalid authorizer payload URI: %v", err)
+					os.Exit(util.ExitArgument)
+				}
+				util.Logger.Infof("Passing payloads to the authorizer, all: %v, URIs: %v", payload.All, config.AuthorizerPayloadURIs)
+				dynamicAuth.Payload = payload
+			}
 
-			mAuth.Add("DynamicAuth", dynamicAuth)
-
+			authorizers[cli.DynamicAuthorizer] = dynamicAuth
 		}
 
 		if config.EnableFeatureAuthorizer {
@@ -172,12 +297,100 @@ func createRouterConfig(config cli.InterconnectConfiguration) (*router.Config, [
 				config.UpstreamFeatureAuthorizerMapping,
 				trustedAuthRoles,
 			)
+			authRef.RolesURI = config.UpstreamFeatureAuthorizerRoles
+			authRef.RefreshInterval = config.FeatureAuthorizerRefresh
+			authRef.UpdateTopic = config.FeatureAuthorizerUpdateTopic
+			authRef.RejectInvalidUpdates = config.FeatureAuthorizerRejectInvalid
 
-			mAuth.Add("FeatureAuth", authRef)
+			authorizers[cli.FeatureAuthorizer] = authRef
 			initers = append(initers, authRef.Initialize)
+			closers = append(closers, authRef)
+		}
+
+		if config.EnablePolicyAuthorizer {
+			util.Logger.Infof("Enabling Policy Authorization, file: %v", config.PolicyFile)
+
+			policyAuth, err := auth.NewPolicyAuthorizer(
+				config.AuthorizeFailed == cli.PermitAction,
+				config.PolicyFile,
+				trustedAuthRoles,
+			)
+			if err != nil {
+				util.Logger.Criticalf("Failed to load policy file: %v", err)
+				os.Exit(util.ExitArgument)
+			}
+			policyAuth.PollInterval = config.PolicyFilePollInterval
+			go policyAuth.Watch()
+			closers = append(closers, policyAuth)
+
+			authorizers[cli.PolicyAuthorizer] = policyAuth
+		}
+
+		if config.EnableAttributeAuthorizer {
+			attributeAuth := auth.NewAttributeAuthorizer(
+				config.AuthorizeFailed == cli.PermitAction,
+				config.AttributeRulesFile,
+				config.AttributeRulesFunc,
+				trustedAuthRoles,
+			)
+			attributeAuth.RefreshInterval = config.AttributeRulesRefresh
+			if config.AttributeRulesFile != "" {
+				util.Logger.Infof("Enabling Attribute Authorization, file: %v", config.AttributeRulesFile)
+				if err := attributeAuth.Load(context.Background()); err != nil {
+					util.Logger.Criticalf("Failed to load attribute rules: %v", err)
+					os.Exit(util.ExitArgument)
+				}
+				go attributeAuth.Watch()
+			} else {
+				// The rules are fetched via the local client, which is not
+				// connected yet.
+				util.Logger.Infof("Enabling Attribute Authorization, func: %v", config.AttributeRulesFunc)
+				initers = append(initers, func() {
+					go attributeAuth.Watch()
+				})
+			}
+
+			authorizers[cli.AttributeAuthorizer] = attributeAuth
+			closers = append(closers, attributeAuth)
 		}
 
-		realm.Authorizer = mAuth
+		if config.EnableRateLimiter {
+			util.Logger.Infof("Enabling Rate Limiting, file: %v", config.RateLimitFile)
+
+			rateLimiter, err := auth.NewRateLimiter(config.RateLimitFile, trustedAuthRoles)
+			if err != nil {
+				util.Logger.Criticalf("Failed to load rate limits: %v", err)
+				os.Exit(util.ExitArgument)
+			}
+
+			deciders[cli.RateLimiter] = rateLimiter
+			initers = append(initers, rateLimiter.Initialize)
+			closers = append(closers, rateLimiter)
+		}
+
+		for _, name := range config.AuthorizerChain {
+			if decider, ok := deciders[name]; ok {
+				mAuth.AddDecider(name, decider)
+			} else {
+				mAuth.Add(name, authorizers[name])
+			}
+		}
+		for _, name := range config.AuthorizerShadow {
+			if decider, ok := deciders[name]; ok {
+				mAuth.AddShadowDecider(name, decider)
+			} else {
+				mAuth.AddShadow(name, authorizers[name])
+			}
+		}
+		explainer := &auth.AuthorizationExplainer{
+			Authorizer:       mAuth,
+			TrustedAuthRoles: trustedAuthRoles,
+			Guard:            guard,
+		}
+		initers = append(initers, explainer.Initialize)
+		guard.Authorizer = mAuth
+	} else {
+		util.Logger.Warning("No authorizer is enabled, all actions of authenticated sessions are permitted.")
 	}
 
 	if config.ListenTLS != nil && config.ListenTLS.ClientCertPolicy != cli.DisableClientAuthentication {
@@ -186,7 +399,7 @@ func createRouterConfig(config cli.InterconnectConfiguration) (*router.Config, [
 			ValidClientCAs: config.ListenTLS.ValidClientCAs,
 		})
 	}
-	return routerConfig, initers
+	return routerConfig, initers, closers
 }
 
 func runTLSEndpoint(websocketServer *router.WebsocketServer, config cli.InterconnectConfiguration) io.Closer {
@@ -269,7 +482,18 @@ func main() {
 	util.Logger.Debug("Interconnect startup")
 	config := cli.ParseCLI()
 
-	routerConfig, initers := createRouterConfig(config)
+	util.UpstreamTimeout = config.UpstreamTimeout
+	util.UpstreamTimeoutOverrides = config.UpstreamTimeoutOverrides
+	auth.UpstreamBreakers.Config = auth.BreakerConfig{
+		FailureThreshold: config.UpstreamBreakerThreshold,
+		OpenDuration:     config.UpstreamBreakerOpenDuration,
+		HalfOpenProbes:   config.UpstreamBreakerHalfOpenProbes,
+	}
+
+	routerConfig, initers, closers := createRouterConfig(config)
+	// Deferred before closing the router, so the resources are closed after
+	// the router stopped using them.
+	defer closeAll(closers)
 
 	util.Router, err = router.NewRouter(routerConfig, nil)
 	if err != nil {
@@ -290,6 +514,12 @@ func main() {
 		util.Logger.Criticalf("Failed to connect local client: %v", err)
 		os.Exit(1)
 	}
+	// Don't wait for callees of timed out upstream calls, but still interrupt
+	// them so they can stop working on the call.
+	if err := util.LocalClient.SetCallCancelMode(wamp.CancelModeKillNoWait); err != nil {
+		util.Logger.Criticalf("Failed to set call cancel mode: %v", err)
+		os.Exit(1)
+	}
 	if err := util.RegisterPing(util.LocalClient); err != nil {
 		util.Logger.Criticalf("Failed to register ping function!")
 		os.Exit(1)
@@ -0,0 +1,74 @@
+package util
+
+import (
+	"context"
+	"time"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+const (
+	// ErrUpstreamTimeout is reported when an upstream procedure did not answer
+	// within its deadline.
+	ErrUpstreamTimeout wamp.URI = "ee.error.upstream-timeout"
+	// ErrUpstreamCanceled is reported when an upstream call was canceled before
+	// the procedure answered, e.g. because the invoking call was canceled.
+	ErrUpstreamCanceled wamp.URI = "ee.error.upstream-canceled"
+	// ErrUpstreamUnavailable is reported when an upstream call was not made
+	// because the upstream failed repeatedly before.
+	ErrUpstreamUnavailable wamp.URI = "ee.error.upstream-unavailable"
+)
+
+// UpstreamTimeout is the default deadline of upstream calls, 0 disables it.
+var UpstreamTimeout = 5 * time.Second
+
+// UpstreamTimeoutOverrides maps procedures to a deadline replacing
+// UpstreamTimeout for calls of that procedure.
+var UpstreamTimeoutOverrides = map[string]time.Duration{}
+
+// UpstreamError is returned by CallUpstream when an upstream call timed out or
+// was canceled. Its error string is the error URI, so authenticators can pass
+// it on to the client directly.
+type UpstreamError struct {
+	URI       wamp.URI
+	Procedure string
+	Err       error
+}
+
+func (e *UpstreamError) Error() string {
+	return string(e.URI)
+}
+
+// UpstreamTimeoutFor returns the deadline of calls to procedure.
+func UpstreamTimeoutFor(procedure string) time.Duration {
+	if timeout, ok := UpstreamTimeoutOverrides[procedure]; ok {
+		return timeout
+	}
+	return UpstreamTimeout
+}
+
+// CallUpstream calls procedure using the LocalClient. The call is canceled
+// when ctx is done or the deadline of the procedure is exceeded. Canceling
+// sends a CANCEL to the router, which interrupts the callee if it supports
+// call canceling.
+func CallUpstream(ctx context.Context, procedure string, args wamp.List, kwargs wamp.Dict) (*wamp.Result, error) {
+	if timeout := UpstreamTimeoutFor(procedure); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	result, err := LocalClient.Call(ctx, procedure, nil, args, kwargs, nil)
+	if err == nil {
+		return result, nil
+	}
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		Logger.Warningf("Call to `%s` timed out after %v: %s", procedure, time.Since(start), ErrUpstreamTimeout)
+		return nil, &UpstreamError{URI: ErrUpstreamTimeout, Procedure: procedure, Err: err}
+	case context.Canceled:
+		Logger.Warningf("Call to `%s` was canceled after %v: %s", procedure, time.Since(start), ErrUpstreamCanceled)
+		return nil, &UpstreamError{URI: ErrUpstreamCanceled, Procedure: procedure, Err: err}
+	}
+	return nil, err
+}